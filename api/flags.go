@@ -0,0 +1,163 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+)
+
+// FlagHandler is the admin API for quality flags. Every request needs
+// "Authorization: Bearer <Token>". There's one token, so SetBy is whoever
+// the client says set the flag; it's a note for the people sharing the
+// token, not an identity. The token goes in the clear, so off the local
+// network put it behind a proxy that does TLS.
+//
+//	GET    /flags?start=...&end=...  lists the flags over the range, a day by default
+//	POST   /flags                    adds the flag in the JSON body, like
+//	       {"Start": "2021-06-01T10:00:00-07:00", "End": "2021-06-01T12:00:00-07:00",
+//	        "Quality": "invalid", "Reason": "bird on the anemometer", "SetBy": "steve"}
+//	DELETE /flags?id=3               removes a flag
+type FlagHandler struct {
+	store db.Store
+	loc   *time.Location
+	Token string
+	// OnChange is called after a flag is added or removed, to rebuild
+	// what was made from the data it covers
+	OnChange func(f *rollup.Flag)
+}
+
+func NewFlagHandler(store db.Store, loc *time.Location, token string) *FlagHandler {
+	return &FlagHandler{
+		store: store,
+		loc:   loc,
+		Token: token,
+	}
+}
+
+func (h *FlagHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+h.Token)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.list(w, r)
+	case http.MethodPost:
+		h.add(w, r)
+	case http.MethodDelete:
+		h.remove(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *FlagHandler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	end := time.Now().In(h.loc)
+	var err error
+	if value := q.Get("end"); value != "" {
+		end, err = parseTime(value, h.loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-24 * time.Hour)
+	if value := q.Get("start"); value != "" {
+		start, err = parseTime(value, h.loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	flags, err := h.store.GetFlags(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, flags)
+}
+
+func (h *FlagHandler) add(w http.ResponseWriter, r *http.Request) {
+	f := &rollup.Flag{}
+	err := json.NewDecoder(r.Body).Decode(f)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("bad flag: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err = rollup.CheckQuality(f.Quality); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !f.Start.Before(f.End) {
+		http.Error(w, "the flag's End must be after its Start", http.StatusBadRequest)
+		return
+	}
+	if f.SetBy == "" {
+		http.Error(w, "SetBy is needed to say who set the flag", http.StatusBadRequest)
+		return
+	}
+	f.SetAt = time.Now()
+	err = h.store.SaveFlag(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("%v flagged %v to %v %v: %v", f.SetBy, f.Start, f.End, f.Quality, f.Reason)
+	h.changed(f)
+	writeJSON(w, http.StatusCreated, f)
+}
+
+func (h *FlagHandler) remove(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "bad flag id", http.StatusBadRequest)
+		return
+	}
+	// find it first so OnChange knows the range
+	var removed *rollup.Flag
+	flags, err := h.store.GetFlags(time.Time{}, time.Now().AddDate(100, 0, 0))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, f := range flags {
+		if f.ID == id {
+			removed = f
+		}
+	}
+	if removed == nil {
+		http.Error(w, fmt.Sprintf("no flag %v", id), http.StatusNotFound)
+		return
+	}
+	err = h.store.DeleteFlag(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Removed flag %v over %v to %v", id, removed.Start, removed.End)
+	h.changed(removed)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *FlagHandler) changed(f *rollup.Flag) {
+	if h.OnChange != nil {
+		h.OnChange(f)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
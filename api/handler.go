@@ -1,18 +1,35 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/smw1218/windygo/cache"
 	"github.com/smw1218/windygo/db"
 	"github.com/smw1218/windygo/plot"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
 )
 
-func CreateRoutes(mysql *db.Mysql) http.Handler {
+// CreateRoutes serves the store's summaries, reading the recent ones from
+// recent, and the live data in recent; times in requests without a zone are
+// in loc, the station's. flags is served at /flags unless it's nil.
+func CreateRoutes(store db.Store, recent *cache.Cache, loc *time.Location, flags *FlagHandler) http.Handler {
 	muxer := http.NewServeMux()
-	plotter := NewPlotter(mysql)
+	var summaries db.SummaryReader = store
+	if recent != nil {
+		summaries = recent
+		muxer.Handle("/latest", &LatestHandler{cache: recent})
+	}
+	plotter := NewPlotter(summaries)
+	plotter.loc = loc
 	muxer.HandleFunc("/plot", plotter.FullPlot)
+	muxer.Handle("/summaries", &SummaryHandler{summaries: summaries, loc: loc})
+	if flags != nil {
+		muxer.Handle("/flags", flags)
+	}
 	return muxer
 }
 
@@ -22,11 +39,12 @@ func CreateRoutes(mysql *db.Mysql) http.Handler {
 // safe for concurrent use and will also run the finish script so
 // will override the current report
 type Plotter struct {
-	mysql *db.Mysql
+	summaries db.SummaryReader
+	loc       *time.Location
 }
 
-func NewPlotter(mysql *db.Mysql) *Plotter {
-	return &Plotter{mysql: mysql}
+func NewPlotter(summaries db.SummaryReader) *Plotter {
+	return &Plotter{summaries: summaries}
 }
 
 func (p *Plotter) FullPlot(w http.ResponseWriter, r *http.Request) {
@@ -38,18 +56,19 @@ func (p *Plotter) FullPlot(w http.ResponseWriter, r *http.Request) {
 	if startQp == "" {
 		startTime = time.Now().Add(-reportSize)
 	} else {
-		startTime, err = time.Parse("2006-01-02T15:04:05", startQp)
+		startTime, err = parseTime(startQp, p.loc)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 	}
 
-	summaries, err := p.mysql.GetSummaries(startTime, reportSize, 300)
+	buckets, err := db.Query(p.summaries, startTime, startTime.Add(reportSize), 5*time.Minute, rollup.QualitySuspect)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	summaries := db.Summaries(buckets)
 
 	if len(summaries) == 0 {
 		http.Error(w, "no data found", http.StatusNotFound)
@@ -69,3 +88,90 @@ func (p *Plotter) FullPlot(w http.ResponseWriter, r *http.Request) {
 	defer f.Close()
 	http.ServeContent(w, r, "windreport", time.Now(), f)
 }
+
+// SummaryHandler returns the summaries from start to end in buckets as JSON.
+// start and end are 2006-01-02T15:04:05 in the station zone or RFC 3339;
+// end defaults to now and start to a day before end. bucket is a duration
+// like 30m and defaults to 5m. quality=valid leaves out suspect data as well
+// as invalid. Gaps are buckets without a Summary.
+type SummaryHandler struct {
+	summaries db.SummaryReader
+	loc       *time.Location
+}
+
+func (h *SummaryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	end := time.Now().In(h.loc)
+	var err error
+	if value := q.Get("end"); value != "" {
+		end, err = parseTime(value, h.loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	start := end.Add(-24 * time.Hour)
+	if value := q.Get("start"); value != "" {
+		start, err = parseTime(value, h.loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	bucket := 5 * time.Minute
+	if value := q.Get("bucket"); value != "" {
+		bucket, err = time.ParseDuration(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if maxBuckets := int64(10000); bucket > 0 && int64(end.Sub(start)/bucket) > maxBuckets {
+		http.Error(w, fmt.Sprintf("more than %v buckets, use a bigger bucket", maxBuckets), http.StatusBadRequest)
+		return
+	}
+
+	buckets, err := db.Query(h.summaries, start, end, bucket, q.Get("quality"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, buckets)
+}
+
+// LatestHandler returns the latest loop record and the newest summary of
+// each interval as JSON, like
+// {"Loop": {...}, "Summaries": {"60": {...}, "300": {...}}}
+type LatestHandler struct {
+	cache *cache.Cache
+}
+
+func (h *LatestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	latest := struct {
+		Loop      *vantage.LoopRecord
+		Summaries map[int64]*db.Summary
+	}{
+		Loop:      h.cache.Latest(),
+		Summaries: make(map[int64]*db.Summary),
+	}
+	for _, interval := range h.cache.Intervals() {
+		if s := h.cache.Newest(interval); s != nil {
+			latest.Summaries[s.SummarySeconds] = s
+		}
+	}
+	writeJSON(w, http.StatusOK, latest)
+}
+
+// parseTime parses a time in loc or in RFC 3339, in loc either way so daily
+// buckets are station days
+func parseTime(value string, loc *time.Location) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02T15:04:05", value, loc)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.In(loc), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// archive runs "windygo archive", which downloads the console's archive,
+// saves it and fills the gaps in the summaries it covers, and
+// "windygo archive fill -from <time> [-to <time>]" which fills the gaps from
+// the archive records already saved. The hourly and daily summaries
+// retention made from the range are made again.
+func archive(cfg storeConfig, host string, intervalsFlag, policyFlag string, args []string) error {
+	fill := len(args) > 0 && args[0] == "fill"
+	if fill {
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("archive", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the range to fill, 2006-01-02 or 2006-01-02T15:04 station time")
+	to := flags.String("to", "", "end of the range to fill, defaults to now")
+	period := flags.Duration("period", 0, "the console's archive interval, worked out from the records if not set")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+
+	clock := vantage.NewClock(cfg.location)
+	store, err := openStore(cfg, clock, rollup.NewEngine(intervals), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var start time.Time
+	end := time.Now()
+	if fill {
+		if *from == "" {
+			return fmt.Errorf("archive fill needs -from")
+		}
+		start, err = parseLocalTime(*from, cfg.location)
+		if err != nil {
+			return err
+		}
+		if *to != "" {
+			end, err = parseLocalTime(*to, cfg.location)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		ars, err := downloadArchive(host, clock)
+		if err != nil {
+			return err
+		}
+		if len(ars) == 0 {
+			log.Println("The console's archive is empty")
+			return nil
+		}
+		err = store.SaveArchiveRecords(ars)
+		if err != nil {
+			return err
+		}
+		// the archive is a ring so the oldest record isn't always first
+		start, end = ars[0].HostTime, ars[0].HostTime
+		for _, ar := range ars {
+			if ar.HostTime.Before(start) {
+				start = ar.HostTime
+			}
+			if ar.HostTime.After(end) {
+				end = ar.HostTime
+			}
+		}
+		log.Printf("Saved %v archive records from %v to %v", len(ars), start, end)
+	}
+
+	filled, err := db.FillGaps(store, intervals, start, end, *period, cfg.location)
+	if err != nil {
+		return err
+	}
+	log.Printf("Filled %v summaries from the archive", filled)
+	if filled == 0 {
+		return nil
+	}
+	return regenerate(store, cfg, policyFlag, intervals, start, end)
+}
+
+func downloadArchive(host string, clock *vantage.Clock) ([]*vantage.ArchiveRecord, error) {
+	vc, err := vantage.Dial(host)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to vantage: %w", err)
+	}
+	defer vc.Close()
+	// archive records only have console time so the offset is
+	// needed to put them on the host timeline
+	vc.Clock = clock
+	err = vc.SyncClock()
+	if err != nil {
+		return nil, fmt.Errorf("error reading console time: %w", err)
+	}
+	return vc.GetArchiveRecords()
+}
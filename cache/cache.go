@@ -0,0 +1,247 @@
+// Package cache keeps the latest loop record and a rolling window of recent
+// summaries of each interval in memory, so the plots, the API and anything
+// else watching the live data read the same thing without going to the
+// database.
+package cache
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// SummarySource reads saved summaries for the ranges the cache doesn't hold
+type SummarySource interface {
+	GetSummaryRange(start, end time.Time, summarySeconds int) ([]*rollup.Summary, error)
+}
+
+// Update is a new loop record or summary sent to subscribers; one of the
+// two is set
+type Update struct {
+	Loop    *vantage.LoopRecord
+	Summary *rollup.Summary
+}
+
+// Cache is safe for concurrent use. Summaries and loop records given to it
+// or returned by it must not be changed.
+type Cache struct {
+	// Size is how far back each interval's window reaches from its newest
+	// summary
+	Size time.Duration
+	// Location is the zone of the returned summaries and of the periods
+	// Window lines up with; nil is UTC
+	Location *time.Location
+	// Store is read for the ranges the windows don't cover; it may be nil
+	Store SummarySource
+
+	mutex   sync.RWMutex
+	latest  *vantage.LoopRecord
+	windows map[int64]*window // by summary seconds
+
+	subMutex sync.Mutex
+	subs     []*Subscription
+}
+
+// window is an interval's summaries, oldest first. The window is complete
+// from from on: every summary saved since then is in it.
+type window struct {
+	summaries []*rollup.Summary
+	from      time.Time
+}
+
+func New(size time.Duration) *Cache {
+	return &Cache{
+		Size:    size,
+		windows: make(map[int64]*window),
+	}
+}
+
+// Load fills the windows of intervals up to now from the store, replacing
+// what they held. It's called on start and after flags change the quality
+// of saved summaries.
+func (c *Cache) Load(intervals []time.Duration, now time.Time) error {
+	from := now.Add(-c.Size)
+	loaded := make(map[int64]*window, len(intervals))
+	for _, interval := range intervals {
+		seconds := int64(interval / time.Second)
+		w := &window{from: from}
+		if c.Store != nil {
+			ss, err := c.Store.GetSummaryRange(from, now, int(seconds))
+			if err != nil {
+				return err
+			}
+			w.summaries = ss
+		}
+		loaded[seconds] = w
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for seconds, w := range loaded {
+		// keep what was added while the store was read; the store's
+		// copies win since they have the latest flags
+		if old, ok := c.windows[seconds]; ok {
+			fresh := w.summaries
+			w.summaries = old.summaries
+			for _, s := range fresh {
+				w.add(s)
+			}
+			w.trim(c.Size)
+		}
+		c.windows[seconds] = w
+	}
+	return nil
+}
+
+// LoadEvery calls Load every interval until stop is closed, so summaries
+// saved by another process, like windygo rebuild or import, show up without
+// a restart
+func (c *Cache) LoadEvery(intervals []time.Duration, every time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if err := c.Load(intervals, now); err != nil {
+				log.Printf("Error reloading recent summaries: %v", err)
+			}
+		}
+	}
+}
+
+// AddLoop makes lr the latest loop record
+func (c *Cache) AddLoop(lr *vantage.LoopRecord) {
+	c.mutex.Lock()
+	c.latest = lr
+	c.mutex.Unlock()
+	c.publish(Update{Loop: lr})
+}
+
+// AddSummary adds the summary to its interval's window, replacing any with
+// the same start, and drops the ones that fell out of the window
+func (c *Cache) AddSummary(s *rollup.Summary) {
+	copied := *s
+	c.mutex.Lock()
+	w, ok := c.windows[s.SummarySeconds]
+	if !ok {
+		// complete from the first one added
+		w = &window{from: s.StartTime}
+		c.windows[s.SummarySeconds] = w
+	}
+	w.add(&copied)
+	w.trim(c.Size)
+	c.mutex.Unlock()
+	c.publish(Update{Summary: &copied})
+}
+
+func (w *window) add(s *rollup.Summary) {
+	i := sort.Search(len(w.summaries), func(i int) bool { return !w.summaries[i].StartTime.Before(s.StartTime) })
+	if i < len(w.summaries) && w.summaries[i].StartTime.Equal(s.StartTime) {
+		w.summaries[i] = s
+		return
+	}
+	w.summaries = append(w.summaries, nil)
+	copy(w.summaries[i+1:], w.summaries[i:])
+	w.summaries[i] = s
+}
+
+func (w *window) trim(size time.Duration) {
+	if len(w.summaries) == 0 {
+		return
+	}
+	oldest := w.summaries[len(w.summaries)-1].StartTime.Add(-size)
+	if oldest.After(w.from) {
+		w.from = oldest
+	}
+	i := sort.Search(len(w.summaries), func(i int) bool { return !w.summaries[i].StartTime.Before(oldest) })
+	w.summaries = append(w.summaries[:0:0], w.summaries[i:]...)
+}
+
+// Latest is the latest loop record, nil before the first
+func (c *Cache) Latest() *vantage.LoopRecord {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.latest
+}
+
+// Intervals are the intervals with windows, shortest first
+func (c *Cache) Intervals() []time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	intervals := make([]time.Duration, 0, len(c.windows))
+	for seconds := range c.windows {
+		intervals = append(intervals, time.Duration(seconds)*time.Second)
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	return intervals
+}
+
+// Newest is the newest summary of the interval, nil if there are none
+func (c *Cache) Newest(interval time.Duration) *rollup.Summary {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	w, ok := c.windows[int64(interval/time.Second)]
+	if !ok || len(w.summaries) == 0 {
+		return nil
+	}
+	return c.in(w.summaries[len(w.summaries)-1])
+}
+
+// GetSummaryRange returns the summaries that start from start up to end,
+// oldest first, like the stores. Ranges the window doesn't cover are read
+// from Store.
+func (c *Cache) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*rollup.Summary, error) {
+	c.mutex.RLock()
+	w, ok := c.windows[int64(summarySeconds)]
+	if !ok || start.Before(w.from) {
+		c.mutex.RUnlock()
+		if c.Store == nil {
+			return []*rollup.Summary{}, nil
+		}
+		return c.Store.GetSummaryRange(start, end, summarySeconds)
+	}
+	defer c.mutex.RUnlock()
+	ss := make([]*rollup.Summary, 0)
+	for _, s := range w.summaries {
+		if !s.StartTime.Before(start) && s.StartTime.Before(end) {
+			ss = append(ss, c.in(s))
+		}
+	}
+	return ss, nil
+}
+
+// Window returns a summary of the interval for each period from start up to
+// end, with nils for the gaps, like the stores' GetSummaries
+func (c *Cache) Window(interval time.Duration, start, end time.Time) ([]*rollup.Summary, error) {
+	start = rollup.PeriodStart(start, interval, c.Location)
+	ss, err := c.GetSummaryRange(start, end, int(interval/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	periods := make([]*rollup.Summary, 0, int(end.Sub(start)/interval))
+	next := 0
+	for period := start; period.Before(end); period = rollup.PeriodEnd(period, interval, c.Location) {
+		var found *rollup.Summary
+		for next < len(ss) && ss[next].StartTime.Before(rollup.PeriodEnd(period, interval, c.Location)) {
+			found = ss[next]
+			next++
+		}
+		periods = append(periods, found)
+	}
+	return periods, nil
+}
+
+// in is a copy of s in the cache's zone
+func (c *Cache) in(s *rollup.Summary) *rollup.Summary {
+	copied := *s
+	loc := c.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return copied.In(loc)
+}
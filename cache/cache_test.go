@@ -0,0 +1,129 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/cache"
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+func minute(start time.Time, i int, wind float64) *rollup.Summary {
+	return &rollup.Summary{StartTime: start.Add(time.Duration(i) * time.Minute),
+		EndTime: start.Add(time.Duration(i+1) * time.Minute), SummarySeconds: 60, WindAvg: wind}
+}
+
+func TestWindows(t *testing.T) {
+	store := db.NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		if err := store.SaveSummary(minute(start, i, 5)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := cache.New(20 * time.Minute)
+	c.Store = store
+	if err := c.Load([]time.Duration{time.Minute}, start.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	ss, err := c.GetSummaryRange(start.Add(10*time.Minute), start.Add(time.Hour), 60)
+	if err != nil || len(ss) != 20 {
+		t.Fatalf("expected 20 summaries got %v %v", len(ss), err)
+	}
+	// older than the window comes from the store
+	if ss, err = c.GetSummaryRange(start, start.Add(time.Hour), 60); err != nil || len(ss) != 30 {
+		t.Fatalf("expected 30 summaries got %v %v", len(ss), err)
+	}
+
+	// a replaced summary takes the old one's place and the window moves on
+	c.AddSummary(minute(start, 29, 15))
+	c.AddSummary(minute(start, 35, 20))
+	ss, err = c.GetSummaryRange(start.Add(15*time.Minute), start.Add(time.Hour), 60)
+	if err != nil || len(ss) != 16 || ss[14].WindAvg != 15 || ss[15].WindAvg != 20 {
+		t.Fatalf("unexpected summaries %v %v", len(ss), err)
+	}
+	if s := c.Newest(time.Minute); s == nil || !s.StartTime.Equal(start.Add(35*time.Minute)) {
+		t.Fatalf("unexpected newest %+v", s)
+	}
+
+	window, err := c.Window(time.Minute, start.Add(25*time.Minute), start.Add(40*time.Minute))
+	if err != nil || len(window) != 15 {
+		t.Fatalf("expected 15 periods got %v %v", len(window), err)
+	}
+	if window[4].WindAvg != 15 || window[5] != nil || window[10].WindAvg != 20 || window[14] != nil {
+		t.Fatalf("unexpected window %v", window)
+	}
+
+	// what's returned is a copy
+	window[4].WindAvg = 0
+	if c.Newest(time.Minute).WindAvg != 20 {
+		t.Fatal("changing a returned summary changed the cache")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c := cache.New(time.Hour)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	summaries := c.Subscribe(false)
+	everything := c.Subscribe(true)
+	// more than a channel buffer while nobody reads
+	for i := 0; i < 100; i++ {
+		c.AddLoop(&vantage.LoopRecord{Recorded: start.Add(time.Duration(i) * 2 * time.Second), Wind: i})
+		c.AddSummary(minute(start, i, float64(i)))
+	}
+	if lr := c.Latest(); lr == nil || lr.Wind != 99 {
+		t.Fatalf("unexpected latest %+v", lr)
+	}
+	for i := 0; i < 100; i++ {
+		u := <-summaries.C
+		if u.Summary == nil || u.Summary.WindAvg != float64(i) {
+			t.Fatalf("expected summary %v got %+v", i, u)
+		}
+	}
+	for i := 0; i < 200; i++ {
+		u := <-everything.C
+		if (i%2 == 0) != (u.Loop != nil) {
+			t.Fatalf("unexpected update %v %+v", i, u)
+		}
+	}
+	if summaries.Dropped() != 0 {
+		t.Fatalf("dropped %v", summaries.Dropped())
+	}
+	c.Unsubscribe(summaries)
+	c.AddSummary(minute(start, 100, 1))
+	if _, ok := <-summaries.C; ok {
+		t.Fatal("expected the subscription closed")
+	}
+	if u := <-everything.C; u.Summary == nil || u.Summary.WindAvg != 1 {
+		t.Fatalf("unexpected update %+v", u)
+	}
+}
+
+func TestLoadEvery(t *testing.T) {
+	store := db.NewMemory()
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Minute)
+	if err := store.SaveSummary(minute(start, 0, 5)); err != nil {
+		t.Fatal(err)
+	}
+	c := cache.New(time.Hour)
+	c.Store = store
+	if err := c.Load([]time.Duration{time.Minute}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process rebuilds it, so it doesn't go through the cache
+	if err := store.SaveSummary(minute(start, 0, 12)); err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go c.LoadEvery([]time.Duration{time.Minute}, 10*time.Millisecond, stop)
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if s := c.Newest(time.Minute); s != nil && s.WindAvg == 12 {
+			return
+		}
+	}
+	t.Fatalf("expected the rebuilt summary got %+v", c.Newest(time.Minute))
+}
@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"sync"
+)
+
+// maxPending is how many updates a subscriber can fall behind before the
+// oldest are dropped
+const maxPending = 10000
+
+// Subscription receives the cache's updates on C in order. Unlike a buffered
+// channel, a slow subscriber doesn't lose updates until it's maxPending
+// behind, and it never holds up the cache or the other subscribers.
+type Subscription struct {
+	C <-chan Update
+
+	c       chan Update
+	loop    bool
+	mutex   sync.Mutex
+	pending []Update
+	dropped int64
+	ready   chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Subscribe returns a subscription to new summaries, and to new loop
+// records as well if loop is set
+func (c *Cache) Subscribe(loop bool) *Subscription {
+	ch := make(chan Update)
+	sub := &Subscription{
+		C:     ch,
+		c:     ch,
+		loop:  loop,
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	c.subMutex.Lock()
+	c.subs = append(c.subs, sub)
+	c.subMutex.Unlock()
+	go sub.deliver()
+	return sub
+}
+
+// Unsubscribe stops the subscription and closes its C
+func (c *Cache) Unsubscribe(sub *Subscription) {
+	c.subMutex.Lock()
+	for i, s := range c.subs {
+		if s == sub {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			break
+		}
+	}
+	c.subMutex.Unlock()
+	sub.once.Do(func() { close(sub.done) })
+}
+
+func (c *Cache) publish(u Update) {
+	c.subMutex.Lock()
+	defer c.subMutex.Unlock()
+	for _, sub := range c.subs {
+		if u.Loop != nil && !sub.loop {
+			continue
+		}
+		sub.push(u)
+	}
+}
+
+// Dropped is how many updates were dropped because the subscriber fell too
+// far behind
+func (sub *Subscription) Dropped() int64 {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	return sub.dropped
+}
+
+func (sub *Subscription) push(u Update) {
+	sub.mutex.Lock()
+	if len(sub.pending) >= maxPending {
+		sub.pending = sub.pending[1:]
+		sub.dropped++
+	}
+	sub.pending = append(sub.pending, u)
+	sub.mutex.Unlock()
+	select {
+	case sub.ready <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends the pending updates to C until the subscription stops
+func (sub *Subscription) deliver() {
+	defer close(sub.c)
+	for {
+		sub.mutex.Lock()
+		if len(sub.pending) == 0 {
+			sub.mutex.Unlock()
+			select {
+			case <-sub.ready:
+				continue
+			case <-sub.done:
+				return
+			}
+		}
+		u := sub.pending[0]
+		sub.pending[0] = Update{}
+		sub.pending = sub.pending[1:]
+		sub.mutex.Unlock()
+		select {
+		case sub.c <- u:
+		case <-sub.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smw1218/windygo/climate"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// climateInterval is the shortest of intervals; the daily aggregates are
+// made from its summaries
+func climateInterval(intervals []time.Duration) time.Duration {
+	shortest := intervals[0]
+	for _, interval := range intervals {
+		if interval < shortest {
+			shortest = interval
+		}
+	}
+	return shortest
+}
+
+// climateCmd runs "windygo climate rebuild -from <day> -to <day>". It remakes
+// the daily aggregates of the range from the saved summaries, falling back to
+// the longer intervals for days whose short summaries have been pruned, then
+// remakes the records from all the saved days.
+func climateCmd(cfg storeConfig, intervalsFlag string, args []string) error {
+	if len(args) == 0 || args[0] != "rebuild" {
+		return fmt.Errorf("usage: windygo climate rebuild -from 2006-01-02 [-to 2006-01-02]")
+	}
+	flags := flag.NewFlagSet("climate rebuild", flag.ContinueOnError)
+	from := flags.String("from", "", "first day to rebuild, 2006-01-02 in the station zone")
+	to := flags.String("to", "", "last day to rebuild, defaults to today")
+	flags.StringVar(&intervalsFlag, "intervals", intervalsFlag+",1h,24h", "summary intervals to read, shortest first for each day")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *from == "" {
+		return fmt.Errorf("climate rebuild needs -from")
+	}
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+	clock := vantage.NewClock(cfg.location)
+	last := *to
+	if last == "" {
+		last = time.Now().In(clock.Location()).Format(climate.DayFormat)
+	}
+
+	store, err := openStore(cfg, clock, rollup.NewEngine(intervals), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	tracker, err := climate.NewTracker(store, cfg.station, clock.Location(), climateInterval(intervals))
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilding days from %v to %v", *from, last)
+	err = tracker.Rebuild(store, *from, last, intervals)
+	if err != nil {
+		return err
+	}
+	for _, r := range tracker.Records() {
+		fmt.Printf("%v\t%v\t%.1f\t%v\n", r.Scope, r.Metric, r.Value, r.Day)
+	}
+	return nil
+}
@@ -0,0 +1,444 @@
+package climate
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+)
+
+// DayFormat is how days are keyed, in the station zone
+const DayFormat = "2006-01-02"
+
+// DefaultThresholds are the wind speeds in mph that hours above are counted for
+var DefaultThresholds = []int{10, 15, 20, 25}
+
+// Day is the aggregate of a day in the station's time zone
+type Day struct {
+	Station          string
+	Day              string // DayFormat in the station zone
+	StartTime        time.Time
+	EndTime          time.Time
+	Measurements     int64
+	WindAvg          float64
+	MaxGust          float64
+	MaxGustTime      time.Time
+	MaxGustDirection int64
+	HoursAbove       map[int]float64 // hours with the average at or above the speed
+	TempHigh         float64
+	TempLow          float64
+	RainTotal        float64
+}
+
+// Add adds a summary from the day. The gust time is the start of the summary
+// it was in and its direction is that summary's average direction. Summaries
+// flagged invalid are skipped.
+func (d *Day) Add(s *rollup.Summary, thresholds []int) {
+	if s.Measurements == 0 || s.Quality == rollup.QualityInvalid {
+		return
+	}
+	if d.Measurements == 0 {
+		d.MaxGust = s.WindGust
+		d.MaxGustTime = s.StartTime
+		d.MaxGustDirection = s.WindDirectionAvg
+		d.TempHigh = s.OutsideTempMax
+		d.TempLow = s.OutsideTempMin
+	}
+	total := d.Measurements + s.Measurements
+	d.WindAvg = (d.WindAvg*float64(d.Measurements) + s.WindAvg*float64(s.Measurements)) / float64(total)
+	d.Measurements = total
+	if s.WindGust > d.MaxGust {
+		d.MaxGust = s.WindGust
+		d.MaxGustTime = s.StartTime
+		d.MaxGustDirection = s.WindDirectionAvg
+	}
+	if d.HoursAbove == nil {
+		d.HoursAbove = make(map[int]float64, len(thresholds))
+	}
+	for _, threshold := range thresholds {
+		if s.WindAvg >= float64(threshold) {
+			d.HoursAbove[threshold] += float64(s.SummarySeconds) / 3600
+		}
+	}
+	if s.OutsideTempMax > d.TempHigh {
+		d.TempHigh = s.OutsideTempMax
+	}
+	if s.OutsideTempMin < d.TempLow {
+		d.TempLow = s.OutsideTempMin
+	}
+	d.RainTotal += s.RainTotal
+}
+
+// Scopes of records
+const (
+	AllTime = "all"
+)
+
+// MonthScope is the scope of records for a calendar month in any year
+func MonthScope(month time.Month) string {
+	return fmt.Sprintf("month-%02d", int(month))
+}
+
+// Record is the best value of a metric in a scope
+type Record struct {
+	Station string
+	Scope   string // AllTime or a MonthScope
+	Metric  string
+	Value   float64
+	Day     string
+	Time    time.Time // when it happened, the start of the day for daily totals
+}
+
+// Metrics that records are kept for
+const (
+	MaxGust    = "max_gust"
+	MaxWindAvg = "max_wind_avg"
+	MaxTemp    = "max_temp"
+	MinTemp    = "min_temp"
+	MaxRain    = "max_rain"
+)
+
+// metric reads the value of a record metric from a day
+type metric struct {
+	name   string
+	lowest bool // lower values are records
+	value  func(d *Day) (float64, time.Time)
+}
+
+var metrics = []metric{
+	{MaxGust, false, func(d *Day) (float64, time.Time) { return d.MaxGust, d.MaxGustTime }},
+	{MaxWindAvg, false, func(d *Day) (float64, time.Time) { return d.WindAvg, d.StartTime }},
+	{MaxTemp, false, func(d *Day) (float64, time.Time) { return d.TempHigh, d.StartTime }},
+	{MinTemp, true, func(d *Day) (float64, time.Time) { return d.TempLow, d.StartTime }},
+	{MaxRain, false, func(d *Day) (float64, time.Time) { return d.RainTotal, d.StartTime }},
+}
+
+// Event is sent when a record is broken. Previous is nil for the first
+// value of a metric.
+type Event struct {
+	Record   Record
+	Previous *Record
+}
+
+func (e Event) String() string {
+	if e.Previous == nil {
+		return fmt.Sprintf("New %v %v record %.1f on %v", e.Record.Scope, e.Record.Metric, e.Record.Value, e.Record.Day)
+	}
+	return fmt.Sprintf("New %v %v record %.1f on %v, was %.1f on %v", e.Record.Scope, e.Record.Metric,
+		e.Record.Value, e.Record.Day, e.Previous.Value, e.Previous.Day)
+}
+
+// Store keeps the days and records and reads the summaries they're made
+// from; all the db stores are one
+type Store interface {
+	SummarySource
+	// SaveDay saves the day, replacing the saved one
+	SaveDay(d *Day) error
+	// GetDays returns the days from from to to inclusive, oldest first
+	GetDays(from, to string) ([]*Day, error)
+	DeleteDays(from, to string) error
+	// SaveRecord saves the record, replacing the one for its scope and metric
+	SaveRecord(r *Record) error
+	GetRecords() ([]*Record, error)
+	DeleteRecords() error
+}
+
+// Tracker keeps the daily aggregates and records up to date from the
+// summaries of one interval. It's a rollup.Sink; summaries of other
+// intervals are ignored. A day is remade from all of its summaries each time
+// one is saved, so saving a summary again, like in a replay, replaces it
+// instead of counting it twice. Breaking a record sends an event the first
+// time it's broken each day; it keeps improving quietly after that.
+type Tracker struct {
+	Store      Store
+	Station    string
+	Location   *time.Location
+	Interval   time.Duration
+	Thresholds []int
+	// Flags reads the quality flags over live summaries; flags set later
+	// need a Rebuild of their days
+	Flags    func(start, end time.Time) ([]*rollup.Flag, error)
+	mutex    sync.Mutex
+	days     map[string]*trackedDay
+	records  map[string]*Record // by scope and metric
+	subMutex sync.Mutex
+	subs     []chan Event
+}
+
+// NewTracker loads the records from store
+func NewTracker(store Store, station string, loc *time.Location, interval time.Duration) (*Tracker, error) {
+	t := &Tracker{
+		Store:      store,
+		Station:    station,
+		Location:   loc,
+		Interval:   interval,
+		Thresholds: DefaultThresholds,
+		days:       make(map[string]*trackedDay),
+		records:    make(map[string]*Record),
+	}
+	records, err := store.GetRecords()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range records {
+		t.records[recordKey(r.Scope, r.Metric)] = r
+	}
+	return t, nil
+}
+
+func recordKey(scope, metric string) string {
+	return scope + "/" + metric
+}
+
+// Events returns a channel that receives the broken records. Slow
+// subscribers miss events rather than blocking the tracker.
+func (t *Tracker) Events() <-chan Event {
+	t.subMutex.Lock()
+	defer t.subMutex.Unlock()
+	c := make(chan Event, 10)
+	t.subs = append(t.subs, c)
+	return c
+}
+
+func (t *Tracker) publish(e Event) {
+	t.subMutex.Lock()
+	defer t.subMutex.Unlock()
+	for _, c := range t.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// SaveSummary adds the summary to its day and checks the records
+func (t *Tracker) SaveSummary(s *rollup.Summary) error {
+	if time.Duration(s.SummarySeconds)*time.Second != t.Interval {
+		return nil
+	}
+	if t.Flags != nil {
+		flags, err := t.Flags(s.StartTime, s.EndTime)
+		if err != nil {
+			return fmt.Errorf("error reading flags: %w", err)
+		}
+		rollup.ApplyFlags([]*rollup.Summary{s}, flags)
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	tracked, err := t.day(s.StartTime)
+	if err != nil {
+		return err
+	}
+	tracked.summaries[s.StartTime.Unix()] = s
+	day := tracked.remake(t.Thresholds)
+	err = t.Store.SaveDay(day)
+	if err != nil {
+		return fmt.Errorf("error saving day %v: %w", day.Day, err)
+	}
+	for _, e := range t.check(day) {
+		err = t.Store.SaveRecord(&e.Record)
+		if err != nil {
+			return fmt.Errorf("error saving record: %w", err)
+		}
+		if e.Previous == nil || e.Previous.Day != e.Record.Day {
+			t.publish(e)
+		}
+	}
+	return nil
+}
+
+// trackedDay is a day with the summaries it's made from, by start time
+type trackedDay struct {
+	day       *Day
+	summaries map[int64]*rollup.Summary
+}
+
+// remake makes the day again from its summaries in time order
+func (d *trackedDay) remake(thresholds []int) *Day {
+	ss := make([]*rollup.Summary, 0, len(d.summaries))
+	for _, s := range d.summaries {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool { return ss[i].StartTime.Before(ss[j].StartTime) })
+	d.day = &Day{
+		Station:   d.day.Station,
+		Day:       d.day.Day,
+		StartTime: d.day.StartTime,
+		EndTime:   d.day.EndTime,
+	}
+	for _, s := range ss {
+		d.day.Add(s, thresholds)
+	}
+	return d.day
+}
+
+// day returns the day of t from the cache, or with its saved summaries from
+// the store. Only the current and previous days are cached. The mutex must
+// be held.
+func (t *Tracker) day(at time.Time) (*trackedDay, error) {
+	local := at.In(t.Location)
+	key := local.Format(DayFormat)
+	if d, ok := t.days[key]; ok {
+		return d, nil
+	}
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, t.Location)
+	end := start.AddDate(0, 0, 1)
+	ss, err := t.Store.GetSummaryRange(start, end, int(t.Interval/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	d := &trackedDay{
+		day: &Day{
+			Station:   t.Station,
+			Day:       key,
+			StartTime: start,
+			EndTime:   end,
+		},
+		summaries: make(map[int64]*rollup.Summary, len(ss)+1),
+	}
+	for _, s := range ss {
+		d.summaries[s.StartTime.Unix()] = s
+	}
+	if len(t.days) > 1 {
+		t.days = make(map[string]*trackedDay)
+	}
+	t.days[key] = d
+	return d, nil
+}
+
+// check returns the records the day has broken and updates them. The mutex
+// must be held.
+func (t *Tracker) check(d *Day) []Event {
+	if d.Measurements == 0 {
+		return nil
+	}
+	var events []Event
+	month, err := time.ParseInLocation(DayFormat, d.Day, t.Location)
+	if err != nil {
+		log.Printf("Bad day %q: %v", d.Day, err)
+		return nil
+	}
+	for _, scope := range []string{AllTime, MonthScope(month.Month())} {
+		for _, m := range metrics {
+			value, at := m.value(d)
+			key := recordKey(scope, m.name)
+			previous := t.records[key]
+			if previous != nil {
+				if value == previous.Value || (value < previous.Value) != m.lowest {
+					continue
+				}
+			}
+			record := &Record{
+				Station: t.Station,
+				Scope:   scope,
+				Metric:  m.name,
+				Value:   value,
+				Day:     d.Day,
+				Time:    at,
+			}
+			t.records[key] = record
+			events = append(events, Event{Record: *record, Previous: previous})
+		}
+	}
+	return events
+}
+
+// Rebuild remakes the days from from to to (DayFormat, inclusive) from the
+// saved summaries, then remakes the records from every saved day. Each day
+// uses the shortest of intervals that has summaries for it, so days that
+// only have hourly summaries left are still counted. No events are sent.
+func (t *Tracker) Rebuild(summaries SummarySource, from, to string, intervals []time.Duration) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	first, err := time.ParseInLocation(DayFormat, from, t.Location)
+	if err != nil {
+		return fmt.Errorf("bad day %q: %w", from, err)
+	}
+	last, err := time.ParseInLocation(DayFormat, to, t.Location)
+	if err != nil {
+		return fmt.Errorf("bad day %q: %w", to, err)
+	}
+	sorted := append([]time.Duration(nil), intervals...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	err = t.Store.DeleteDays(from, to)
+	if err != nil {
+		return err
+	}
+	t.days = make(map[string]*trackedDay)
+	rebuilt := 0
+	for start := first; !start.After(last); start = start.AddDate(0, 0, 1) {
+		end := start.AddDate(0, 0, 1)
+		d := &Day{
+			Station:   t.Station,
+			Day:       start.Format(DayFormat),
+			StartTime: start,
+			EndTime:   end,
+		}
+		for _, interval := range sorted {
+			ss, err := summaries.GetSummaryRange(start, end, int(interval/time.Second))
+			if err != nil {
+				return err
+			}
+			if len(ss) == 0 {
+				continue
+			}
+			for _, s := range ss {
+				d.Add(s, t.Thresholds)
+			}
+			break
+		}
+		if d.Measurements == 0 {
+			continue
+		}
+		err = t.Store.SaveDay(d)
+		if err != nil {
+			return err
+		}
+		rebuilt++
+	}
+	log.Printf("Rebuilt %v days", rebuilt)
+
+	err = t.Store.DeleteRecords()
+	if err != nil {
+		return err
+	}
+	t.records = make(map[string]*Record)
+	days, err := t.Store.GetDays("", "9999-12-31")
+	if err != nil {
+		return err
+	}
+	for _, d := range days {
+		t.check(d)
+	}
+	for _, r := range t.records {
+		err = t.Store.SaveRecord(r)
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Rebuilt %v records from %v days", len(t.records), len(days))
+	return nil
+}
+
+// Records returns the current records sorted by scope and metric
+func (t *Tracker) Records() []Record {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	records := make([]Record, 0, len(t.records))
+	for _, r := range t.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return recordKey(records[i].Scope, records[i].Metric) < recordKey(records[j].Scope, records[j].Metric)
+	})
+	return records
+}
+
+// SummarySource reads saved summaries
+type SummarySource interface {
+	GetSummaryRange(start, end time.Time, summarySeconds int) ([]*rollup.Summary, error)
+}
@@ -0,0 +1,115 @@
+package climate_test
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/climate"
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+)
+
+func TestTracker(t *testing.T) {
+	testTracker(t, db.NewMemory())
+	sqlite, err := db.NewSQLite(filepath.Join(t.TempDir(), "windygo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+	testTracker(t, sqlite)
+}
+
+func testTracker(t *testing.T, store db.Store) {
+	loc := time.FixedZone("PDT", -7*3600)
+	tracker, err := climate.NewTracker(store, "", loc, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := tracker.Events()
+
+	// 22:00 and 23:00 local on June 1st are the next day in UTC
+	start := time.Date(2021, 6, 1, 22, 0, 0, 0, loc)
+	var broken []climate.Event
+	for i, wind := range []float64{12, 18, 8} {
+		s := &rollup.Summary{
+			StartTime:      start.Add(time.Duration(i) * time.Hour),
+			EndTime:        start.Add(time.Duration(i+1) * time.Hour),
+			SummarySeconds: 3600,
+			Measurements:   1200,
+			WindAvg:        wind,
+			WindGust:       wind + 10,
+			OutsideTempMin: 60 - float64(i),
+			OutsideTempMax: 70,
+			RainTotal:      0.1,
+		}
+		if err = store.SaveSummary(s); err != nil {
+			t.Fatal(err)
+		}
+		// saved twice, like by a replay, it's only counted once
+		for j := 0; j < 2; j++ {
+			if err = tracker.SaveSummary(s); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for len(events) > 0 {
+			broken = append(broken, <-events)
+		}
+	}
+	// other intervals are ignored
+	if err = tracker.SaveSummary(&rollup.Summary{StartTime: start, SummarySeconds: 60, Measurements: 30, WindGust: 99}); err != nil {
+		t.Fatal(err)
+	}
+
+	days, err := store.GetDays("2021-06-01", "2021-06-02")
+	if err != nil || len(days) != 2 {
+		t.Fatalf("expected 2 days got %v %v", len(days), err)
+	}
+	d := days[0]
+	if d.Day != "2021-06-01" || d.Measurements != 2400 || d.WindAvg != 15 || d.MaxGust != 28 ||
+		!d.MaxGustTime.Equal(start.Add(time.Hour)) || d.HoursAbove[10] != 2 || d.HoursAbove[15] != 1 ||
+		d.HoursAbove[20] != 0 || d.TempLow != 59 || math.Abs(d.RainTotal-0.2) > 0.0001 {
+		t.Fatalf("unexpected day %+v", d)
+	}
+
+	// the first summary sets every record, later ones on the same day improve
+	// them quietly and the colder second day breaks the low temperature
+	if len(broken) != 12 {
+		t.Fatalf("expected 12 broken records got %v", broken)
+	}
+	if e := broken[len(broken)-1]; e.Record.Metric != climate.MinTemp || e.Previous == nil ||
+		e.Previous.Day != "2021-06-01" || e.Record.Day != "2021-06-02" {
+		t.Fatalf("unexpected last event %v", e)
+	}
+
+	records := tracker.Records()
+	for _, r := range records {
+		if r.Scope == climate.AllTime && r.Metric == climate.MaxGust && (r.Value != 28 || r.Day != "2021-06-01") {
+			t.Fatalf("unexpected gust record %+v", r)
+		}
+	}
+
+	// a day with nothing measured yet is saved without a max gust time
+	empty := time.Date(2021, 6, 5, 10, 0, 0, 0, loc)
+	err = tracker.SaveSummary(&rollup.Summary{StartTime: empty, EndTime: empty.Add(time.Hour), SummarySeconds: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if days, err = store.GetDays("2021-06-05", "2021-06-05"); err != nil || len(days) != 1 ||
+		days[0].Measurements != 0 || !days[0].MaxGustTime.IsZero() {
+		t.Fatalf("unexpected empty day %+v %v", days, err)
+	}
+
+	// rebuilding from the saved summaries gives the same days and records
+	if err = tracker.Rebuild(store, "2021-06-01", "2021-06-02", []time.Duration{time.Minute, time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err := store.GetDays("2021-06-01", "2021-06-02")
+	if err != nil || len(rebuilt) != 2 || rebuilt[0].MaxGust != 28 || rebuilt[1].Measurements != 1200 {
+		t.Fatalf("unexpected rebuilt days %+v %v", rebuilt, err)
+	}
+	if again := tracker.Records(); len(again) != len(records) {
+		t.Fatalf("expected %v records after rebuild got %v", len(records), len(again))
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/smw1218/windygo/raw"
+)
+
+// convertRaw runs "windygo convert". It rewrites the raw recordings made
+// before the version 2 format in it, keeping gzipped hours gzipped. The hour
+// being recorded is left alone, and it won't run while windygo is recording
+// to the directory since its Job compresses the hours on its own.
+func convertRaw(cfg storeConfig, rawDir string, args []string) error {
+	flags := flag.NewFlagSet("convert", flag.ContinueOnError)
+	dryRun := flags.Bool("n", false, "list the hours that need converting without changing them")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if rawDir == "" {
+		return fmt.Errorf("convert needs the raw directory, set -raw")
+	}
+	if !*dryRun {
+		lock, err := raw.Lock(rawDir)
+		if errors.Is(err, raw.ErrLocked) {
+			return fmt.Errorf("%w, stop it before converting", err)
+		}
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	hours, err := raw.Hours(rawDir, cfg.location)
+	if err != nil {
+		return err
+	}
+	header := &raw.Header{
+		Station:  cfg.station,
+		TimeZone: cfg.location.String(),
+		Created:  time.Now().UTC(),
+	}
+	current := time.Now().Add(-time.Hour - 5*time.Minute)
+	converted := 0
+	for _, h := range hours {
+		if h.Start.After(current) {
+			continue
+		}
+		fileName := filepath.Join(rawDir, h.File)
+		if *dryRun {
+			if version, err := raw.FileVersion(fileName); err != nil {
+				return err
+			} else if version == raw.Version1 {
+				fmt.Println(h.File)
+			}
+			continue
+		}
+		ok, err := raw.ConvertFile(fileName, header)
+		if err != nil {
+			return err
+		}
+		if ok {
+			converted++
+		}
+	}
+	log.Printf("Converted %v of %v raw hours", converted, len(hours))
+	return nil
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+// archiveCols are the archive record columns that are saved; the station
+// doesn't have the solar, UV, leaf or soil sensors
+var archiveCols []string = []string{
+	"station", "archive_time", "host_time", "outside_temp", "high_outside_temp",
+	"low_outside_temp", "rainfall", "high_rain_rate", "barometer",
+	"wind_samples", "inside_temp", "inside_humidity", "outside_humidity",
+	"wind_avg", "wind_max", "wind_max_dir", "wind_dir", "record_type",
+}
+
+// archive records are keyed by the console's timestamp
+var archiveKeyCols []string = []string{"station", "archive_time"}
+
+// archiveValues are the values for archiveCols, in the same order
+func archiveValues(station string, ar *vantage.ArchiveRecord) []interface{} {
+	return []interface{}{
+		station,
+		ar.ArchiveTime.UTC(),
+		ar.HostTime.UTC(),
+		ar.OutsideTemp,
+		ar.HighOutsideTemp,
+		ar.LowOutsideTemp,
+		ar.Rainfall,
+		ar.HighRainRate,
+		ar.Barometer,
+		ar.WindSamples,
+		ar.InsideTemp,
+		ar.InsideHumidity,
+		ar.OutsideHumidity,
+		ar.WindAvg,
+		ar.WindMax,
+		ar.WindMaxDir,
+		ar.WindDir,
+		ar.RecordType,
+	}
+}
+
+// saveArchiveRecords upserts the records in one transaction
+func saveArchiveRecords(sqlDB *sql.DB, dialect, station string, ars []*vantage.ArchiveRecord) error {
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting archive transaction: %w", err)
+	}
+	stmt, err := tx.Prepare(upsertSql(dialect, "archive_records", archiveCols, archiveKeyCols))
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed archive upsert prepare: %w", err)
+	}
+	defer stmt.Close()
+	for _, ar := range ars {
+		_, err = stmt.Exec(archiveValues(station, ar)...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error saving archive record %v: %w", ar.ArchiveTime, err)
+		}
+	}
+	return tx.Commit()
+}
+
+const selectArchive string = "select %v from archive_records where station = ? and host_time >= ? and host_time < ? order by host_time"
+
+// selectArchiveRecords returns the records with a host time from start up to
+// end, oldest first
+func selectArchiveRecords(sqlDB *sql.DB, dialect, station string, start, end time.Time) ([]*vantage.ArchiveRecord, error) {
+	query := fmt.Sprintf(selectArchive, strings.Join(archiveCols[1:], ","))
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	rows, err := sqlDB.Query(query, station, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to select archive records: %w", err)
+	}
+	defer rows.Close()
+	var ars []*vantage.ArchiveRecord
+	for rows.Next() {
+		ar := &vantage.ArchiveRecord{}
+		err = rows.Scan(&ar.ArchiveTime, &ar.HostTime, &ar.OutsideTemp, &ar.HighOutsideTemp,
+			&ar.LowOutsideTemp, &ar.Rainfall, &ar.HighRainRate, &ar.Barometer,
+			&ar.WindSamples, &ar.InsideTemp, &ar.InsideHumidity, &ar.OutsideHumidity,
+			&ar.WindAvg, &ar.WindMax, &ar.WindMaxDir, &ar.WindDir, &ar.RecordType)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive record: %w", err)
+		}
+		ars = append(ars, ar)
+	}
+	return ars, rows.Err()
+}
+
+// rebind changes ? placeholders to postgres' $n
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
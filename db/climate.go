@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/smw1218/windygo/climate"
+)
+
+var dayCols []string = []string{
+	"station", "day", "start_time", "end_time", "measurements", "wind_avg",
+	"max_gust", "max_gust_time", "max_gust_direction", "hours_above",
+	"temp_high", "temp_low", "rain_total",
+}
+
+var dayKeyCols []string = []string{"station", "day"}
+
+var recordCols []string = []string{"station", "scope", "metric", "value", "day", "record_time"}
+
+var recordKeyCols []string = []string{"station", "scope", "metric"}
+
+// climateSql keeps the daily aggregates and records for the sql stores.
+// station points at the store's Station so it can be set after opening.
+type climateSql struct {
+	db      *sql.DB
+	dialect string
+	station *string
+}
+
+func (c *climateSql) query(query string) string {
+	if c.dialect == PostgresDialect {
+		return rebind(query)
+	}
+	return query
+}
+
+func (c *climateSql) SaveDay(d *climate.Day) error {
+	hours, err := json.Marshal(d.HoursAbove)
+	if err != nil {
+		return fmt.Errorf("error encoding hours above: %w", err)
+	}
+	_, err = c.db.Exec(upsertSql(c.dialect, "daily_summaries", dayCols, dayKeyCols),
+		*c.station, d.Day, d.StartTime.UTC(), d.EndTime.UTC(), d.Measurements, d.WindAvg,
+		d.MaxGust, nullTime(d.MaxGustTime), d.MaxGustDirection, string(hours),
+		d.TempHigh, d.TempLow, d.RainTotal)
+	if err != nil {
+		return fmt.Errorf("error saving day %v: %w", d.Day, err)
+	}
+	return nil
+}
+
+func (c *climateSql) GetDays(from, to string) ([]*climate.Day, error) {
+	rows, err := c.db.Query(c.query(fmt.Sprintf(
+		"select %v from daily_summaries where station = ? and day >= ? and day <= ? order by day",
+		strings.Join(dayCols[1:], ","))), *c.station, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select days: %w", err)
+	}
+	defer rows.Close()
+	var days []*climate.Day
+	for rows.Next() {
+		d := &climate.Day{Station: *c.station}
+		var hours string
+		// a day with no measurements has no max gust time
+		var maxGustTime sql.NullTime
+		err = rows.Scan(&d.Day, &d.StartTime, &d.EndTime, &d.Measurements, &d.WindAvg,
+			&d.MaxGust, &maxGustTime, &d.MaxGustDirection, &hours,
+			&d.TempHigh, &d.TempLow, &d.RainTotal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read day: %w", err)
+		}
+		d.MaxGustTime = maxGustTime.Time
+		err = json.Unmarshal([]byte(hours), &d.HoursAbove)
+		if err != nil {
+			return nil, fmt.Errorf("bad hours above for %v: %w", d.Day, err)
+		}
+		days = append(days, d)
+	}
+	return days, rows.Err()
+}
+
+func (c *climateSql) DeleteDays(from, to string) error {
+	_, err := c.db.Exec(c.query("delete from daily_summaries where station = ? and day >= ? and day <= ?"), *c.station, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to delete days: %w", err)
+	}
+	return nil
+}
+
+func (c *climateSql) SaveRecord(r *climate.Record) error {
+	_, err := c.db.Exec(upsertSql(c.dialect, "climate_records", recordCols, recordKeyCols),
+		*c.station, r.Scope, r.Metric, r.Value, r.Day, r.Time.UTC())
+	if err != nil {
+		return fmt.Errorf("error saving record %v %v: %w", r.Scope, r.Metric, err)
+	}
+	return nil
+}
+
+func (c *climateSql) GetRecords() ([]*climate.Record, error) {
+	rows, err := c.db.Query(c.query(fmt.Sprintf("select %v from climate_records where station = ?",
+		strings.Join(recordCols[1:], ","))), *c.station)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select records: %w", err)
+	}
+	defer rows.Close()
+	var records []*climate.Record
+	for rows.Next() {
+		r := &climate.Record{Station: *c.station}
+		var at time.Time
+		err = rows.Scan(&r.Scope, &r.Metric, &r.Value, &r.Day, &at)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read record: %w", err)
+		}
+		r.Time = at
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+func (c *climateSql) DeleteRecords() error {
+	_, err := c.db.Exec(c.query("delete from climate_records where station = ?"), *c.station)
+	if err != nil {
+		return fmt.Errorf("failed to delete records: %w", err)
+	}
+	return nil
+}
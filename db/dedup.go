@@ -0,0 +1,76 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrDuplicates means there are duplicate summaries that have to be
+// removed before the unique key can be added
+var ErrDuplicates = errors.New("database has duplicate summaries, run windygo dedup")
+
+// stationVersion is the migration that added summaries.station
+const stationVersion = 7
+
+// duplicateOf matches a newer summaries row with the same key as the row
+// aliased s. Before the station column existed every row was one station.
+func (m *Migrator) duplicateOf() (string, error) {
+	version, err := m.Version()
+	if err != nil {
+		return "", err
+	}
+	match := "k.start_time = s.start_time AND k.summary_seconds = s.summary_seconds AND k.id > s.id"
+	if version >= stationVersion {
+		match += " AND k.station = s.station"
+	}
+	return match, nil
+}
+
+// Duplicates counts the summaries that have a newer copy
+func (m *Migrator) Duplicates() (int64, error) {
+	match, err := m.duplicateOf()
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	err = m.DB.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM summaries s WHERE EXISTS (SELECT 1 FROM summaries k WHERE %v)", match)).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting duplicate summaries: %w", err)
+	}
+	return count, nil
+}
+
+// Dedup deletes the summaries that have a newer copy, keeping the last one
+// written, and returns how many were deleted. Databases written before
+// summaries had a unique key need this before they can be migrated.
+func (m *Migrator) Dedup() (int64, error) {
+	match, err := m.duplicateOf()
+	if err != nil {
+		return 0, err
+	}
+	query := fmt.Sprintf("DELETE FROM summaries AS s WHERE EXISTS (SELECT 1 FROM summaries k WHERE %v)", match)
+	if m.dialect == MysqlDialect {
+		// mysql can't select from the table it's deleting from, but can join it
+		query = fmt.Sprintf("DELETE s FROM summaries s JOIN summaries k ON %v", match)
+	}
+	result, err := m.DB.Exec(query)
+	if err != nil {
+		return 0, fmt.Errorf("error deleting duplicate summaries: %w", err)
+	}
+	return result.RowsAffected()
+}
+
+// checkDuplicates is run before migrating from version to target
+func (m *Migrator) checkDuplicates(version, target int) error {
+	if version >= stationVersion || target < stationVersion || !m.hasSummaries() {
+		return nil
+	}
+	count, err := m.Duplicates()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return fmt.Errorf("%w: %v rows", ErrDuplicates, count)
+	}
+	return nil
+}
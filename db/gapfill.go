@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// DefaultArchivePeriod is the console's factory archive interval
+const DefaultArchivePeriod = 30 * time.Minute
+
+// FillGaps looks for periods from start up to end with no summary and saves
+// summaries made from the console's archive records for them (see
+// rollup.FromArchive), so the graphs don't have holes when windygo or the
+// network was down. archivePeriod is the console's archive interval; 0 works
+// it out from the records. Periods are aligned like the engine's, with days
+// starting at midnight in loc. It returns the number of summaries saved.
+func FillGaps(store Store, intervals []time.Duration, start, end time.Time, archivePeriod time.Duration, loc *time.Location) (int, error) {
+	longest := intervals[0]
+	for _, interval := range intervals {
+		if interval > longest {
+			longest = interval
+		}
+	}
+	// records up to a period after end can cover the last summaries
+	records, err := store.GetArchiveRecords(start, end.Add(longest+24*time.Hour))
+	if err != nil {
+		return 0, err
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	if archivePeriod <= 0 {
+		archivePeriod = inferArchivePeriod(records)
+	}
+
+	filled := 0
+	for _, interval := range intervals {
+		periodStart := rollup.PeriodStart(start, interval, loc)
+		periodEnd := rollup.PeriodStart(end, interval, loc)
+		secs := int(interval / time.Second)
+		existing, err := store.GetSummaryRange(periodStart, periodEnd, secs)
+		if err != nil {
+			return filled, err
+		}
+		have := make(map[int64]bool, len(existing))
+		for _, s := range existing {
+			have[s.StartTime.Unix()] = true
+		}
+		for period := periodStart; period.Before(periodEnd); period = rollup.PeriodEnd(period, interval, loc) {
+			if have[period.Unix()] {
+				continue
+			}
+			s := rollup.FromArchive(period, interval, archivePeriod, overlapping(records, period, interval, archivePeriod, loc))
+			if s == nil {
+				continue
+			}
+			err = store.SaveSummary(s)
+			if err != nil {
+				return filled, fmt.Errorf("error saving archive summary for %v: %w", period, err)
+			}
+			filled++
+		}
+	}
+	return filled, nil
+}
+
+// overlapping returns the records whose archive period overlaps the summary
+// period; records are sorted by host time
+func overlapping(records []*vantage.ArchiveRecord, period time.Time, interval, archivePeriod time.Duration, loc *time.Location) []*vantage.ArchiveRecord {
+	first := sort.Search(len(records), func(i int) bool { return records[i].HostTime.After(period) })
+	last := first
+	end := rollup.PeriodEnd(period, interval, loc)
+	for last < len(records) && records[last].HostTime.Add(-archivePeriod).Before(end) {
+		last++
+	}
+	return records[first:last]
+}
+
+// inferArchivePeriod is the shortest time between records, which is the
+// archive interval unless the console missed some
+func inferArchivePeriod(records []*vantage.ArchiveRecord) time.Duration {
+	shortest := time.Duration(0)
+	for i := 1; i < len(records); i++ {
+		gap := records[i].HostTime.Sub(records[i-1].HostTime).Round(time.Minute)
+		if gap > 0 && (shortest == 0 || gap < shortest) {
+			shortest = gap
+		}
+	}
+	if shortest == 0 {
+		return DefaultArchivePeriod
+	}
+	return shortest
+}
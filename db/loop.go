@@ -0,0 +1,222 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/spool"
+	"github.com/smw1218/windygo/vantage"
+)
+
+var loopCols []string = []string{
+	"station", "recorded", "console_time", "wind", "wind_direction", "wind_avg",
+	"barometer_raw", "bar_trend", "bar_trend_byte", "inside_temp_raw",
+	"outside_temp_raw", "inside_humidity", "outside_humidity", "rain_rate_raw",
+	"storm_rain_raw", "start_of_storm", "day_rain_raw", "month_rain_raw",
+	"year_rain_raw",
+}
+
+// loopValues are the values for loopCols, in the same order
+func loopValues(station string, lr *vantage.LoopRecord) []interface{} {
+	return []interface{}{
+		station,
+		lr.Recorded.UTC(),
+		lr.ConsoleTime.UTC(),
+		lr.Wind,
+		lr.WindDirection,
+		lr.WindAvg,
+		lr.BarometerRaw,
+		lr.BarTrend,
+		lr.BarTrendByte,
+		lr.InsideTempRaw,
+		lr.OutsideTempRaw,
+		lr.InsideHumidity,
+		lr.OutsideHumidity,
+		lr.RainRateRaw,
+		lr.StormRainRaw,
+		nullTime(lr.StartOfStorm),
+		lr.DayRainRaw,
+		lr.MonthRainRaw,
+		lr.YearRainRaw,
+	}
+}
+
+// nullTime is NULL for the zero time, which is out of range for a mysql
+// timestamp; the console has no start of storm when it isn't raining
+func nullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UTC()
+}
+
+// saveLoopRecords inserts the records in one transaction
+func saveLoopRecords(sqlDB *sql.DB, dialect, station string, lrs []*vantage.LoopRecord) error {
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(loopCols)), ",")
+	query := fmt.Sprintf("insert into loop_records (%v) VALUES (%v)", strings.Join(loopCols, ","), placeholders)
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	tx, err := sqlDB.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting loop record transaction: %w", err)
+	}
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("failed loop record insert prepare: %w", err)
+	}
+	defer stmt.Close()
+	for _, lr := range lrs {
+		_, err = stmt.Exec(loopValues(station, lr)...)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error saving loop record %v: %w", lr.Recorded, err)
+		}
+	}
+	return tx.Commit()
+}
+
+const selectLoop string = "select %v from loop_records where station = ? and recorded >= ? and recorded < ? order by recorded"
+
+// selectLoopRecords returns the records received from start up to end,
+// oldest first
+func selectLoopRecords(sqlDB *sql.DB, dialect, station string, start, end time.Time) ([]*vantage.LoopRecord, error) {
+	query := fmt.Sprintf(selectLoop, strings.Join(loopCols[1:], ","))
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	rows, err := sqlDB.Query(query, station, start.UTC(), end.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to select loop records: %w", err)
+	}
+	defer rows.Close()
+	var lrs []*vantage.LoopRecord
+	for rows.Next() {
+		lr := &vantage.LoopRecord{}
+		var barTrend sql.NullString
+		// records saved before console_time was added have none
+		var consoleTime, startOfStorm sql.NullTime
+		err = rows.Scan(&lr.Recorded, &consoleTime, &lr.Wind, &lr.WindDirection, &lr.WindAvg,
+			&lr.BarometerRaw, &barTrend, &lr.BarTrendByte, &lr.InsideTempRaw,
+			&lr.OutsideTempRaw, &lr.InsideHumidity, &lr.OutsideHumidity, &lr.RainRateRaw,
+			&lr.StormRainRaw, &startOfStorm, &lr.DayRainRaw, &lr.MonthRainRaw,
+			&lr.YearRainRaw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read loop record: %w", err)
+		}
+		lr.BarTrend = barTrend.String
+		lr.ConsoleTime = consoleTime.Time
+		lr.StartOfStorm = startOfStorm.Time
+		lrs = append(lrs, lr)
+	}
+	return lrs, rows.Err()
+}
+
+// LoopRecordSaver saves batches of loop records; all the stores are one
+type LoopRecordSaver interface {
+	SaveLoopRecords(lrs []*vantage.LoopRecord) error
+}
+
+// maxPendingLoopRecords is how many unsaved loop records are kept while the
+// database is failing, an hour of packets
+const maxPendingLoopRecords = 1800
+
+// LoopBatcher collects loop records and saves them in one transaction every
+// Every, since an insert per packet every 2 seconds is a lot of round trips.
+// Batches that fail to save go to Spool for the store to replay when the
+// database is back. Without a spool, or when it's full, they're retried with
+// the next batch; if the database stays down the oldest are dropped, the raw
+// files still have them.
+type LoopBatcher struct {
+	Store LoopRecordSaver
+	Every time.Duration
+	// Spool keeps batches that couldn't be saved; it may be nil
+	Spool   *spool.Spool
+	mutex   sync.Mutex
+	pending []*vantage.LoopRecord
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewLoopBatcher starts saving batches to store every every until Close
+func NewLoopBatcher(store LoopRecordSaver, every time.Duration) *LoopBatcher {
+	b := &LoopBatcher{
+		Store: store,
+		Every: every,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+// Add queues the record for the next batch
+func (b *LoopBatcher) Add(lr *vantage.LoopRecord) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.pending = append(b.pending, lr)
+	if dropped := len(b.pending) - maxPendingLoopRecords; dropped > 0 {
+		log.Printf("Dropping %v unsaved loop records", dropped)
+		b.pending = b.pending[dropped:]
+	}
+}
+
+// Flush saves the queued records now
+func (b *LoopBatcher) Flush() error {
+	b.mutex.Lock()
+	batch := b.pending
+	b.pending = nil
+	b.mutex.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	err := b.Store.SaveLoopRecords(batch)
+	if err != nil && b.Spool != nil {
+		spoolErr := b.Spool.Append(spool.KindLoop, loopBatchKey(batch), batch)
+		if spoolErr == nil {
+			return fmt.Errorf("%w (spooled for replay)", err)
+		}
+		log.Printf("Error spooling loop records: %v", spoolErr)
+	}
+	if err != nil {
+		// put them back in front of the ones that came in meanwhile
+		b.mutex.Lock()
+		b.pending = append(batch, b.pending...)
+		b.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+// loopBatchKey identifies a batch in the spool
+func loopBatchKey(batch []*vantage.LoopRecord) string {
+	return fmt.Sprintf("%v/%v", batch[0].Recorded.UTC().Format(time.RFC3339Nano), len(batch))
+}
+
+func (b *LoopBatcher) loop() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.Every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				log.Printf("Error saving loop records: %v", err)
+			}
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+// Close stops the batches and saves the queued records
+func (b *LoopBatcher) Close() error {
+	close(b.stop)
+	<-b.done
+	return b.Flush()
+}
@@ -0,0 +1,301 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/climate"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Memory keeps summaries in memory. Nothing survives a restart so it's meant
+// for tests and for running without any history.
+type Memory struct {
+	recorder
+	mutex     sync.Mutex
+	nextID    int64
+	summaries map[int64][]*Summary             // by summary seconds, sorted by end time
+	archive   map[int64]*vantage.ArchiveRecord // by console time
+	loop      []*vantage.LoopRecord            // in the order received
+	flags     []*Flag
+	days      map[string]*climate.Day
+	records   map[string]*climate.Record // by scope and metric
+}
+
+func NewMemory() *Memory {
+	m := &Memory{
+		summaries: make(map[int64][]*Summary),
+		archive:   make(map[int64]*vantage.ArchiveRecord),
+		days:      make(map[string]*climate.Day),
+		records:   make(map[string]*climate.Record),
+	}
+	m.recorder = newRecorder(m.insert)
+	m.recorder.store = m
+	m.Engine = rollup.NewEngine(rollup.DefaultIntervals, m)
+	return m
+}
+
+func (m *Memory) insert(s *Summary) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored := *s
+	stored.StartTime = s.StartTime.UTC()
+	stored.EndTime = s.EndTime.UTC()
+	ss := m.summaries[s.SummarySeconds]
+	i := sort.Search(len(ss), func(i int) bool { return ss[i].EndTime.After(stored.EndTime) })
+	// replace the summary with the same key, it sorts just before i
+	for j := i - 1; j >= 0 && ss[j].EndTime.Equal(stored.EndTime); j-- {
+		if ss[j].Station == stored.Station && ss[j].StartTime.Equal(stored.StartTime) {
+			stored.ID = ss[j].ID
+			ss[j] = &stored
+			return nil
+		}
+	}
+	m.nextID++
+	stored.ID = m.nextID
+	ss = append(ss, nil)
+	copy(ss[i+1:], ss[i:])
+	ss[i] = &stored
+	m.summaries[s.SummarySeconds] = ss
+	return nil
+}
+
+func (m *Memory) GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error) {
+	slenmin := reportLength(reportSize, summarySecondsForReport)
+	m.mutex.Lock()
+	ss := m.summaries[int64(summarySecondsForReport)]
+	i := sort.Search(len(ss), func(i int) bool { return ss[i].EndTime.After(startTime) })
+	found := make([]*Summary, 0, slenmin)
+	for ; i < len(ss) && len(found) < slenmin; i++ {
+		if ss[i].Station != m.Station {
+			continue
+		}
+		copied := *ss[i]
+		found = append(found, &copied)
+	}
+	m.mutex.Unlock()
+	return m.reportSlice(found, slenmin)
+}
+
+func (m *Memory) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error) {
+	m.mutex.Lock()
+	var found []*Summary
+	for _, s := range m.summaries[int64(summarySeconds)] {
+		if s.Station == m.Station && !s.StartTime.Before(start) && s.StartTime.Before(end) {
+			copied := *s
+			found = append(found, &copied)
+		}
+	}
+	m.mutex.Unlock()
+	return m.inLocation(found)
+}
+
+func (m *Memory) SummaryTimes(summarySeconds int) (first, last time.Time, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, s := range m.summaries[int64(summarySeconds)] {
+		if s.Station != m.Station {
+			continue
+		}
+		if first.IsZero() || s.StartTime.Before(first) {
+			first = s.StartTime
+		}
+		if s.StartTime.After(last) {
+			last = s.StartTime
+		}
+	}
+	return first, last, nil
+}
+
+func (m *Memory) DeleteSummaries(before time.Time, summarySeconds int, dryRun bool) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	ss := m.summaries[int64(summarySeconds)]
+	kept := ss[:0:0]
+	var deleted int64
+	for _, s := range ss {
+		if s.Station == m.Station && s.StartTime.Before(before) {
+			deleted++
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if !dryRun {
+		m.summaries[int64(summarySeconds)] = kept
+	}
+	return deleted, nil
+}
+
+func (m *Memory) SaveLoopRecords(lrs []*vantage.LoopRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, lr := range lrs {
+		stored := *lr
+		m.loop = append(m.loop, &stored)
+	}
+	return nil
+}
+
+func (m *Memory) GetLoopRecords(start, end time.Time) ([]*vantage.LoopRecord, error) {
+	m.mutex.Lock()
+	var lrs []*vantage.LoopRecord
+	for _, lr := range m.loop {
+		if !lr.Recorded.Before(start) && lr.Recorded.Before(end) {
+			copied := *lr
+			lrs = append(lrs, &copied)
+		}
+	}
+	m.mutex.Unlock()
+	return dropInvalidLoopRecords(m, lrs)
+}
+
+func (m *Memory) SaveFlag(f *Flag) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nextID++
+	f.ID = m.nextID
+	f.Station = m.Station
+	stored := *f
+	m.flags = append(m.flags, &stored)
+	return nil
+}
+
+func (m *Memory) GetFlags(start, end time.Time) ([]*Flag, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	flags := make([]*Flag, 0)
+	for _, f := range m.flags {
+		if f.Station == m.Station && f.Overlaps(start, end) {
+			copied := *f
+			flags = append(flags, &copied)
+		}
+	}
+	sort.Slice(flags, func(i, j int) bool { return flags[i].Start.Before(flags[j].Start) })
+	return flags, nil
+}
+
+func (m *Memory) DeleteFlag(id int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for i, f := range m.flags {
+		if f.ID == id && f.Station == m.Station {
+			m.flags = append(m.flags[:i], m.flags[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no flag %v", id)
+}
+
+func (m *Memory) DeleteLoopRecords(before time.Time, dryRun bool) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	kept := m.loop[:0]
+	var deleted int64
+	for _, lr := range m.loop {
+		if lr.Recorded.Before(before) {
+			deleted++
+			if dryRun {
+				kept = append(kept, lr)
+			}
+			continue
+		}
+		kept = append(kept, lr)
+	}
+	m.loop = kept
+	return deleted, nil
+}
+
+func (m *Memory) SaveArchiveRecords(ars []*vantage.ArchiveRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, ar := range ars {
+		stored := *ar
+		m.archive[ar.ArchiveTime.UnixNano()] = &stored
+	}
+	return nil
+}
+
+func (m *Memory) GetArchiveRecords(start, end time.Time) ([]*vantage.ArchiveRecord, error) {
+	m.mutex.Lock()
+	ars := make([]*vantage.ArchiveRecord, 0)
+	for _, ar := range m.archive {
+		if !ar.HostTime.Before(start) && ar.HostTime.Before(end) {
+			copied := *ar
+			ars = append(ars, &copied)
+		}
+	}
+	m.mutex.Unlock()
+	sort.Slice(ars, func(i, j int) bool { return ars[i].HostTime.Before(ars[j].HostTime) })
+	return ars, nil
+}
+
+func (m *Memory) SaveDay(d *climate.Day) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored := *d
+	stored.HoursAbove = make(map[int]float64, len(d.HoursAbove))
+	for threshold, hours := range d.HoursAbove {
+		stored.HoursAbove[threshold] = hours
+	}
+	m.days[d.Day] = &stored
+	return nil
+}
+
+func (m *Memory) GetDays(from, to string) ([]*climate.Day, error) {
+	m.mutex.Lock()
+	days := make([]*climate.Day, 0)
+	for key, d := range m.days {
+		if key >= from && key <= to {
+			copied := *d
+			days = append(days, &copied)
+		}
+	}
+	m.mutex.Unlock()
+	sort.Slice(days, func(i, j int) bool { return days[i].Day < days[j].Day })
+	return days, nil
+}
+
+func (m *Memory) DeleteDays(from, to string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key := range m.days {
+		if key >= from && key <= to {
+			delete(m.days, key)
+		}
+	}
+	return nil
+}
+
+func (m *Memory) SaveRecord(r *climate.Record) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stored := *r
+	m.records[r.Scope+"/"+r.Metric] = &stored
+	return nil
+}
+
+func (m *Memory) GetRecords() ([]*climate.Record, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	records := make([]*climate.Record, 0, len(m.records))
+	for _, r := range m.records {
+		copied := *r
+		records = append(records, &copied)
+	}
+	return records, nil
+}
+
+func (m *Memory) DeleteRecords() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.records = make(map[string]*climate.Record)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.closeLoopRecords()
+	return nil
+}
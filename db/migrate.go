@@ -0,0 +1,251 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrSchemaBehind means the database needs "windygo migrate" before this
+// version of windygo can use it
+var ErrSchemaBehind = errors.New("database schema is older than windygo, run windygo migrate")
+
+// ErrSchemaAhead means the database was migrated by a newer windygo
+var ErrSchemaAhead = errors.New("database schema is newer than windygo")
+
+// Migration is one numbered schema change. Up and Down are run in order
+// and hold a single statement each since the mysql driver doesn't allow
+// several per Exec.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []string
+	Down    []string
+	// Done, when set, is a query that returns a row if the database
+	// already has the change, like from gorm's AutoMigrate before
+	// migrations existed; the version is then recorded without running Up
+	Done string
+}
+
+const schemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (
+	version		integer NOT NULL,
+	name		varchar(255) NOT NULL,
+	applied_at	timestamp NOT NULL
+)`
+
+// Migrator applies migrations and keeps track of them in the
+// schema_version table, one row per applied version
+type Migrator struct {
+	DB          *sql.DB
+	Migrations  []Migration
+	dialect     string
+	placeholder func(n int) string
+}
+
+func NewMigrator(dialect string, sqlDB *sql.DB) (*Migrator, error) {
+	migrations, ok := dialectMigrations[dialect]
+	if !ok {
+		return nil, fmt.Errorf("no migrations for %q", dialect)
+	}
+	placeholder := func(int) string { return "?" }
+	if dialect == PostgresDialect {
+		placeholder = func(n int) string { return fmt.Sprintf("$%d", n) }
+	}
+	return &Migrator{
+		DB:          sqlDB,
+		Migrations:  migrations,
+		dialect:     dialect,
+		placeholder: placeholder,
+	}, nil
+}
+
+// OpenMigrator connects to the database without checking the schema
+// so it can be migrated
+func OpenMigrator(dialect, dataSource string) (*Migrator, error) {
+	driver := dialect
+	if dialect == SQLiteDialect {
+		driver = "sqlite3"
+	}
+	sqlDB, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v: %w", dialect, err)
+	}
+	return NewMigrator(dialect, sqlDB)
+}
+
+// Latest is the version this windygo expects
+func (m *Migrator) Latest() int {
+	if len(m.Migrations) == 0 {
+		return 0
+	}
+	return m.Migrations[len(m.Migrations)-1].Version
+}
+
+// Version is the version the database is at, 0 if it has never been
+// migrated. It only reads, so "windygo migrate status" leaves the database
+// as it is.
+func (m *Migrator) Version() (int, error) {
+	exists, err := m.hasVersionTable()
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version sql.NullInt64
+	err = m.DB.QueryRow("SELECT max(version) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("error reading schema version: %w", err)
+	}
+	return int(version.Int64), nil
+}
+
+// Check returns an error wrapping ErrSchemaBehind or ErrSchemaAhead
+// if the database can't be used as is. A new database that has no
+// summaries is migrated to the latest version since there is nothing
+// to break.
+func (m *Migrator) Check() error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	if version == 0 && !m.hasSummaries() {
+		log.Printf("Creating schema version %v", m.Latest())
+		return m.Up(0)
+	}
+	if version < m.Latest() {
+		return fmt.Errorf("%w: at version %v, need %v", ErrSchemaBehind, version, m.Latest())
+	}
+	if version > m.Latest() {
+		return fmt.Errorf("%w: at version %v, windygo supports %v", ErrSchemaAhead, version, m.Latest())
+	}
+	return nil
+}
+
+// hasVersionTable reports whether the schema_version table has been created
+func (m *Migrator) hasVersionTable() (bool, error) {
+	query := "SELECT count(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_version'"
+	switch m.dialect {
+	case SQLiteDialect:
+		query = "SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'"
+	case PostgresDialect:
+		query = "SELECT count(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_version'"
+	}
+	var count int
+	err := m.DB.QueryRow(query).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error looking for the schema_version table: %w", err)
+	}
+	return count > 0, nil
+}
+
+func (m *Migrator) hasSummaries() bool {
+	rows, err := m.DB.Query("SELECT 1 FROM summaries")
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	return rows.Next()
+}
+
+// Up applies migrations up to and including target, 0 means all of them
+func (m *Migrator) Up(target int) error {
+	if target <= 0 {
+		target = m.Latest()
+	}
+	_, err := m.DB.Exec(schemaVersionTable)
+	if err != nil {
+		return fmt.Errorf("create schema_version table error: %w", err)
+	}
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	err = m.checkDuplicates(version, target)
+	if err != nil {
+		return err
+	}
+	for _, migration := range m.Migrations {
+		if migration.Version <= version || migration.Version > target {
+			continue
+		}
+		log.Printf("Migrating up to %v %v", migration.Version, migration.Name)
+		statements := migration.Up
+		done, err := m.done(migration)
+		if err != nil {
+			return fmt.Errorf("migration %v %v check failed: %w", migration.Version, migration.Name, err)
+		}
+		if done {
+			statements = nil
+		}
+		err = m.apply(statements,
+			fmt.Sprintf("INSERT INTO schema_version (version, name, applied_at) VALUES (%v, %v, %v)",
+				m.placeholder(1), m.placeholder(2), m.placeholder(3)),
+			migration.Version, migration.Name, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("migration %v %v failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// done runs the migration's Done query
+func (m *Migrator) done(migration Migration) (bool, error) {
+	if migration.Done == "" {
+		return false, nil
+	}
+	rows, err := m.DB.Query(migration.Done)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	return rows.Next(), rows.Err()
+}
+
+// Down reverts migrations newer than target, 0 reverts everything
+func (m *Migrator) Down(target int) error {
+	version, err := m.Version()
+	if err != nil {
+		return err
+	}
+	for i := len(m.Migrations) - 1; i >= 0; i-- {
+		migration := m.Migrations[i]
+		if migration.Version > version || migration.Version <= target {
+			continue
+		}
+		log.Printf("Migrating down from %v %v", migration.Version, migration.Name)
+		err = m.apply(migration.Down,
+			fmt.Sprintf("DELETE FROM schema_version WHERE version = %v", m.placeholder(1)),
+			migration.Version)
+		if err != nil {
+			return fmt.Errorf("migration %v %v down failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// apply runs the statements and records the version in a transaction.
+// MySQL commits DDL immediately so a failure part way through a
+// migration there has to be fixed by hand.
+func (m *Migrator) apply(statements []string, versionSql string, versionArgs ...interface{}) error {
+	tx, err := m.DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(versionSql, versionArgs...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) Close() error {
+	return m.DB.Close()
+}
@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func TestMigratorCheck(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "windygo.db")
+	migrator, err := OpenMigrator(SQLiteDialect, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer migrator.Close()
+
+	// reading the version doesn't change anything
+	if version, err := migrator.Version(); err != nil || version != 0 {
+		t.Fatalf("expected version 0 got %v %v", version, err)
+	}
+	if exists, err := migrator.hasVersionTable(); err != nil || exists {
+		t.Fatalf("Version created the schema_version table %v", err)
+	}
+
+	// an empty database is brought up to date
+	if err = migrator.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := migrator.Version(); version != migrator.Latest() {
+		t.Fatalf("expected version %v got %v", migrator.Latest(), version)
+	}
+
+	// one with data has to be migrated by hand
+	if err = migrator.Down(1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = migrator.DB.Exec("INSERT INTO summaries (start_time, summary_seconds) VALUES ('2021-06-01 12:00:00', 60)"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = migrator.Check(); !errors.Is(err, ErrSchemaBehind) {
+		t.Fatalf("expected ErrSchemaBehind got %v", err)
+	}
+
+	// duplicates have to be removed before the unique key is added
+	if err = migrator.Up(0); !errors.Is(err, ErrDuplicates) {
+		t.Fatalf("expected ErrDuplicates got %v", err)
+	}
+	if deleted, err := migrator.Dedup(); err != nil || deleted != 2 {
+		t.Fatalf("expected 2 deleted got %v %v", deleted, err)
+	}
+	if err = migrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := migrator.Duplicates(); err != nil || count != 0 {
+		t.Fatalf("expected no duplicates got %v %v", count, err)
+	}
+
+	// and a newer schema is refused
+	if _, err = migrator.DB.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (1000, 'future', CURRENT_TIMESTAMP)"); err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Check(); !errors.Is(err, ErrSchemaAhead) {
+		t.Fatalf("expected ErrSchemaAhead got %v", err)
+	}
+}
+
+func TestMigrationsInStep(t *testing.T) {
+	for dialect, migrations := range dialectMigrations {
+		if len(migrations) != len(mysqlMigrations) {
+			t.Fatalf("%v has %v migrations, mysql has %v", dialect, len(migrations), len(mysqlMigrations))
+		}
+		for i, migration := range migrations {
+			if migration.Version != i+1 || migration.Name != mysqlMigrations[i].Name {
+				t.Fatalf("%v migration %v %q doesn't match mysql's %v %q", dialect, migration.Version, migration.Name,
+					mysqlMigrations[i].Version, mysqlMigrations[i].Name)
+			}
+		}
+	}
+}
+
+func TestMigrateAutoMigratedLoopRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "windygo.db")
+	migrator, err := OpenMigrator(SQLiteDialect, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// loop_records like gorm's AutoMigrate made it, without console_time
+	_, err = migrator.DB.Exec(`CREATE TABLE loop_records (
+	id integer PRIMARY KEY AUTOINCREMENT, recorded timestamp, wind integer, wind_direction integer,
+	wind_avg integer, barometer_raw integer, bar_trend varchar(255), bar_trend_byte integer,
+	inside_temp_raw integer, outside_temp_raw integer, inside_humidity integer, outside_humidity integer,
+	rain_rate_raw integer, storm_rain_raw integer, start_of_storm timestamp, day_rain_raw integer,
+	month_rain_raw integer, year_rain_raw integer)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorded := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	_, err = migrator.DB.Exec(`INSERT INTO loop_records (recorded, wind, wind_direction, wind_avg, barometer_raw,
+	bar_trend, bar_trend_byte, inside_temp_raw, outside_temp_raw, inside_humidity, outside_humidity, rain_rate_raw,
+	storm_rain_raw, day_rain_raw, month_rain_raw, year_rain_raw) VALUES (?, 10, 0, 0, 0, '', 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)`, recorded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = migrator.Up(0); err != nil {
+		t.Fatal(err)
+	}
+	migrator.Close()
+
+	store, err := NewSQLite(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	lr := &vantage.LoopRecord{Recorded: recorded.Add(2 * time.Second), ConsoleTime: recorded, Wind: 12}
+	if err = store.SaveLoopRecords([]*vantage.LoopRecord{lr}); err != nil {
+		t.Fatal(err)
+	}
+	lrs, err := store.GetLoopRecords(recorded, recorded.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lrs) != 2 || lrs[0].Wind != 10 || !lrs[0].ConsoleTime.IsZero() || lrs[1].Wind != 12 || !lrs[1].ConsoleTime.Equal(recorded) {
+		t.Fatalf("unexpected loop records %+v", lrs)
+	}
+}
@@ -0,0 +1,848 @@
+package db
+
+const (
+	MysqlDialect    = "mysql"
+	SQLiteDialect   = "sqlite"
+	PostgresDialect = "postgres"
+)
+
+// Migrations for each dialect. Version 1 is the schema windygo created
+// before migrations existed, so it uses IF NOT EXISTS and is safe to run
+// against an existing database. Add new migrations to the end of every
+// dialect with the same version number.
+var dialectMigrations = map[string][]Migration{
+	MysqlDialect:    mysqlMigrations,
+	SQLiteDialect:   sqliteMigrations,
+	PostgresDialect: postgresMigrations,
+}
+
+var mysqlMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: []string{`
+CREATE TABLE IF NOT EXISTS summaries (
+	id 						integer AUTO_INCREMENT PRIMARY KEY,
+	start_time				timestamp,
+	end_time				timestamp,
+	measurments				integer,
+	summary_seconds			integer,
+	wind_avg				float,
+	wind_gust				float,
+	wind_lull				float,
+	wind_stddev				float,
+	wind_direction_avg		integer,
+	wind_direction_min		integer,
+	wind_direction_max		integer,
+	barometer_avg			float,
+	barometer_start			float,
+	outside_temp_avg		float,
+	outside_humidity_avg	float,
+	INDEX end_time_idx (end_time),
+	INDEX summary_minutes_idx (summary_seconds)
+)`, `
+CREATE TABLE IF NOT EXISTS loop_records (
+	id					int unsigned AUTO_INCREMENT PRIMARY KEY,
+	recorded			timestamp NULL,
+	console_time		timestamp NULL,
+	wind				int,
+	wind_direction		int,
+	wind_avg			int,
+	barometer_raw		int,
+	bar_trend			varchar(255),
+	bar_trend_byte		tinyint unsigned,
+	inside_temp_raw		int,
+	outside_temp_raw	int,
+	inside_humidity		int,
+	outside_humidity	int,
+	rain_rate_raw		int,
+	storm_rain_raw		int,
+	start_of_storm		timestamp NULL,
+	day_rain_raw		int,
+	month_rain_raw		int,
+	year_rain_raw		int,
+	INDEX idx_loop_records_recorded (recorded)
+)`,
+		},
+		Down: []string{
+			`DROP TABLE loop_records`,
+			`DROP TABLE summaries`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "fix measurements spelling",
+		Up:      []string{`ALTER TABLE summaries CHANGE measurments measurements integer`},
+		Down:    []string{`ALTER TABLE summaries CHANGE measurements measurments integer`},
+	},
+	{
+		Version: 3,
+		Name:    "richer summary metrics",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN bar_trend_byte smallint,
+	ADD COLUMN rain_total float,
+	ADD COLUMN rain_rate_max float,
+	ADD COLUMN outside_temp_min float,
+	ADD COLUMN outside_temp_max float,
+	ADD COLUMN outside_humidity_min float,
+	ADD COLUMN outside_humidity_max float,
+	ADD COLUMN barometer_end float,
+	ADD COLUMN barometer_change float,
+	ADD COLUMN inside_temp_avg float,
+	ADD COLUMN inside_humidity_avg float,
+	ADD COLUMN dew_point_avg float`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN bar_trend_byte,
+	DROP COLUMN rain_total,
+	DROP COLUMN rain_rate_max,
+	DROP COLUMN outside_temp_min,
+	DROP COLUMN outside_temp_max,
+	DROP COLUMN outside_humidity_min,
+	DROP COLUMN outside_humidity_max,
+	DROP COLUMN barometer_end,
+	DROP COLUMN barometer_change,
+	DROP COLUMN inside_temp_avg,
+	DROP COLUMN inside_humidity_avg,
+	DROP COLUMN dew_point_avg`},
+	},
+	{
+		Version: 4,
+		Name:    "circular wind direction statistics",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN wind_direction_range integer,
+	ADD COLUMN wind_direction_stddev float,
+	ADD COLUMN wind_vector_speed float,
+	ADD COLUMN wind_vector_direction integer`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN wind_direction_range,
+	DROP COLUMN wind_direction_stddev,
+	DROP COLUMN wind_vector_speed,
+	DROP COLUMN wind_vector_direction`},
+	},
+	{
+		Version: 5,
+		Name:    "wind histograms",
+		Up:      []string{`ALTER TABLE summaries ADD COLUMN histogram text`},
+		Down:    []string{`ALTER TABLE summaries DROP COLUMN histogram`},
+	},
+	{
+		Version: 6,
+		Name:    "summary coverage",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN expected_measurements integer,
+	ADD COLUMN partial boolean NOT NULL DEFAULT FALSE`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN expected_measurements,
+	DROP COLUMN partial`},
+	},
+	{
+		Version: 7,
+		Name:    "summary natural key",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN station varchar(64) NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX summaries_key_idx ON summaries (station, start_time, summary_seconds)`,
+		},
+		Down: []string{
+			`DROP INDEX summaries_key_idx ON summaries`,
+			`ALTER TABLE summaries DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "archive records",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN source varchar(16) NOT NULL DEFAULT 'loop'`, `
+CREATE TABLE archive_records (
+	id					integer AUTO_INCREMENT PRIMARY KEY,
+	station				varchar(64) NOT NULL DEFAULT '',
+	archive_time		timestamp NULL,
+	host_time			timestamp NULL,
+	outside_temp		float,
+	high_outside_temp	float,
+	low_outside_temp	float,
+	rainfall			integer,
+	high_rain_rate		integer,
+	barometer			float,
+	wind_samples		integer,
+	inside_temp			float,
+	inside_humidity		integer,
+	outside_humidity	integer,
+	wind_avg			integer,
+	wind_max			integer,
+	wind_max_dir		integer,
+	wind_dir			integer,
+	record_type			integer,
+	UNIQUE INDEX archive_records_key_idx (station, archive_time),
+	INDEX archive_records_host_time_idx (host_time)
+)`,
+		},
+		Down: []string{
+			`DROP TABLE archive_records`,
+			`ALTER TABLE summaries DROP COLUMN source`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "climate",
+		Up: []string{
+			`
+CREATE TABLE daily_summaries (
+	id					integer AUTO_INCREMENT PRIMARY KEY,
+	station				varchar(64) NOT NULL DEFAULT '',
+	day					varchar(10) NOT NULL,
+	start_time			timestamp NULL,
+	end_time			timestamp NULL,
+	measurements		integer,
+	wind_avg			float,
+	max_gust			float,
+	max_gust_time		timestamp NULL,
+	max_gust_direction	integer,
+	hours_above			text,
+	temp_high			float,
+	temp_low			float,
+	rain_total			float,
+	UNIQUE INDEX daily_summaries_key_idx (station, day)
+)`, `
+CREATE TABLE climate_records (
+	id					integer AUTO_INCREMENT PRIMARY KEY,
+	station				varchar(64) NOT NULL DEFAULT '',
+	scope				varchar(16) NOT NULL,
+	metric				varchar(32) NOT NULL,
+	value				float,
+	day					varchar(10),
+	record_time			timestamp NULL,
+	UNIQUE INDEX climate_records_key_idx (station, scope, metric)
+)`,
+		},
+		Down: []string{
+			`DROP TABLE climate_records`,
+			`DROP TABLE daily_summaries`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "loop record partitions",
+		Up: []string{
+			`ALTER TABLE loop_records ADD COLUMN station varchar(64) NOT NULL DEFAULT '' AFTER id`,
+			// the partitioning column has to be in the primary key
+			`ALTER TABLE loop_records MODIFY recorded timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP`,
+			`ALTER TABLE loop_records DROP PRIMARY KEY, ADD PRIMARY KEY (id, recorded)`,
+			`CREATE INDEX loop_records_station_recorded_idx ON loop_records (station, recorded)`,
+			// monthly partitions are split off pmax as records are saved
+			`ALTER TABLE loop_records PARTITION BY RANGE (UNIX_TIMESTAMP(recorded)) (PARTITION pmax VALUES LESS THAN MAXVALUE)`,
+		},
+		Down: []string{
+			`ALTER TABLE loop_records REMOVE PARTITIONING`,
+			`DROP INDEX loop_records_station_recorded_idx ON loop_records`,
+			`ALTER TABLE loop_records DROP PRIMARY KEY, ADD PRIMARY KEY (id)`,
+			`ALTER TABLE loop_records MODIFY recorded timestamp NULL`,
+			`ALTER TABLE loop_records DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "quality flags",
+		Up: []string{`
+CREATE TABLE quality_flags (
+	id			integer AUTO_INCREMENT PRIMARY KEY,
+	station		varchar(64) NOT NULL DEFAULT '',
+	start_time	timestamp NULL,
+	end_time	timestamp NULL,
+	quality		varchar(16) NOT NULL,
+	reason		varchar(255) NOT NULL DEFAULT '',
+	set_by		varchar(64) NOT NULL DEFAULT '',
+	set_at		timestamp NULL
+)`,
+			`CREATE INDEX quality_flags_station_start_time_idx ON quality_flags (station, start_time)`,
+		},
+		Down: []string{`DROP TABLE quality_flags`},
+	},
+	{
+		// loop_records is already partitioned by migration 10; this keeps
+		// the versions in step with postgres
+		Version: 12,
+		Name:    "native loop record partitions",
+	},
+	{
+		// loop_records made by gorm's AutoMigrate, before migrations, has
+		// no console_time, so baseline's IF NOT EXISTS didn't add it. Down
+		// leaves it since baseline creates it.
+		Version: 13,
+		Name:    "loop record console time",
+		Up:      []string{`ALTER TABLE loop_records ADD COLUMN console_time timestamp NULL AFTER recorded`},
+		Done:    `SELECT 1 FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = 'loop_records' AND column_name = 'console_time'`,
+	},
+}
+
+var sqliteMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: []string{`
+CREATE TABLE IF NOT EXISTS summaries (
+	id 						integer PRIMARY KEY AUTOINCREMENT,
+	start_time				timestamp,
+	end_time				timestamp,
+	measurments				integer,
+	summary_seconds			integer,
+	wind_avg				float,
+	wind_gust				float,
+	wind_lull				float,
+	wind_stddev				float,
+	wind_direction_avg		integer,
+	wind_direction_min		integer,
+	wind_direction_max		integer,
+	barometer_avg			float,
+	barometer_start			float,
+	outside_temp_avg		float,
+	outside_humidity_avg	float
+)`,
+			`CREATE INDEX IF NOT EXISTS end_time_idx ON summaries (end_time)`,
+			`CREATE INDEX IF NOT EXISTS summary_minutes_idx ON summaries (summary_seconds)`, `
+CREATE TABLE IF NOT EXISTS loop_records (
+	id					integer PRIMARY KEY AUTOINCREMENT,
+	recorded			timestamp,
+	console_time		timestamp,
+	wind				integer,
+	wind_direction		integer,
+	wind_avg			integer,
+	barometer_raw		integer,
+	bar_trend			varchar(255),
+	bar_trend_byte		integer,
+	inside_temp_raw		integer,
+	outside_temp_raw	integer,
+	inside_humidity		integer,
+	outside_humidity	integer,
+	rain_rate_raw		integer,
+	storm_rain_raw		integer,
+	start_of_storm		timestamp,
+	day_rain_raw		integer,
+	month_rain_raw		integer,
+	year_rain_raw		integer
+)`,
+			`CREATE INDEX IF NOT EXISTS idx_loop_records_recorded ON loop_records (recorded)`,
+		},
+		Down: []string{
+			`DROP TABLE loop_records`,
+			`DROP TABLE summaries`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "fix measurements spelling",
+		Up:      []string{`ALTER TABLE summaries RENAME COLUMN measurments TO measurements`},
+		Down:    []string{`ALTER TABLE summaries RENAME COLUMN measurements TO measurments`},
+	},
+	{
+		Version: 3,
+		Name:    "richer summary metrics",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN bar_trend_byte integer`,
+			`ALTER TABLE summaries ADD COLUMN rain_total float`,
+			`ALTER TABLE summaries ADD COLUMN rain_rate_max float`,
+			`ALTER TABLE summaries ADD COLUMN outside_temp_min float`,
+			`ALTER TABLE summaries ADD COLUMN outside_temp_max float`,
+			`ALTER TABLE summaries ADD COLUMN outside_humidity_min float`,
+			`ALTER TABLE summaries ADD COLUMN outside_humidity_max float`,
+			`ALTER TABLE summaries ADD COLUMN barometer_end float`,
+			`ALTER TABLE summaries ADD COLUMN barometer_change float`,
+			`ALTER TABLE summaries ADD COLUMN inside_temp_avg float`,
+			`ALTER TABLE summaries ADD COLUMN inside_humidity_avg float`,
+			`ALTER TABLE summaries ADD COLUMN dew_point_avg float`,
+		},
+		Down: []string{
+			`ALTER TABLE summaries DROP COLUMN bar_trend_byte`,
+			`ALTER TABLE summaries DROP COLUMN rain_total`,
+			`ALTER TABLE summaries DROP COLUMN rain_rate_max`,
+			`ALTER TABLE summaries DROP COLUMN outside_temp_min`,
+			`ALTER TABLE summaries DROP COLUMN outside_temp_max`,
+			`ALTER TABLE summaries DROP COLUMN outside_humidity_min`,
+			`ALTER TABLE summaries DROP COLUMN outside_humidity_max`,
+			`ALTER TABLE summaries DROP COLUMN barometer_end`,
+			`ALTER TABLE summaries DROP COLUMN barometer_change`,
+			`ALTER TABLE summaries DROP COLUMN inside_temp_avg`,
+			`ALTER TABLE summaries DROP COLUMN inside_humidity_avg`,
+			`ALTER TABLE summaries DROP COLUMN dew_point_avg`,
+		},
+	},
+	{
+		Version: 4,
+		Name:    "circular wind direction statistics",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN wind_direction_range integer`,
+			`ALTER TABLE summaries ADD COLUMN wind_direction_stddev float`,
+			`ALTER TABLE summaries ADD COLUMN wind_vector_speed float`,
+			`ALTER TABLE summaries ADD COLUMN wind_vector_direction integer`,
+		},
+		Down: []string{
+			`ALTER TABLE summaries DROP COLUMN wind_direction_range`,
+			`ALTER TABLE summaries DROP COLUMN wind_direction_stddev`,
+			`ALTER TABLE summaries DROP COLUMN wind_vector_speed`,
+			`ALTER TABLE summaries DROP COLUMN wind_vector_direction`,
+		},
+	},
+	{
+		Version: 5,
+		Name:    "wind histograms",
+		Up:      []string{`ALTER TABLE summaries ADD COLUMN histogram text`},
+		Down:    []string{`ALTER TABLE summaries DROP COLUMN histogram`},
+	},
+	{
+		Version: 6,
+		Name:    "summary coverage",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN expected_measurements integer`,
+			`ALTER TABLE summaries ADD COLUMN partial boolean NOT NULL DEFAULT FALSE`,
+		},
+		Down: []string{
+			`ALTER TABLE summaries DROP COLUMN expected_measurements`,
+			`ALTER TABLE summaries DROP COLUMN partial`,
+		},
+	},
+	{
+		Version: 7,
+		Name:    "summary natural key",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN station text NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX summaries_key_idx ON summaries (station, start_time, summary_seconds)`,
+		},
+		Down: []string{
+			`DROP INDEX summaries_key_idx`,
+			`ALTER TABLE summaries DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "archive records",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN source text NOT NULL DEFAULT 'loop'`, `
+CREATE TABLE archive_records (
+	id					integer PRIMARY KEY AUTOINCREMENT,
+	station				text NOT NULL DEFAULT '',
+	archive_time		timestamp,
+	host_time			timestamp,
+	outside_temp		float,
+	high_outside_temp	float,
+	low_outside_temp	float,
+	rainfall			integer,
+	high_rain_rate		integer,
+	barometer			float,
+	wind_samples		integer,
+	inside_temp			float,
+	inside_humidity		integer,
+	outside_humidity	integer,
+	wind_avg			integer,
+	wind_max			integer,
+	wind_max_dir		integer,
+	wind_dir			integer,
+	record_type			integer
+)`,
+			`CREATE UNIQUE INDEX archive_records_key_idx ON archive_records (station, archive_time)`,
+			`CREATE INDEX archive_records_host_time_idx ON archive_records (host_time)`,
+		},
+		Down: []string{
+			`DROP TABLE archive_records`,
+			`ALTER TABLE summaries DROP COLUMN source`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "climate",
+		Up: []string{
+			`
+CREATE TABLE daily_summaries (
+	id					integer PRIMARY KEY AUTOINCREMENT,
+	station				text NOT NULL DEFAULT '',
+	day					text NOT NULL,
+	start_time			timestamp,
+	end_time			timestamp,
+	measurements		integer,
+	wind_avg			float,
+	max_gust			float,
+	max_gust_time		timestamp,
+	max_gust_direction	integer,
+	hours_above			text,
+	temp_high			float,
+	temp_low			float,
+	rain_total			float
+)`, `
+CREATE TABLE climate_records (
+	id					integer PRIMARY KEY AUTOINCREMENT,
+	station				text NOT NULL DEFAULT '',
+	scope				text NOT NULL,
+	metric				text NOT NULL,
+	value				float,
+	day					text,
+	record_time			timestamp
+)`,
+			`CREATE UNIQUE INDEX daily_summaries_key_idx ON daily_summaries (station, day)`,
+			`CREATE UNIQUE INDEX climate_records_key_idx ON climate_records (station, scope, metric)`,
+		},
+		Down: []string{
+			`DROP TABLE climate_records`,
+			`DROP TABLE daily_summaries`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "loop record partitions",
+		Up: []string{
+			`ALTER TABLE loop_records ADD COLUMN station text NOT NULL DEFAULT ''`,
+			`CREATE INDEX loop_records_station_recorded_idx ON loop_records (station, recorded)`,
+		},
+		Down: []string{
+			`DROP INDEX loop_records_station_recorded_idx`,
+			`ALTER TABLE loop_records DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "quality flags",
+		Up: []string{`
+CREATE TABLE quality_flags (
+	id			integer PRIMARY KEY AUTOINCREMENT,
+	station		text NOT NULL DEFAULT '',
+	start_time	timestamp,
+	end_time	timestamp,
+	quality		text NOT NULL,
+	reason		text NOT NULL DEFAULT '',
+	set_by		text NOT NULL DEFAULT '',
+	set_at		timestamp
+)`,
+			`CREATE INDEX quality_flags_station_start_time_idx ON quality_flags (station, start_time)`,
+		},
+		Down: []string{`DROP TABLE quality_flags`},
+	},
+	{
+		// sqlite has no partitions; this keeps the versions in step with
+		// postgres
+		Version: 12,
+		Name:    "native loop record partitions",
+	},
+	{
+		Version: 13,
+		Name:    "loop record console time",
+		Up:      []string{`ALTER TABLE loop_records ADD COLUMN console_time timestamp`},
+		Done:    `SELECT 1 FROM pragma_table_info('loop_records') WHERE name = 'console_time'`,
+	},
+}
+
+// The postgres tables are laid out so they can be TimescaleDB hypertables:
+// every unique index includes the time column, times are timestamptz and
+// there are no triggers or foreign keys, so continuous aggregates can be
+// defined over them for long range queries. The hypertables are only
+// created if the timescaledb extension is installed.
+var postgresMigrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		Up: []string{`
+CREATE TABLE IF NOT EXISTS summaries (
+	id 						bigserial,
+	start_time				timestamptz NOT NULL,
+	end_time				timestamptz NOT NULL,
+	measurments				integer,
+	summary_seconds			integer NOT NULL,
+	wind_avg				double precision,
+	wind_gust				double precision,
+	wind_lull				double precision,
+	wind_stddev				double precision,
+	wind_direction_avg		integer,
+	wind_direction_min		integer,
+	wind_direction_max		integer,
+	barometer_avg			double precision,
+	barometer_start			double precision,
+	outside_temp_avg		double precision,
+	outside_humidity_avg	double precision,
+	PRIMARY KEY (id, end_time)
+)`,
+			`CREATE INDEX IF NOT EXISTS summaries_seconds_end_time_idx ON summaries (summary_seconds, end_time)`, `
+CREATE TABLE IF NOT EXISTS loop_records (
+	id					bigserial,
+	recorded			timestamptz NOT NULL,
+	console_time		timestamptz,
+	wind				integer,
+	wind_direction		integer,
+	wind_avg			integer,
+	barometer_raw		integer,
+	bar_trend			text,
+	bar_trend_byte		smallint,
+	inside_temp_raw		integer,
+	outside_temp_raw	integer,
+	inside_humidity		integer,
+	outside_humidity	integer,
+	rain_rate_raw		integer,
+	storm_rain_raw		integer,
+	start_of_storm		timestamptz,
+	day_rain_raw		integer,
+	month_rain_raw		integer,
+	year_rain_raw		integer,
+	PRIMARY KEY (id, recorded)
+)`,
+			`CREATE INDEX IF NOT EXISTS loop_records_recorded_idx ON loop_records (recorded)`, `
+DO $$
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') THEN
+		PERFORM create_hypertable('summaries', 'end_time', if_not_exists => TRUE, migrate_data => TRUE);
+		PERFORM create_hypertable('loop_records', 'recorded', if_not_exists => TRUE, migrate_data => TRUE);
+	END IF;
+END
+$$`,
+		},
+		Down: []string{
+			`DROP TABLE loop_records`,
+			`DROP TABLE summaries`,
+		},
+	},
+	{
+		Version: 2,
+		Name:    "fix measurements spelling",
+		Up:      []string{`ALTER TABLE summaries RENAME COLUMN measurments TO measurements`},
+		Down:    []string{`ALTER TABLE summaries RENAME COLUMN measurements TO measurments`},
+	},
+	{
+		Version: 3,
+		Name:    "richer summary metrics",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN bar_trend_byte smallint,
+	ADD COLUMN rain_total double precision,
+	ADD COLUMN rain_rate_max double precision,
+	ADD COLUMN outside_temp_min double precision,
+	ADD COLUMN outside_temp_max double precision,
+	ADD COLUMN outside_humidity_min double precision,
+	ADD COLUMN outside_humidity_max double precision,
+	ADD COLUMN barometer_end double precision,
+	ADD COLUMN barometer_change double precision,
+	ADD COLUMN inside_temp_avg double precision,
+	ADD COLUMN inside_humidity_avg double precision,
+	ADD COLUMN dew_point_avg double precision`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN bar_trend_byte,
+	DROP COLUMN rain_total,
+	DROP COLUMN rain_rate_max,
+	DROP COLUMN outside_temp_min,
+	DROP COLUMN outside_temp_max,
+	DROP COLUMN outside_humidity_min,
+	DROP COLUMN outside_humidity_max,
+	DROP COLUMN barometer_end,
+	DROP COLUMN barometer_change,
+	DROP COLUMN inside_temp_avg,
+	DROP COLUMN inside_humidity_avg,
+	DROP COLUMN dew_point_avg`},
+	},
+	{
+		Version: 4,
+		Name:    "circular wind direction statistics",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN wind_direction_range integer,
+	ADD COLUMN wind_direction_stddev double precision,
+	ADD COLUMN wind_vector_speed double precision,
+	ADD COLUMN wind_vector_direction integer`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN wind_direction_range,
+	DROP COLUMN wind_direction_stddev,
+	DROP COLUMN wind_vector_speed,
+	DROP COLUMN wind_vector_direction`},
+	},
+	{
+		Version: 5,
+		Name:    "wind histograms",
+		Up:      []string{`ALTER TABLE summaries ADD COLUMN histogram jsonb`},
+		Down:    []string{`ALTER TABLE summaries DROP COLUMN histogram`},
+	},
+	{
+		Version: 6,
+		Name:    "summary coverage",
+		Up: []string{`
+ALTER TABLE summaries
+	ADD COLUMN expected_measurements integer,
+	ADD COLUMN partial boolean NOT NULL DEFAULT FALSE`},
+		Down: []string{`
+ALTER TABLE summaries
+	DROP COLUMN expected_measurements,
+	DROP COLUMN partial`},
+	},
+	{
+		Version: 7,
+		Name:    "summary natural key",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN station text NOT NULL DEFAULT ''`,
+			`CREATE UNIQUE INDEX summaries_key_idx ON summaries (station, start_time, summary_seconds, end_time)`,
+		},
+		Down: []string{
+			`DROP INDEX summaries_key_idx`,
+			`ALTER TABLE summaries DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 8,
+		Name:    "archive records",
+		Up: []string{
+			`ALTER TABLE summaries ADD COLUMN source text NOT NULL DEFAULT 'loop'`, `
+CREATE TABLE archive_records (
+	id					bigserial PRIMARY KEY,
+	station				text NOT NULL DEFAULT '',
+	archive_time		timestamptz NOT NULL,
+	host_time			timestamptz NOT NULL,
+	outside_temp		double precision,
+	high_outside_temp	double precision,
+	low_outside_temp	double precision,
+	rainfall			integer,
+	high_rain_rate		integer,
+	barometer			double precision,
+	wind_samples		integer,
+	inside_temp			double precision,
+	inside_humidity		integer,
+	outside_humidity	integer,
+	wind_avg			integer,
+	wind_max			integer,
+	wind_max_dir		integer,
+	wind_dir			integer,
+	record_type			integer
+)`,
+			`CREATE UNIQUE INDEX archive_records_key_idx ON archive_records (station, archive_time)`,
+			`CREATE INDEX archive_records_host_time_idx ON archive_records (host_time)`,
+		},
+		Down: []string{
+			`DROP TABLE archive_records`,
+			`ALTER TABLE summaries DROP COLUMN source`,
+		},
+	},
+	{
+		Version: 9,
+		Name:    "climate",
+		Up: []string{
+			`
+CREATE TABLE daily_summaries (
+	id					bigserial PRIMARY KEY,
+	station				text NOT NULL DEFAULT '',
+	day					text NOT NULL,
+	start_time			timestamptz,
+	end_time			timestamptz,
+	measurements		integer,
+	wind_avg			double precision,
+	max_gust			double precision,
+	max_gust_time		timestamptz,
+	max_gust_direction	integer,
+	hours_above			text,
+	temp_high			double precision,
+	temp_low			double precision,
+	rain_total			double precision
+)`, `
+CREATE TABLE climate_records (
+	id					bigserial PRIMARY KEY,
+	station				text NOT NULL DEFAULT '',
+	scope				text NOT NULL,
+	metric				text NOT NULL,
+	value				double precision,
+	day					text,
+	record_time			timestamptz
+)`,
+			`CREATE UNIQUE INDEX daily_summaries_key_idx ON daily_summaries (station, day)`,
+			`CREATE UNIQUE INDEX climate_records_key_idx ON climate_records (station, scope, metric)`,
+		},
+		Down: []string{
+			`DROP TABLE climate_records`,
+			`DROP TABLE daily_summaries`,
+		},
+	},
+	{
+		Version: 10,
+		Name:    "loop record partitions",
+		Up: []string{
+			`ALTER TABLE loop_records ADD COLUMN station text NOT NULL DEFAULT ''`,
+			`CREATE INDEX loop_records_station_recorded_idx ON loop_records (station, recorded)`,
+		},
+		Down: []string{
+			`DROP INDEX loop_records_station_recorded_idx`,
+			`ALTER TABLE loop_records DROP COLUMN station`,
+		},
+	},
+	{
+		Version: 11,
+		Name:    "quality flags",
+		Up: []string{`
+CREATE TABLE quality_flags (
+	id			bigserial PRIMARY KEY,
+	station		text NOT NULL DEFAULT '',
+	start_time	timestamptz,
+	end_time	timestamptz,
+	quality		text NOT NULL,
+	reason		text NOT NULL DEFAULT '',
+	set_by		text NOT NULL DEFAULT '',
+	set_at		timestamptz
+)`,
+			`CREATE INDEX quality_flags_station_start_time_idx ON quality_flags (station, start_time)`,
+		},
+		Down: []string{`DROP TABLE quality_flags`},
+	},
+	{
+		// without timescaledb loop_records is remade partitioned by month,
+		// with partitions for the months it has records for and a default
+		// one for anything Postgres.addLoopPartitions hasn't caught up with
+		Version: 12,
+		Name:    "native loop record partitions",
+		Up: []string{`
+DO $$
+DECLARE
+	month timestamp;
+BEGIN
+	IF EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb') OR
+		(SELECT relkind FROM pg_class WHERE oid = 'loop_records'::regclass) = 'p' THEN
+		RETURN;
+	END IF;
+	CREATE TABLE loop_records_new (LIKE loop_records INCLUDING DEFAULTS, PRIMARY KEY (id, recorded))
+		PARTITION BY RANGE (recorded);
+	CREATE TABLE loop_records_default PARTITION OF loop_records_new DEFAULT;
+	month := date_trunc('month', COALESCE((SELECT min(recorded) FROM loop_records), now()) AT TIME ZONE 'UTC');
+	WHILE month < date_trunc('month', now() AT TIME ZONE 'UTC') + interval '2 months' LOOP
+		EXECUTE format('CREATE TABLE loop_records_p%s PARTITION OF loop_records_new FOR VALUES FROM (%L) TO (%L)',
+			to_char(month, 'YYYYMM'), month AT TIME ZONE 'UTC', (month + interval '1 month') AT TIME ZONE 'UTC');
+		month := month + interval '1 month';
+	END LOOP;
+	INSERT INTO loop_records_new SELECT * FROM loop_records;
+	ALTER SEQUENCE loop_records_id_seq OWNED BY NONE;
+	DROP TABLE loop_records;
+	ALTER TABLE loop_records_new RENAME TO loop_records;
+	ALTER TABLE loop_records RENAME CONSTRAINT loop_records_new_pkey TO loop_records_pkey;
+	ALTER SEQUENCE loop_records_id_seq OWNED BY loop_records.id;
+	CREATE INDEX loop_records_recorded_idx ON loop_records (recorded);
+	CREATE INDEX loop_records_station_recorded_idx ON loop_records (station, recorded);
+END
+$$`,
+		},
+		Down: []string{`
+DO $$
+BEGIN
+	IF (SELECT relkind FROM pg_class WHERE oid = 'loop_records'::regclass) <> 'p' THEN
+		RETURN;
+	END IF;
+	CREATE TABLE loop_records_old (LIKE loop_records INCLUDING DEFAULTS, PRIMARY KEY (id, recorded));
+	INSERT INTO loop_records_old SELECT * FROM loop_records;
+	ALTER SEQUENCE loop_records_id_seq OWNED BY NONE;
+	DROP TABLE loop_records;
+	ALTER TABLE loop_records_old RENAME TO loop_records;
+	ALTER TABLE loop_records RENAME CONSTRAINT loop_records_old_pkey TO loop_records_pkey;
+	ALTER SEQUENCE loop_records_id_seq OWNED BY loop_records.id;
+	CREATE INDEX loop_records_recorded_idx ON loop_records (recorded);
+	CREATE INDEX loop_records_station_recorded_idx ON loop_records (station, recorded);
+END
+$$`,
+		},
+	},
+	{
+		Version: 13,
+		Name:    "loop record console time",
+		Up:      []string{`ALTER TABLE loop_records ADD COLUMN IF NOT EXISTS console_time timestamptz`},
+	},
+}
@@ -3,381 +3,198 @@ package db
 import (
 	"database/sql"
 	"fmt"
-	"log"
-	"math"
+	"strconv"
 	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jinzhu/gorm"
+	"github.com/smw1218/windygo/rollup"
 	"github.com/smw1218/windygo/vantage"
 )
 
-var Intervals = []time.Duration{time.Minute, 5 * time.Minute, 10 * time.Minute}
-
-const DegreesPerRadian = 180 / math.Pi
-const RadiansPerDegree = math.Pi / 180
-const summariesTable string = `
-CREATE TABLE IF NOT EXISTS summaries (
-	id 						integer AUTO_INCREMENT PRIMARY KEY,
-	start_time				timestamp,
-	end_time				timestamp,
-	measurments				integer,
-	summary_seconds			integer,
-	wind_avg				float,
-	wind_gust				float,
-	wind_lull				float,
-	wind_stddev				float,
-	wind_direction_avg		integer,
-	wind_direction_min		integer,
-	wind_direction_max		integer,
-	barometer_avg			float,
-	barometer_start			float,
-	outside_temp_avg		float,
-	outside_humidity_avg	float,
-	INDEX end_time_idx (end_time),
-	INDEX summary_minutes_idx (summary_seconds)
-)
-`
-
-type LoopRecord struct {
-	ID uint `gorm:"primary_key"`
-	vantage.LoopRecord
-}
-
-type Summary struct {
-	ID                 int64
-	StartTime          time.Time
-	EndTime            time.Time
-	Measurements       int64
-	SummarySeconds     int64
-	WindAvg            float64
-	WindGust           float64
-	WindLull           float64
-	WindStddev         float64
-	WindDirectionAvg   int64
-	WindDirectionMin   int64
-	WindDirectionMax   int64
-	BarometerAvg       float64
-	BarometerStart     float64
-	OutsideTempAvg     float64
-	OutsideHumidityAvg float64
-	BarTrendByte       byte
+// Mysql is the MariaDB/MySQL store
+type Mysql struct {
+	recorder
+	climateSql
+	DB         *sql.DB
+	insertStmt *sql.Stmt
+	ORM        *gorm.DB
+	// partitionedUntil is the end of the last monthly loop_records partition
+	partitionedUntil time.Time
 }
 
-func (s *Summary) WindDirAvgCardinal() int {
-	tmp := int(math.Floor(float64(s.WindDirectionAvg)/22.5+.5) * 22.5)
-	if tmp == 360 {
-		tmp = 0
+func NewMysql(user, password string) (*Mysql, error) {
+	gormDB, err := gorm.Open("mysql", MysqlDataSource(user, password))
+	//db, err := sql.Open("mysql", connectString)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to mysql: %w", err)
 	}
-	return tmp
-}
 
-func (s *Summary) OutsideTempAvgCelsius() float64 {
-	return (s.OutsideTempAvg - 32) * 5 / 9
+	mysql := &Mysql{
+		DB:  gormDB.DB(),
+		ORM: gormDB,
+	}
+	mysql.recorder = newRecorder(mysql.insert)
+	mysql.recorder.store = mysql
+	mysql.Engine = rollup.NewEngine(rollup.DefaultIntervals, mysql)
+	mysql.climateSql = climateSql{db: mysql.DB, dialect: MysqlDialect, station: &mysql.Station}
+	if err = mysql.init(); err != nil {
+		return nil, err
+	}
+	mysql.insertStmt, err = mysql.DB.Prepare(upsertStatement(MysqlDialect))
+	if err != nil {
+		return nil, fmt.Errorf("failed upsert prepare: %w", err)
+	}
+	return mysql, nil
 }
 
-func (s *Summary) Valid() bool {
-	return s.WindAvg < 100 && s.WindGust < 100
+// MysqlDataSource is the connect string for the local windygo database
+func MysqlDataSource(user, password string) string {
+	// keep the session in UTC so timestamp columns aren't shifted by the
+	// server's zone; summaries are converted to the station zone on the way out
+	return fmt.Sprintf("%v:%v@/windygo?parseTime=true&loc=UTC&time_zone=%%27%%2B00%%3A00%%27", user, password)
 }
 
-const insertSql string = `insert into summaries (%v) VALUES (%v)`
-
-var insertCols []string = []string{
-	"start_time", "end_time", "measurments", "summary_seconds", "wind_avg",
-	"wind_gust", "wind_lull", "wind_stddev", "wind_direction_avg",
-	"wind_direction_min", "wind_direction_max", "barometer_avg",
-	"barometer_start", "outside_temp_avg", "outside_humidity_avg",
+func (m *Mysql) init() error {
+	migrator, err := NewMigrator(MysqlDialect, m.DB)
+	if err != nil {
+		return err
+	}
+	return migrator.Check()
 }
 
-type Mysql struct {
-	DB         *sql.DB
-	SavedChan  chan *Summary
-	ErrChan    chan error
-	rollups    []*Rollup
-	insertStmt *sql.Stmt
-	ORM        *gorm.DB
+func (m *Mysql) insert(s *Summary) error {
+	_, err := m.insertStmt.Exec(insertValues(s)...)
+	return err
 }
 
-type Rollup struct {
-	Period             time.Time
-	Interval           time.Duration
-	Count              int // number of samples
-	WindSum            int // sum
-	WindSum2           int // sum of squares
-	WindMax            int
-	WindMin            int
-	WindDirXSum        float64 // sum
-	WindDirYSum        float64 // sum
-	WindDirMax         int
-	WindDirMin         int
-	BarometerSum       float64
-	BarometerStart     float64
-	OutsideTempSum     float64
-	OutsideHumiditySum int
-	BarTrendByte       byte
-	Done               bool
-}
+// 5 minutes
+const selectRecent string = "select * from summaries where end_time > ? and summary_seconds = ? and station = ? order by end_time limit ?"
 
-func newRollup(period time.Time, interval time.Duration) *Rollup {
-	return &Rollup{
-		Period:     period,
-		Interval:   interval,
-		WindMin:    math.MaxInt32,
-		WindDirMin: math.MaxInt32,
+func (m *Mysql) GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error) {
+	slenmin := reportLength(reportSize, summarySecondsForReport)
+	var ss []*Summary
+	err := m.ORM.Raw(selectRecent, startTime.UTC(), summarySecondsForReport, m.Station, slenmin).Find(&ss).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to select summaries: %w", err)
 	}
+	return m.reportSlice(ss, slenmin)
 }
 
-func (r *Rollup) Update(loopRecord *vantage.LoopRecord) {
-	r.Count++
-	// wind
-	wind := loopRecord.Wind
-	r.WindSum += wind
-	r.WindSum2 += wind * wind
-	if wind > r.WindMax {
-		r.WindMax = wind
-	}
-	if wind < r.WindMin {
-		r.WindMin = wind
-	}
-	// wind direction
-	winddir := loopRecord.WindDirection
-	winddirx := math.Cos(float64(winddir) * RadiansPerDegree)
-	winddiry := math.Sin(float64(winddir) * RadiansPerDegree)
-
-	r.WindDirXSum += winddirx
-	r.WindDirYSum += winddiry
-	if winddir > r.WindDirMax {
-		r.WindDirMax = winddir
-	}
-	if winddir < r.WindDirMin {
-		r.WindDirMin = winddir
-	}
-	// other stuff
-	r.BarometerSum += float64(loopRecord.Barometer())
-	if r.Count == 1 {
-		r.BarometerStart = float64(loopRecord.Barometer())
+func (m *Mysql) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error) {
+	ss, err := selectSummaryRange(m.ORM, m.Station, start, end, summarySeconds)
+	if err != nil {
+		return nil, err
 	}
-	r.OutsideTempSum += float64(loopRecord.OutsideTemp())
-	r.OutsideHumiditySum += loopRecord.OutsideHumidity
-	r.BarTrendByte = loopRecord.BarTrendByte
+	return m.inLocation(ss)
 }
 
-func (r *Rollup) WindAvg() float64 {
-	return float64(r.WindSum) / float64(r.Count)
-}
-func (r *Rollup) WindStddev() float64 {
-	//variance = (SumSq - (Sum × Sum) ⁄ n) ⁄ n
-	return math.Sqrt((float64(r.WindSum2) - float64(r.WindSum*r.WindSum)/float64(r.Count)) / float64(r.Count))
-}
-func (r *Rollup) WindDirAvg() int64 {
-	rads := math.Atan2(r.WindDirYSum, r.WindDirXSum)
-	if rads < 0 {
-		rads += 2 * math.Pi
-	}
-	return int64(rads*DegreesPerRadian + 0.5)
+func (m *Mysql) SummaryTimes(summarySeconds int) (first, last time.Time, err error) {
+	return summaryTimes(m.DB, MysqlDialect, m.Station, summarySeconds)
 }
 
-func (r *Rollup) BarometerAvg() float64 {
-	return r.BarometerSum / float64(r.Count)
-}
-func (r *Rollup) OutsideTempAvg() float64 {
-	return r.OutsideTempSum / float64(r.Count)
+func (m *Mysql) DeleteSummaries(before time.Time, summarySeconds int, dryRun bool) (int64, error) {
+	return deleteSummaries(m.DB, MysqlDialect, m.Station, before, summarySeconds, dryRun)
 }
-func (r *Rollup) OutsideHumidityAvg() int {
-	return r.OutsideHumiditySum / r.Count
+
+func (m *Mysql) DeleteLoopRecords(before time.Time, dryRun bool) (int64, error) {
+	return deleteLoopRecords(m.DB, MysqlDialect, m.Station, before, dryRun)
 }
 
-func (r *Rollup) Summary() *Summary {
-	s := &Summary{
-		ID:                 0,
-		StartTime:          r.Period,
-		EndTime:            r.Period.Add(r.Interval),
-		Measurements:       int64(r.Count),
-		SummarySeconds:     int64(r.Interval / time.Second),
-		WindAvg:            r.WindAvg(),
-		WindGust:           float64(r.WindMax),
-		WindLull:           float64(r.WindMin),
-		WindStddev:         r.WindStddev(),
-		WindDirectionAvg:   r.WindDirAvg(),
-		WindDirectionMin:   int64(r.WindDirMin),
-		WindDirectionMax:   int64(r.WindDirMax),
-		BarometerAvg:       r.BarometerAvg(),
-		BarometerStart:     r.BarometerStart,
-		OutsideTempAvg:     r.OutsideTempAvg(),
-		OutsideHumidityAvg: float64(r.OutsideHumidityAvg()),
-		BarTrendByte:       r.BarTrendByte,
-	}
-	return s
+func (m *Mysql) SaveArchiveRecords(ars []*vantage.ArchiveRecord) error {
+	return saveArchiveRecords(m.DB, MysqlDialect, m.Station, ars)
 }
 
-func (s *Summary) insert() []interface{} {
-	//(start_time,end_time,measurments,summary_seconds,wind_avg,wind_gust,wind_lull,wind_stddev,
-	//wind_direction_avg,wind_direction_min,wind_direction_max,barometer_avg,barometer_start,outside_temp_avg,outside_humidity_avg)
-	vals := make([]interface{}, len(insertCols))
-	vals[0] = s.StartTime
-	vals[1] = s.EndTime
-	vals[2] = s.Measurements
-	vals[3] = s.SummarySeconds
-	vals[4] = s.WindAvg
-	vals[5] = s.WindGust
-	vals[6] = s.WindLull
-	vals[7] = s.WindStddev
-	vals[8] = s.WindDirectionAvg
-	vals[9] = s.WindDirectionMin
-	vals[10] = s.WindDirectionMax
-	vals[11] = s.BarometerAvg
-	vals[12] = s.BarometerStart
-	vals[13] = s.OutsideTempAvg
-	vals[14] = s.OutsideHumidityAvg
-	return vals
+func (m *Mysql) GetArchiveRecords(start, end time.Time) ([]*vantage.ArchiveRecord, error) {
+	return selectArchiveRecords(m.DB, MysqlDialect, m.Station, start, end)
 }
 
-func NewMysql(user, password string) (*Mysql, error) {
-	connectString := fmt.Sprintf("%v:%v@/windygo?parseTime=true", user, password)
-	gormDB, err := gorm.Open("mysql", connectString)
-	//db, err := sql.Open("mysql", connectString)
+// SaveLoopRecords inserts the records, adding the loop_records partitions
+// for their month and the next one first if they're missing
+func (m *Mysql) SaveLoopRecords(lrs []*vantage.LoopRecord) error {
+	if len(lrs) == 0 {
+		return nil
+	}
+	err := m.addLoopPartitions(lrs[len(lrs)-1].Recorded)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to mysql: %w", err)
+		return err
 	}
+	return saveLoopRecords(m.DB, MysqlDialect, m.Station, lrs)
+}
 
-	mysql := &Mysql{
-		DB:  gormDB.DB(),
-		ORM: gormDB,
-	}
-	mysql.rollups = make([]*Rollup, len(Intervals))
-	mysql.SavedChan = make(chan *Summary, 10)
-	mysql.ErrChan = make(chan error, 1)
-	if err = mysql.init(); err != nil {
-		return nil, err
-	}
-	mysql.insertStmt, err = mysql.DB.Prepare(mysql.createInsertStmt())
+func (m *Mysql) GetLoopRecords(start, end time.Time) ([]*vantage.LoopRecord, error) {
+	lrs, err := selectLoopRecords(m.DB, MysqlDialect, m.Station, start, end)
 	if err != nil {
-		return nil, fmt.Errorf("failed insert prepare: %w", err)
+		return nil, err
 	}
-	return mysql, nil
+	return dropInvalidLoopRecords(m, lrs)
 }
 
-func (m *Mysql) createInsertStmt() string {
-	placeholders := make([]string, len(insertCols))
-	for i := range placeholders {
-		placeholders[i] = "?"
-	}
-	return fmt.Sprintf(insertSql, strings.Join(insertCols, ","), strings.Join(placeholders, ","))
+func (m *Mysql) SaveFlag(f *Flag) error {
+	return saveFlag(m.DB, MysqlDialect, m.Station, f)
 }
 
-func (m *Mysql) init() error {
-	_, err := m.DB.Exec(summariesTable)
-	if err != nil {
-		return fmt.Errorf("create summaries table error: %w", err)
-	}
-	m.ORM.AutoMigrate(&LoopRecord{})
-	return nil
+func (m *Mysql) GetFlags(start, end time.Time) ([]*Flag, error) {
+	return selectFlags(m.DB, MysqlDialect, m.Station, start, end)
 }
 
-func (m *Mysql) Record(loopPkt []byte) {
-	loopRecord := vantage.ParseLoop(loopPkt)
-	finished := make([]*Rollup, 0, len(Intervals))
-	for idx, interval := range Intervals {
-		tint := loopRecord.Recorded.Truncate(interval)
-		rollup := m.rollups[idx]
-		if rollup == nil {
-			rollup = newRollup(tint, interval)
-			m.rollups[idx] = rollup
-		}
-		// the current loop record is after the rollup period
-		// save the old rollup as finished and create a new one
-		if !rollup.Period.Equal(tint) {
-			rollup.Done = true
-			finished = append(finished, rollup)
-			rollup = newRollup(tint, interval)
-			m.rollups[idx] = rollup
-		}
-		rollup.Update(loopRecord)
-	}
-	for _, done := range finished {
-		m.save(done)
-	}
+func (m *Mysql) DeleteFlag(id int64) error {
+	return deleteFlag(m.DB, MysqlDialect, m.Station, id)
 }
 
-func (m *Mysql) save(rollup *Rollup) {
-	if rollup.Count == 0 {
-		return
+// addLoopPartitions splits monthly partitions off the end of loop_records up
+// to the end of the month after at. Records past the last month go in pmax
+// so nothing fails if this falls behind; queries and deletes on a time range
+// only read the partitions for it.
+func (m *Mysql) addLoopPartitions(at time.Time) error {
+	at = at.UTC()
+	until := time.Date(at.Year(), at.Month()+2, 1, 0, 0, 0, 0, time.UTC)
+	if !m.partitionedUntil.Before(until) {
+		return nil
 	}
-	s := rollup.Summary()
-	_, err := m.insertStmt.Exec(s.insert()...)
+	rows, err := m.DB.Query(`select partition_description from information_schema.partitions
+		where table_schema = database() and table_name = 'loop_records' and partition_name is not null`)
 	if err != nil {
-		select {
-		case m.ErrChan <- fmt.Errorf("insert err: %w", err):
-		default:
-			log.Printf("Insert err: %v\n", err)
+		return fmt.Errorf("failed to read loop record partitions: %w", err)
+	}
+	defer rows.Close()
+	var last time.Time
+	for rows.Next() {
+		var bound string
+		if err = rows.Scan(&bound); err != nil {
+			return fmt.Errorf("failed to read loop record partitions: %w", err)
+		}
+		if secs, err := strconv.ParseInt(bound, 10, 64); err == nil && time.Unix(secs, 0).After(last) {
+			last = time.Unix(secs, 0).UTC()
 		}
 	}
-	select {
-	case m.SavedChan <- s:
-	default:
+	if err = rows.Err(); err != nil {
+		return err
 	}
-}
 
-// 5 minutes
-const selectRecent string = "select * from summaries where end_time > ? and summary_seconds = ? order by end_time limit ?"
-
-func (m *Mysql) GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error) {
-	slenmin := int(reportSize / (time.Duration(summarySecondsForReport) * time.Second))
-	var ss []*Summary
-	err := m.ORM.Raw(selectRecent, startTime, summarySecondsForReport, slenmin).Find(&ss).Error
-	//rows, err := m.DB.Query(selectRecent, startTime, summarySecondsForReport, slenmin)
-	if err != nil {
-		return nil, fmt.Errorf("failed to select summaries: %w", err)
+	month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC)
+	if !last.IsZero() {
+		month = last
 	}
-	/*
-		ss := make([]*Summary, slenmin)
-		i := 0
-		for rows.Next() {
-			if i == slenmin {
-				rows.Close()
-				log.Printf("Got too many summary records from DB")
-				break
-			}
-			s := &Summary{}
-			err := rows.Scan(
-				&s.ID,
-				&s.StartTime,
-				&s.EndTime,
-				&s.Measurements,
-				&s.SummarySeconds,
-				&s.WindAvg,
-				&s.WindGust,
-				&s.WindLull,
-				&s.WindStddev,
-				&s.WindDirectionAvg,
-				&s.WindDirectionMin,
-				&s.WindDirectionMax,
-				&s.BarometerAvg,
-				&s.BarometerStart,
-				&s.OutsideTempAvg,
-				&s.OutsideHumidityAvg)
-			if err != nil {
-				rows.Close()
-				return nil, fmt.Errorf("error scanning summaries: %w", err)
-			}
-			// set times to local
-			s.StartTime = s.StartTime.In(time.Local)
-			s.EndTime = s.EndTime.In(time.Local)
-			ss[i] = s
-			i++
-		}
-	*/
-	// warn if we have less than half the records
-	i := len(ss)
-	if i < (slenmin / 2) {
-		log.Printf("Not enough summary records for report: %v/%v", i, slenmin)
+	var partitions []string
+	for ; month.Before(until); month = month.AddDate(0, 1, 0) {
+		partitions = append(partitions, fmt.Sprintf("PARTITION p%v VALUES LESS THAN (%v)",
+			month.Format("200601"), month.AddDate(0, 1, 0).Unix()))
 	}
-	ret := make([]*Summary, slenmin)
-	for i, s := range ss {
-		s.StartTime = s.StartTime.In(time.Local)
-		s.EndTime = s.EndTime.In(time.Local)
-		ret[i] = s
+	if len(partitions) > 0 {
+		partitions = append(partitions, "PARTITION pmax VALUES LESS THAN MAXVALUE")
+		_, err = m.DB.Exec(fmt.Sprintf("ALTER TABLE loop_records REORGANIZE PARTITION pmax INTO (%v)",
+			strings.Join(partitions, ", ")))
+		if err != nil {
+			return fmt.Errorf("failed to add loop record partitions: %w", err)
+		}
 	}
-	return ret, nil
+	m.partitionedUntil = until
+	return nil
+}
+
+func (m *Mysql) Close() error {
+	m.closeLoopRecords()
+	return m.ORM.Close()
 }
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/lib/pq"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Postgres stores summaries in PostgreSQL. If the timescaledb extension is
+// installed the tables are turned into hypertables, otherwise loop_records
+// is partitioned by month.
+type Postgres struct {
+	recorder
+	climateSql
+	DB         *sql.DB
+	insertStmt *sql.Stmt
+	ORM        *gorm.DB
+	// partitionedUntil is the end of the last monthly loop_records
+	// partition, or far in the future for a hypertable
+	partitionedUntil time.Time
+}
+
+// NewPostgres connects using a lib/pq connection string, for example
+// "host=localhost dbname=windygo sslmode=disable"
+func NewPostgres(connectString string) (*Postgres, error) {
+	gormDB, err := gorm.Open("postgres", connectString)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+
+	postgres := &Postgres{
+		DB:  gormDB.DB(),
+		ORM: gormDB,
+	}
+	postgres.recorder = newRecorder(postgres.insert)
+	postgres.recorder.store = postgres
+	postgres.Engine = rollup.NewEngine(rollup.DefaultIntervals, postgres)
+	postgres.climateSql = climateSql{db: postgres.DB, dialect: PostgresDialect, station: &postgres.Station}
+	if err = postgres.init(); err != nil {
+		return nil, err
+	}
+	postgres.insertStmt, err = postgres.DB.Prepare(upsertStatement(PostgresDialect))
+	if err != nil {
+		return nil, fmt.Errorf("failed upsert prepare: %w", err)
+	}
+	return postgres, nil
+}
+
+func (p *Postgres) init() error {
+	migrator, err := NewMigrator(PostgresDialect, p.DB)
+	if err != nil {
+		return err
+	}
+	return migrator.Check()
+}
+
+func (p *Postgres) insert(s *Summary) error {
+	_, err := p.insertStmt.Exec(insertValues(s)...)
+	return err
+}
+
+func (p *Postgres) GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error) {
+	slenmin := reportLength(reportSize, summarySecondsForReport)
+	var ss []*Summary
+	err := p.ORM.Raw(selectRecent, startTime.UTC(), summarySecondsForReport, p.Station, slenmin).Find(&ss).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to select summaries: %w", err)
+	}
+	return p.reportSlice(ss, slenmin)
+}
+
+func (p *Postgres) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error) {
+	ss, err := selectSummaryRange(p.ORM, p.Station, start, end, summarySeconds)
+	if err != nil {
+		return nil, err
+	}
+	return p.inLocation(ss)
+}
+
+func (p *Postgres) SummaryTimes(summarySeconds int) (first, last time.Time, err error) {
+	return summaryTimes(p.DB, PostgresDialect, p.Station, summarySeconds)
+}
+
+func (p *Postgres) DeleteSummaries(before time.Time, summarySeconds int, dryRun bool) (int64, error) {
+	return deleteSummaries(p.DB, PostgresDialect, p.Station, before, summarySeconds, dryRun)
+}
+
+func (p *Postgres) DeleteLoopRecords(before time.Time, dryRun bool) (int64, error) {
+	return deleteLoopRecords(p.DB, PostgresDialect, p.Station, before, dryRun)
+}
+
+func (p *Postgres) SaveArchiveRecords(ars []*vantage.ArchiveRecord) error {
+	return saveArchiveRecords(p.DB, PostgresDialect, p.Station, ars)
+}
+
+func (p *Postgres) GetArchiveRecords(start, end time.Time) ([]*vantage.ArchiveRecord, error) {
+	return selectArchiveRecords(p.DB, PostgresDialect, p.Station, start, end)
+}
+
+// SaveLoopRecords inserts the records, adding the loop_records partitions
+// they need first
+func (p *Postgres) SaveLoopRecords(lrs []*vantage.LoopRecord) error {
+	if len(lrs) == 0 {
+		return nil
+	}
+	err := p.addLoopPartitions(lrs[len(lrs)-1].Recorded)
+	if err != nil {
+		return err
+	}
+	return saveLoopRecords(p.DB, PostgresDialect, p.Station, lrs)
+}
+
+// addLoopPartitions creates the monthly partitions of loop_records up to the
+// end of the month after at. Records past the last month go in the default
+// partition so nothing fails if this falls behind. A hypertable makes its
+// own chunks.
+func (p *Postgres) addLoopPartitions(at time.Time) error {
+	at = at.UTC()
+	until := time.Date(at.Year(), at.Month()+2, 1, 0, 0, 0, 0, time.UTC)
+	if !p.partitionedUntil.Before(until) {
+		return nil
+	}
+	var kind string
+	err := p.DB.QueryRow(`select relkind from pg_class where oid = 'loop_records'::regclass`).Scan(&kind)
+	if err != nil {
+		return fmt.Errorf("failed to read loop record partitions: %w", err)
+	}
+	if kind != "p" {
+		p.partitionedUntil = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+		return nil
+	}
+	for month := time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, time.UTC); month.Before(until); month = month.AddDate(0, 1, 0) {
+		_, err = p.DB.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS loop_records_p%v PARTITION OF loop_records FOR VALUES FROM ('%v') TO ('%v')`,
+			month.Format("200601"), month.Format(time.RFC3339), month.AddDate(0, 1, 0).Format(time.RFC3339)))
+		if err != nil {
+			return fmt.Errorf("failed to add loop record partitions: %w", err)
+		}
+	}
+	p.partitionedUntil = until
+	return nil
+}
+
+func (p *Postgres) GetLoopRecords(start, end time.Time) ([]*vantage.LoopRecord, error) {
+	lrs, err := selectLoopRecords(p.DB, PostgresDialect, p.Station, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return dropInvalidLoopRecords(p, lrs)
+}
+
+func (p *Postgres) SaveFlag(f *Flag) error {
+	return saveFlag(p.DB, PostgresDialect, p.Station, f)
+}
+
+func (p *Postgres) GetFlags(start, end time.Time) ([]*Flag, error) {
+	return selectFlags(p.DB, PostgresDialect, p.Station, start, end)
+}
+
+func (p *Postgres) DeleteFlag(id int64) error {
+	return deleteFlag(p.DB, PostgresDialect, p.Station, id)
+}
+
+func (p *Postgres) Close() error {
+	p.closeLoopRecords()
+	return p.ORM.Close()
+}
@@ -0,0 +1,26 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+// Set WINDYGO_TEST_POSTGRES to the connection string of a scratch database
+// to run this, for example "host=localhost dbname=windygo_test sslmode=disable".
+// The tables in it are emptied.
+func TestPostgresStore(t *testing.T) {
+	connectString := os.Getenv("WINDYGO_TEST_POSTGRES")
+	if connectString == "" {
+		t.Skip("WINDYGO_TEST_POSTGRES not set")
+	}
+	store, err := NewPostgres(connectString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	_, err = store.DB.Exec("TRUNCATE summaries, loop_records, archive_records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, store)
+}
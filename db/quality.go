@@ -0,0 +1,135 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Flag marks a time range valid, suspect or invalid
+type Flag = rollup.Flag
+
+var flagCols []string = []string{"station", "start_time", "end_time", "quality", "reason", "set_by", "set_at"}
+
+// saveFlag inserts the flag and sets its ID
+func saveFlag(sqlDB *sql.DB, dialect, station string, f *Flag) error {
+	query := fmt.Sprintf("insert into quality_flags (%v) VALUES (?,?,?,?,?,?,?)", strings.Join(flagCols, ","))
+	args := []interface{}{station, f.Start.UTC(), f.End.UTC(), f.Quality, f.Reason, f.SetBy, f.SetAt.UTC()}
+	if dialect == PostgresDialect {
+		// lib/pq doesn't support LastInsertId
+		err := sqlDB.QueryRow(rebind(query)+" RETURNING id", args...).Scan(&f.ID)
+		if err != nil {
+			return fmt.Errorf("error saving flag: %w", err)
+		}
+		f.Station = station
+		return nil
+	}
+	result, err := sqlDB.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("error saving flag: %w", err)
+	}
+	f.ID, err = result.LastInsertId()
+	f.Station = station
+	return err
+}
+
+// selectFlags returns the flags that overlap start up to end, oldest first
+func selectFlags(sqlDB *sql.DB, dialect, station string, start, end time.Time) ([]*Flag, error) {
+	query := fmt.Sprintf("select id,%v from quality_flags where station = ? and start_time < ? and end_time > ? order by start_time",
+		strings.Join(flagCols, ","))
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	rows, err := sqlDB.Query(query, station, end.UTC(), start.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to select flags: %w", err)
+	}
+	defer rows.Close()
+	flags := make([]*Flag, 0)
+	for rows.Next() {
+		f := &Flag{}
+		err = rows.Scan(&f.ID, &f.Station, &f.Start, &f.End, &f.Quality, &f.Reason, &f.SetBy, &f.SetAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read flag: %w", err)
+		}
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+// deleteFlag deletes the station's flag with the id
+func deleteFlag(sqlDB *sql.DB, dialect, station string, id int64) error {
+	query := "delete from quality_flags where station = ? and id = ?"
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	result, err := sqlDB.Exec(query, station, id)
+	if err != nil {
+		return fmt.Errorf("error deleting flag %v: %w", id, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("no flag %v", id)
+	}
+	return nil
+}
+
+// flagGetter is the part of Store that reads flags
+type flagGetter interface {
+	GetFlags(start, end time.Time) ([]*Flag, error)
+}
+
+// applyStoredFlags sets the quality of the summaries from the flags over
+// them
+func applyStoredFlags(store flagGetter, ss []*Summary) error {
+	var start, end time.Time
+	for _, s := range ss {
+		if s == nil {
+			continue
+		}
+		if start.IsZero() || s.StartTime.Before(start) {
+			start = s.StartTime
+		}
+		if s.EndTime.After(end) {
+			end = s.EndTime
+		}
+	}
+	if start.IsZero() {
+		return nil
+	}
+	flags, err := store.GetFlags(start, end)
+	if err != nil {
+		return err
+	}
+	rollup.ApplyFlags(ss, flags)
+	return nil
+}
+
+// dropInvalidLoopRecords removes the loop records received while a flag
+// marked the data invalid
+func dropInvalidLoopRecords(store flagGetter, lrs []*vantage.LoopRecord) ([]*vantage.LoopRecord, error) {
+	if len(lrs) == 0 {
+		return lrs, nil
+	}
+	flags, err := store.GetFlags(lrs[0].Recorded, lrs[len(lrs)-1].Recorded.Add(time.Nanosecond))
+	if err != nil {
+		return nil, err
+	}
+	kept := lrs[:0]
+	for _, lr := range lrs {
+		invalid := false
+		for _, f := range flags {
+			if f.Quality == rollup.QualityInvalid && f.Overlaps(lr.Recorded, lr.Recorded.Add(time.Nanosecond)) {
+				invalid = true
+				break
+			}
+		}
+		if !invalid {
+			kept = append(kept, lr)
+		}
+	}
+	return kept, nil
+}
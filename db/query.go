@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+)
+
+// QueryIntervals are the summary intervals Query can read, shortest first
+var QueryIntervals = []time.Duration{time.Minute, 5 * time.Minute, 10 * time.Minute, time.Hour, 24 * time.Hour}
+
+// SummaryReader reads saved summaries, like a Store or a cache.Cache in
+// front of one
+type SummaryReader interface {
+	GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error)
+}
+
+// Bucket is one period of a query. Summary is nil when there's no data for
+// the period.
+type Bucket struct {
+	Start   time.Time
+	End     time.Time
+	Summary *Summary
+}
+
+// Query returns the summaries from start to end in buckets of the given
+// size, like 30 minutes made from 5 minute summaries. It reads the longest
+// of QueryIntervals that divide bucket first and fills in what they don't
+// cover from the shorter ones, so ranges whose short summaries were pruned
+// and hours and days that aren't over yet both come back, and merges them
+// with rollup.Merge. Buckets are aligned like the summaries, with daily
+// ones starting at midnight in start's zone; start is moved back to the
+// start of its bucket and every bucket up to end is returned, with a nil
+// Summary for gaps. worst is the worst quality kept: rollup.QualitySuspect
+// (or "") leaves out the invalid summaries and rollup.QualityValid leaves
+// out the suspect ones too.
+func Query(store SummaryReader, start, end time.Time, bucket time.Duration, worst string) ([]Bucket, error) {
+	if bucket <= 0 {
+		return nil, fmt.Errorf("bad bucket size %v", bucket)
+	}
+	if worst == "" {
+		worst = rollup.QualitySuspect
+	}
+	loc := start.Location()
+	start = rollup.PeriodStart(start, bucket, loc)
+	if !start.Before(end) {
+		return nil, fmt.Errorf("query end %v is not after start %v", end, start)
+	}
+	if rounded := rollup.PeriodStart(end, bucket, loc); !rounded.Equal(end) {
+		end = rollup.PeriodEnd(rounded, bucket, loc)
+	}
+
+	var sources []time.Duration
+	for i := len(QueryIntervals) - 1; i >= 0; i-- {
+		interval := QueryIntervals[i]
+		if interval <= bucket && bucket%interval == 0 {
+			sources = append(sources, interval)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no summary interval divides %v", bucket)
+	}
+
+	buckets := make([]Bucket, 0, int(end.Sub(start)/bucket))
+	for period := start; period.Before(end); period = rollup.PeriodEnd(period, bucket, loc) {
+		buckets = append(buckets, Bucket{Start: period, End: rollup.PeriodEnd(period, bucket, loc)})
+	}
+	inside := make([][]*Summary, len(buckets))
+	covered := make([]time.Duration, len(buckets))
+	// the periods of the longer intervals already read, by interval
+	taken := make(map[time.Duration]map[int64]bool, len(sources))
+	for _, interval := range sources {
+		// only read the range of the buckets that aren't full yet
+		first, last := -1, -1
+		for i, b := range buckets {
+			if covered[i] < b.End.Sub(b.Start) {
+				if first < 0 {
+					first = i
+				}
+				last = i
+			}
+		}
+		if first < 0 {
+			break
+		}
+		found, err := store.GetSummaryRange(buckets[first].Start, buckets[last].End, int(interval/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		taken[interval] = make(map[int64]bool, len(found))
+		next := first
+		for _, s := range found {
+			if rollup.Worse(s.Quality, worst) || coveredBy(taken, s, loc) {
+				continue
+			}
+			for next < len(buckets) && !s.StartTime.Before(buckets[next].End) {
+				next++
+			}
+			if next == len(buckets) {
+				break
+			}
+			taken[interval][s.StartTime.Unix()] = true
+			inside[next] = append(inside[next], s)
+			covered[next] += s.EndTime.Sub(s.StartTime)
+		}
+	}
+
+	for i := range buckets {
+		ss := inside[i]
+		if len(ss) == 1 && time.Duration(ss[0].SummarySeconds)*time.Second == bucket {
+			buckets[i].Summary = ss[0]
+		} else if len(ss) > 0 {
+			buckets[i].Summary = rollup.Merge(buckets[i].Start, bucket, loc, ss)
+		}
+	}
+	return buckets, nil
+}
+
+// coveredBy is true if s is inside a period of a longer interval already
+// taken
+func coveredBy(taken map[time.Duration]map[int64]bool, s *Summary, loc *time.Location) bool {
+	for interval, periods := range taken {
+		if time.Duration(s.SummarySeconds)*time.Second < interval && periods[rollup.PeriodStart(s.StartTime, interval, loc).Unix()] {
+			return true
+		}
+	}
+	return false
+}
+
+// Summaries returns the summaries of the buckets with nils for the gaps,
+// like GetSummaries
+func Summaries(buckets []Bucket) []*Summary {
+	ss := make([]*Summary, len(buckets))
+	for i, b := range buckets {
+		ss[i] = b.Summary
+	}
+	return ss
+}
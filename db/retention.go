@@ -0,0 +1,84 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const selectRange string = "select * from summaries where station = ? and summary_seconds = ? and start_time >= ? and start_time < ? order by start_time"
+
+// selectSummaryRange returns the summaries that start from start up to end
+func selectSummaryRange(orm *gorm.DB, station string, start, end time.Time, summarySeconds int) ([]*Summary, error) {
+	var ss []*Summary
+	err := orm.Raw(selectRange, station, summarySeconds, start.UTC(), end.UTC()).Find(&ss).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to select summaries: %w", err)
+	}
+	return ss, nil
+}
+
+// summaryTimes is the start of the first and last summaries, zero if there
+// are none. min() and max() would lose the column type in sqlite.
+func summaryTimes(sqlDB *sql.DB, dialect, station string, summarySeconds int) (first, last time.Time, err error) {
+	query := "select start_time from summaries where station = ? and summary_seconds = ? order by start_time %v limit 1"
+	for _, order := range []string{"asc", "desc"} {
+		q := fmt.Sprintf(query, order)
+		if dialect == PostgresDialect {
+			q = rebind(q)
+		}
+		var t time.Time
+		err = sqlDB.QueryRow(q, station, summarySeconds).Scan(&t)
+		if err == sql.ErrNoRows {
+			return time.Time{}, time.Time{}, nil
+		}
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("failed to select summary times: %w", err)
+		}
+		if order == "asc" {
+			first = t
+		} else {
+			last = t
+		}
+	}
+	return first, last, nil
+}
+
+// deleteSummaries deletes the summaries that start before before, or only
+// counts them for a dry run
+func deleteSummaries(sqlDB *sql.DB, dialect, station string, before time.Time, summarySeconds int, dryRun bool) (int64, error) {
+	where := "from summaries where station = ? and summary_seconds = ? and start_time < ?"
+	return deleteOrCount(sqlDB, dialect, where, dryRun, station, summarySeconds, before.UTC())
+}
+
+// deleteLoopRecords deletes the loop records from before before, or only
+// counts them for a dry run
+func deleteLoopRecords(sqlDB *sql.DB, dialect, station string, before time.Time, dryRun bool) (int64, error) {
+	return deleteOrCount(sqlDB, dialect, "from loop_records where station = ? and recorded < ?", dryRun, station, before.UTC())
+}
+
+func deleteOrCount(sqlDB *sql.DB, dialect, fromWhere string, dryRun bool, args ...interface{}) (int64, error) {
+	if dryRun {
+		query := "select count(*) " + fromWhere
+		if dialect == PostgresDialect {
+			query = rebind(query)
+		}
+		var count int64
+		err := sqlDB.QueryRow(query, args...).Scan(&count)
+		if err != nil {
+			return 0, fmt.Errorf("failed to count rows to prune: %w", err)
+		}
+		return count, nil
+	}
+	query := "delete " + fromWhere
+	if dialect == PostgresDialect {
+		query = rebind(query)
+	}
+	result, err := sqlDB.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune: %w", err)
+	}
+	return result.RowsAffected()
+}
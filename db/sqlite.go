@@ -0,0 +1,129 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// SQLite is an embedded store in a single file so a deployment
+// doesn't need a database server
+type SQLite struct {
+	recorder
+	climateSql
+	DB         *sql.DB
+	insertStmt *sql.Stmt
+	ORM        *gorm.DB
+}
+
+func NewSQLite(fileName string) (*SQLite, error) {
+	gormDB, err := gorm.Open("sqlite3", fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error opening sqlite %v: %w", fileName, err)
+	}
+	// sqlite only allows one writer at a time
+	gormDB.DB().SetMaxOpenConns(1)
+
+	sqlite := &SQLite{
+		DB:  gormDB.DB(),
+		ORM: gormDB,
+	}
+	sqlite.recorder = newRecorder(sqlite.insert)
+	sqlite.recorder.store = sqlite
+	sqlite.Engine = rollup.NewEngine(rollup.DefaultIntervals, sqlite)
+	sqlite.climateSql = climateSql{db: sqlite.DB, dialect: SQLiteDialect, station: &sqlite.Station}
+	if err = sqlite.init(); err != nil {
+		return nil, err
+	}
+	sqlite.insertStmt, err = sqlite.DB.Prepare(upsertStatement(SQLiteDialect))
+	if err != nil {
+		return nil, fmt.Errorf("failed upsert prepare: %w", err)
+	}
+	return sqlite, nil
+}
+
+func (s *SQLite) init() error {
+	migrator, err := NewMigrator(SQLiteDialect, s.DB)
+	if err != nil {
+		return err
+	}
+	return migrator.Check()
+}
+
+func (s *SQLite) insert(summary *Summary) error {
+	_, err := s.insertStmt.Exec(insertValues(summary)...)
+	return err
+}
+
+func (s *SQLite) GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error) {
+	slenmin := reportLength(reportSize, summarySecondsForReport)
+	var ss []*Summary
+	err := s.ORM.Raw(selectRecent, startTime.UTC(), summarySecondsForReport, s.Station, slenmin).Find(&ss).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to select summaries: %w", err)
+	}
+	return s.reportSlice(ss, slenmin)
+}
+
+func (s *SQLite) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error) {
+	ss, err := selectSummaryRange(s.ORM, s.Station, start, end, summarySeconds)
+	if err != nil {
+		return nil, err
+	}
+	return s.inLocation(ss)
+}
+
+func (s *SQLite) SummaryTimes(summarySeconds int) (first, last time.Time, err error) {
+	return summaryTimes(s.DB, SQLiteDialect, s.Station, summarySeconds)
+}
+
+func (s *SQLite) DeleteSummaries(before time.Time, summarySeconds int, dryRun bool) (int64, error) {
+	return deleteSummaries(s.DB, SQLiteDialect, s.Station, before, summarySeconds, dryRun)
+}
+
+func (s *SQLite) DeleteLoopRecords(before time.Time, dryRun bool) (int64, error) {
+	return deleteLoopRecords(s.DB, SQLiteDialect, s.Station, before, dryRun)
+}
+
+func (s *SQLite) SaveArchiveRecords(ars []*vantage.ArchiveRecord) error {
+	return saveArchiveRecords(s.DB, SQLiteDialect, s.Station, ars)
+}
+
+func (s *SQLite) GetArchiveRecords(start, end time.Time) ([]*vantage.ArchiveRecord, error) {
+	return selectArchiveRecords(s.DB, SQLiteDialect, s.Station, start, end)
+}
+
+func (s *SQLite) SaveLoopRecords(lrs []*vantage.LoopRecord) error {
+	return saveLoopRecords(s.DB, SQLiteDialect, s.Station, lrs)
+}
+
+func (s *SQLite) GetLoopRecords(start, end time.Time) ([]*vantage.LoopRecord, error) {
+	lrs, err := selectLoopRecords(s.DB, SQLiteDialect, s.Station, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return dropInvalidLoopRecords(s, lrs)
+}
+
+func (s *SQLite) SaveFlag(f *Flag) error {
+	return saveFlag(s.DB, SQLiteDialect, s.Station, f)
+}
+
+func (s *SQLite) GetFlags(start, end time.Time) ([]*Flag, error) {
+	return selectFlags(s.DB, SQLiteDialect, s.Station, start, end)
+}
+
+func (s *SQLite) DeleteFlag(id int64) error {
+	return deleteFlag(s.DB, SQLiteDialect, s.Station, id)
+}
+
+func (s *SQLite) Close() error {
+	s.closeLoopRecords()
+	return s.ORM.Close()
+}
@@ -0,0 +1,360 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/cache"
+	"github.com/smw1218/windygo/climate"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/spool"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Store persists the summaries windygo creates from loop packets.
+// Implementations are MySQL, SQLite and an in-memory store for tests
+// and deployments that don't need history.
+type Store interface {
+	// Record takes a raw loop packet, updates the rollups and saves any
+	// summaries that finished
+	Record(loopPkt []byte)
+	// SaveSummary saves a summary and sends it to subscribers
+	SaveSummary(s *Summary) error
+	// GetSummaries returns reportSize worth of summaries starting at startTime.
+	// The slice is always the full report length and is padded with nils
+	// when there isn't enough data.
+	GetSummaries(startTime time.Time, reportSize time.Duration, summarySecondsForReport int) ([]*Summary, error)
+	// Subscribe returns a channel that receives every saved summary. Slow
+	// subscribers miss summaries rather than blocking the store.
+	Subscribe() <-chan *Summary
+	// GetSummaryRange returns the summaries that start from start up to
+	// end, oldest first and without padding
+	GetSummaryRange(start, end time.Time, summarySeconds int) ([]*Summary, error)
+	// SummaryTimes is the start of the first and last summaries of the
+	// interval, zero if there are none
+	SummaryTimes(summarySeconds int) (first, last time.Time, err error)
+	// DeleteSummaries deletes the summaries of the interval that start
+	// before before and returns how many. A dry run only counts them.
+	DeleteSummaries(before time.Time, summarySeconds int, dryRun bool) (int64, error)
+	// SaveLoopRecords inserts a batch of loop records
+	SaveLoopRecords(lrs []*vantage.LoopRecord) error
+	// GetLoopRecords returns the loop records received from start up to
+	// end, oldest first, leaving out the ones flagged invalid
+	GetLoopRecords(start, end time.Time) ([]*vantage.LoopRecord, error)
+	// DeleteLoopRecords deletes loop records from before before like
+	// DeleteSummaries
+	DeleteLoopRecords(before time.Time, dryRun bool) (int64, error)
+	// SaveArchiveRecords saves records from the console's archive,
+	// replacing any with the same console time
+	SaveArchiveRecords(ars []*vantage.ArchiveRecord) error
+	// GetArchiveRecords returns the archive records with a host time from
+	// start up to end, oldest first
+	GetArchiveRecords(start, end time.Time) ([]*vantage.ArchiveRecord, error)
+	// daily aggregates and records
+	climate.Store
+	// SaveFlag saves a quality flag for this station and sets its ID
+	SaveFlag(f *Flag) error
+	// GetFlags returns the flags that overlap start up to end
+	GetFlags(start, end time.Time) ([]*Flag, error)
+	DeleteFlag(id int64) error
+	// Errors receives errors from saving summaries in Record
+	Errors() <-chan error
+	// Configure sets the options every store shares
+	Configure(opts Options)
+	Close() error
+}
+
+// Options are the settings every store shares
+type Options struct {
+	Clock *vantage.Clock
+	// Engine, when set, replaces the store's engine and saves to the store
+	Engine  *rollup.Engine
+	Spool   *spool.Spool
+	Station string
+	Cache   *cache.Cache
+	// LoopRecords is how often loop records are saved in batches, 0
+	// doesn't keep them
+	LoopRecords time.Duration
+}
+
+// recorder does the rollups and the fan out to subscribers that every store
+// shares. The store only has to provide the insert.
+type recorder struct {
+	// Clock is used for the console time of loop records and the
+	// station time zone of returned summaries; it may be nil
+	Clock *vantage.Clock
+	// Engine does the rollups for Record. The constructors set it to the
+	// default intervals saving to this store; replace it before recording.
+	Engine *rollup.Engine
+	// Station is saved with every summary and only this station's
+	// summaries are returned
+	Station string
+	// Spool keeps summaries, and loop record batches from LoopRecords, that
+	// couldn't be inserted until the database is back; it may be nil
+	Spool *spool.Spool
+	// LoopRecords saves the loop records given to Record in batches; they
+	// aren't kept if it's nil
+	LoopRecords *LoopBatcher
+	// Cache gets the loop records given to Record and the saved summaries;
+	// it may be nil
+	Cache   *cache.Cache
+	ErrChan chan error
+	insert  func(s *Summary) error
+	// store is the store the recorder is part of, for its flags and loop
+	// record inserts; it may be nil
+	store       Store
+	subMutex    sync.Mutex
+	subscribers []chan *Summary
+}
+
+func newRecorder(insert func(s *Summary) error) recorder {
+	return recorder{
+		ErrChan: make(chan error, 1),
+		insert:  insert,
+	}
+}
+
+// Configure sets the recorder's fields from opts and adds the store as a sink
+// of the engine
+func (r *recorder) Configure(opts Options) {
+	r.Clock = opts.Clock
+	r.Spool = opts.Spool
+	r.Station = opts.Station
+	r.Cache = opts.Cache
+	if opts.Engine != nil {
+		r.Engine = opts.Engine
+		r.Engine.AddSink(r.store)
+	}
+	if opts.LoopRecords > 0 {
+		r.LoopRecords = NewLoopBatcher(r.store, opts.LoopRecords)
+		r.LoopRecords.Spool = opts.Spool
+	}
+}
+
+func (r *recorder) Record(loopPkt []byte) {
+	loopRecord := r.Clock.ParseLoop(loopPkt)
+	if r.Cache != nil {
+		r.Cache.AddLoop(loopRecord)
+	}
+	if r.LoopRecords != nil {
+		r.LoopRecords.Add(loopRecord)
+	}
+	err := r.Engine.Record(loopRecord)
+	if err != nil {
+		select {
+		case r.ErrChan <- err:
+		default:
+			log.Printf("Insert err: %v\n", err)
+		}
+	}
+}
+
+// closeLoopRecords saves the last batch of loop records
+func (r *recorder) closeLoopRecords() {
+	if r.LoopRecords == nil {
+		return
+	}
+	if err := r.LoopRecords.Close(); err != nil {
+		log.Printf("Error saving loop records: %v", err)
+	}
+}
+
+// SaveSummary inserts the summary, replacing any saved summary for the same
+// station, start time and interval. Subscribers get the summary even if the
+// insert fails so the live report keeps updating.
+func (r *recorder) SaveSummary(s *Summary) error {
+	if s.Station == "" {
+		s.Station = r.Station
+	}
+	if s.Source == "" {
+		s.Source = rollup.SourceLoop
+	}
+	err := r.insertOrSpool(s)
+	// so the live report shows flags set ahead, like for maintenance
+	if flagErr := r.applyFlags([]*Summary{s}); flagErr != nil {
+		log.Printf("Error reading flags: %v", flagErr)
+	}
+	s.In(r.Clock.Location())
+	if r.Cache != nil {
+		r.Cache.AddSummary(s)
+	}
+	r.publish(s)
+	return err
+}
+
+// insertOrSpool inserts the summary, or appends it to the spool if the insert
+// fails. While the spool has summaries waiting, new ones go behind them so
+// they're replayed in order, unless the spool is full, when the database
+// may be back before the replay has caught up.
+func (r *recorder) insertOrSpool(s *Summary) error {
+	if r.Spool == nil {
+		return r.insertErr(s)
+	}
+	if r.Spool.Pending() {
+		err := r.spool(s, nil)
+		if !errors.Is(err, spool.ErrFull) {
+			return err
+		}
+		insertErr := r.insertErr(s)
+		if insertErr != nil {
+			return fmt.Errorf("%v, not spooled: %w", insertErr, err)
+		}
+		return nil
+	}
+	err := r.insertErr(s)
+	if err != nil {
+		return r.spool(s, err)
+	}
+	return nil
+}
+
+func (r *recorder) insertErr(s *Summary) error {
+	err := r.insert(s)
+	if err != nil {
+		return fmt.Errorf("insert err: %w", err)
+	}
+	return nil
+}
+
+func (r *recorder) spool(s *Summary, insertErr error) error {
+	err := r.Spool.Append(spool.KindSummary, summaryKey(s), s)
+	if err != nil {
+		if insertErr != nil {
+			return fmt.Errorf("%v, not spooled: %w", insertErr, err)
+		}
+		return err
+	}
+	if insertErr != nil {
+		return fmt.Errorf("%w (spooled for replay)", insertErr)
+	}
+	return nil
+}
+
+// summaryKey identifies a summary in the spool
+func summaryKey(s *Summary) string {
+	return fmt.Sprintf("%v/%v/%v", s.Station, s.StartTime.UTC().Format(time.RFC3339), s.SummarySeconds)
+}
+
+// ReplaySpool inserts the spooled summaries and loop records. It stops at the first insert that
+// fails and leaves the rest for the next try.
+func (r *recorder) ReplaySpool() (int, error) {
+	if r.Spool == nil {
+		return 0, nil
+	}
+	return r.Spool.Replay(func(e spool.Entry) error {
+		switch e.Kind {
+		case spool.KindSummary:
+			s := &Summary{}
+			err := json.Unmarshal(e.Data, s)
+			if err != nil {
+				log.Printf("Dropping spooled summary %v: %v", e.Key, err)
+				return nil
+			}
+			return r.insertErr(s)
+		case spool.KindLoop:
+			if r.LoopRecords == nil {
+				log.Printf("Dropping spooled loop records %v, this store doesn't save them", e.Key)
+				return nil
+			}
+			var lrs []*vantage.LoopRecord
+			err := json.Unmarshal(e.Data, &lrs)
+			if err != nil {
+				log.Printf("Dropping spooled loop records %v: %v", e.Key, err)
+				return nil
+			}
+			return r.LoopRecords.Store.SaveLoopRecords(lrs)
+		default:
+			log.Printf("Dropping spooled %v %v, this store doesn't save them", e.Kind, e.Key)
+			return nil
+		}
+	})
+}
+
+// ReplaySpoolForever replays the spool now and then every interval until
+// stop is closed
+func (r *recorder) ReplaySpoolForever(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if r.Spool.Pending() {
+			n, err := r.ReplaySpool()
+			if n > 0 {
+				log.Printf("Replayed %v spooled summaries and loop record batches", n)
+			}
+			if err != nil {
+				log.Printf("Spool replay stopped: %v", err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *recorder) Subscribe() <-chan *Summary {
+	r.subMutex.Lock()
+	defer r.subMutex.Unlock()
+	c := make(chan *Summary, 10)
+	r.subscribers = append(r.subscribers, c)
+	return c
+}
+
+func (r *recorder) publish(s *Summary) {
+	r.subMutex.Lock()
+	defer r.subMutex.Unlock()
+	for _, c := range r.subscribers {
+		select {
+		case c <- s:
+		default:
+		}
+	}
+}
+
+func (r *recorder) Errors() <-chan error {
+	return r.ErrChan
+}
+
+// reportSlice converts the summaries to the station zone, sets their quality
+// from the flags and pads them out to the full report length
+func (r *recorder) reportSlice(ss []*Summary, slenmin int) ([]*Summary, error) {
+	// warn if we have less than half the records
+	if len(ss) < (slenmin / 2) {
+		log.Printf("Not enough summary records for report: %v/%v", len(ss), slenmin)
+	}
+	ret := make([]*Summary, slenmin)
+	loc := r.Clock.Location()
+	for i, s := range ss {
+		if i == slenmin {
+			break
+		}
+		ret[i] = s.In(loc)
+	}
+	return ret, r.applyFlags(ret)
+}
+
+// inLocation converts the summaries to the station zone and sets their
+// quality from the flags
+func (r *recorder) inLocation(ss []*Summary) ([]*Summary, error) {
+	loc := r.Clock.Location()
+	for _, s := range ss {
+		s.In(loc)
+	}
+	return ss, r.applyFlags(ss)
+}
+
+func (r *recorder) applyFlags(ss []*Summary) error {
+	if r.store == nil {
+		return nil
+	}
+	return applyStoredFlags(r.store, ss)
+}
+
+func reportLength(reportSize time.Duration, summarySecondsForReport int) int {
+	return int(reportSize / (time.Duration(summarySecondsForReport) * time.Second))
+}
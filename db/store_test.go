@@ -0,0 +1,590 @@
+package db
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/spool"
+	"github.com/smw1218/windygo/vantage"
+)
+
+func loopPacket(recorded time.Time, wind, direction int) []byte {
+	return weatherPacket(recorded, wind, direction, 650, 0)
+}
+
+func weatherPacket(recorded time.Time, wind, direction, tempRaw, dayRainRaw int) []byte {
+	pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+	binary.LittleEndian.PutUint64(pkt, uint64(recorded.UnixNano()))
+	copy(pkt[8:], "LOO")
+	pkt[8+14] = byte(wind)
+	binary.LittleEndian.PutUint16(pkt[8+16:], uint16(direction))
+	binary.LittleEndian.PutUint16(pkt[8+7:], 30000)
+	binary.LittleEndian.PutUint16(pkt[8+12:], uint16(tempRaw))
+	pkt[8+33] = 50 // humidity
+	binary.LittleEndian.PutUint16(pkt[8+50:], uint16(dayRainRaw))
+	return pkt
+}
+
+func testStore(t *testing.T, store Store) {
+	saved := store.Subscribe()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// 11 minutes of packets every 2 seconds finishes all the intervals
+	for i := 0; i < 11*30; i++ {
+		// rain every 30 seconds
+		store.Record(weatherPacket(start.Add(time.Duration(i)*2*time.Second), 10+i%2*2, 270, 650+i%2, i/15))
+	}
+	select {
+	case s := <-saved:
+		if s.SummarySeconds != 60 || s.WindAvg != 11 {
+			t.Fatalf("unexpected first summary %+v", s)
+		}
+	default:
+		t.Fatal("no summary sent to subscriber")
+	}
+
+	ss, err := store.GetSummaries(start.Add(-time.Minute), 10*time.Minute, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 10 {
+		t.Fatalf("expected padded report of 10, got %v", len(ss))
+	}
+	for i, s := range ss {
+		if s == nil {
+			t.Fatalf("missing summary %v", i)
+		}
+		if !s.StartTime.Equal(start.Add(time.Duration(i) * time.Minute)) {
+			t.Fatalf("summary %v starts at %v", i, s.StartTime)
+		}
+		if s.Measurements != 30 || s.WindGust != 12 || s.WindLull != 10 || s.WindDirectionAvg != 270 {
+			t.Fatalf("unexpected summary %+v", s)
+		}
+		if s.OutsideTempMin != 65 || math.Abs(s.OutsideTempMax-65.1) > 0.001 || s.OutsideHumidityMax != 50 {
+			t.Fatalf("unexpected temperature or humidity %+v", s)
+		}
+		if s.Histogram.Direction[12] != 30 || len(s.Histogram.Speed) != 13 ||
+			s.Histogram.Speed[10] != 15 || s.Histogram.SpeedBySector[12][12] != 15 {
+			t.Fatalf("unexpected histogram %+v", s.Histogram)
+		}
+		// the first sample has nothing to compare with so misses the rain at the boundary
+		expectedRain := 0.02
+		if i == 0 {
+			expectedRain = 0.01
+		}
+		if math.Abs(s.RainTotal-expectedRain) > 0.0001 {
+			t.Fatalf("summary %v expected rain %v got %v", i, expectedRain, s.RainTotal)
+		}
+	}
+
+	ss, err = store.GetSummaries(start, 10*time.Minute, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ss) != 1 || ss[0] == nil || ss[0].Measurements != 300 || math.Abs(ss[0].RainTotal-0.19) > 0.0001 {
+		t.Fatalf("unexpected 10 minute summaries %+v", ss)
+	}
+
+	// saving the same summary again replaces it
+	again := *ss[0]
+	again.WindAvg = 20
+	if err = store.SaveSummary(&again); err != nil {
+		t.Fatal(err)
+	}
+	ss, err = store.GetSummaries(start, 20*time.Minute, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ss[0] == nil || ss[0].WindAvg != 20 || ss[1] != nil {
+		t.Fatalf("expected the summary to be replaced got %+v", ss)
+	}
+
+	first, last, err := store.SummaryTimes(60)
+	if err != nil || !first.Equal(start) || !last.Equal(start.Add(9*time.Minute)) {
+		t.Fatalf("unexpected summary times %v %v %v", first, last, err)
+	}
+	if ss, err = store.GetSummaryRange(start, start.Add(5*time.Minute), 60); err != nil || len(ss) != 5 {
+		t.Fatalf("expected 5 summaries in range got %v %v", len(ss), err)
+	}
+	for _, dryRun := range []bool{true, false} {
+		if deleted, err := store.DeleteSummaries(start.Add(5*time.Minute), 60, dryRun); err != nil || deleted != 5 {
+			t.Fatalf("expected 5 deleted got %v %v", deleted, err)
+		}
+	}
+	if first, _, err = store.SummaryTimes(60); err != nil || !first.Equal(start.Add(5*time.Minute)) {
+		t.Fatalf("expected summaries from %v got %v %v", start.Add(5*time.Minute), first, err)
+	}
+	if _, err = store.DeleteLoopRecords(start, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemory())
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "windygo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testStore(t, store)
+}
+
+func TestConfigure(t *testing.T) {
+	store := NewMemory()
+	engine := rollup.NewEngine([]time.Duration{time.Minute})
+	store.Configure(Options{Engine: engine, Station: "alameda", LoopRecords: time.Hour})
+	if store.Engine != engine || store.Station != "alameda" || store.LoopRecords == nil || store.LoopRecords.Store != store {
+		t.Fatal("options not applied")
+	}
+	// the engine saves to the store
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	if err := engine.Record(&vantage.LoopRecord{Recorded: start, Wind: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Record(&vantage.LoopRecord{Recorded: start.Add(time.Minute), Wind: 10}); err != nil {
+		t.Fatal(err)
+	}
+	if ss, err := store.GetSummaryRange(start, start.Add(time.Minute), 60); err != nil || len(ss) != 1 || ss[0].Station != "alameda" {
+		t.Fatalf("expected the engine's summary saved got %v %v", ss, err)
+	}
+}
+
+func TestSpoolReplay(t *testing.T) {
+	summarySpool, err := spool.Open(filepath.Join(t.TempDir(), "spool"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := true
+	var inserted []*Summary
+	r := newRecorder(func(s *Summary) error {
+		if down {
+			return errors.New("database is down")
+		}
+		inserted = append(inserted, s)
+		return nil
+	})
+	r.Spool = summarySpool
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		s := &Summary{StartTime: start.Add(time.Duration(i) * time.Minute), SummarySeconds: 60, WindAvg: float64(i)}
+		// only the first tries the database, the rest queue behind it
+		if err = r.SaveSummary(s); (err == nil) == (i == 0) {
+			t.Fatalf("unexpected error for summary %v: %v", i, err)
+		}
+	}
+	if _, err = r.ReplaySpool(); err == nil || len(inserted) != 0 {
+		t.Fatalf("replay should fail while the database is down, got %v", err)
+	}
+
+	down = false
+	// saved behind the spooled summaries to keep them in order
+	if err = r.SaveSummary(&Summary{StartTime: start.Add(3 * time.Minute), SummarySeconds: 60, WindAvg: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 0 {
+		t.Fatal("summary should wait behind the spool")
+	}
+	n, err := r.ReplaySpool()
+	if err != nil || n != 4 {
+		t.Fatalf("expected 4 replayed got %v %v", n, err)
+	}
+	for i, s := range inserted {
+		if s.WindAvg != float64(i) || !s.StartTime.Equal(start.Add(time.Duration(i)*time.Minute)) {
+			t.Fatalf("unexpected replay order %+v", inserted)
+		}
+	}
+}
+
+func TestSpoolFull(t *testing.T) {
+	down := true
+	var inserted []*Summary
+	r := newRecorder(func(s *Summary) error {
+		if down {
+			return errors.New("database is down")
+		}
+		inserted = append(inserted, s)
+		return nil
+	})
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	first := &Summary{StartTime: start, SummarySeconds: 60}
+	line, err := json.Marshal(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// room for the first summary and not a second
+	r.Spool, err = spool.Open(filepath.Join(t.TempDir(), "spool"), int64(len(line))*3/2+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.SaveSummary(first); err == nil || !r.Spool.Pending() {
+		t.Fatalf("expected the first summary spooled got %v", err)
+	}
+	second := &Summary{StartTime: start.Add(time.Minute), SummarySeconds: 60}
+	if err = r.SaveSummary(second); !errors.Is(err, spool.ErrFull) {
+		t.Fatalf("expected ErrFull got %v", err)
+	}
+
+	// once the database is back a summary that doesn't fit goes straight in
+	down = false
+	third := &Summary{StartTime: start.Add(2 * time.Minute), SummarySeconds: 60}
+	if err = r.SaveSummary(third); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted) != 1 || inserted[0] != third {
+		t.Fatalf("expected the third summary inserted got %+v", inserted)
+	}
+	if n, err := r.ReplaySpool(); err != nil || n != 1 || len(inserted) != 2 || !inserted[1].StartTime.Equal(start) {
+		t.Fatalf("expected the first summary replayed got %v %v", n, err)
+	}
+}
+
+// flakySaver saves loop records unless down
+type flakySaver struct {
+	down  bool
+	saved []*vantage.LoopRecord
+}
+
+func (f *flakySaver) SaveLoopRecords(lrs []*vantage.LoopRecord) error {
+	if f.down {
+		return errors.New("database is down")
+	}
+	f.saved = append(f.saved, lrs...)
+	return nil
+}
+
+func TestSpoolLoopRecords(t *testing.T) {
+	summarySpool, err := spool.Open(filepath.Join(t.TempDir(), "spool"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saver := &flakySaver{down: true}
+	r := newRecorder(func(s *Summary) error { return nil })
+	r.Spool = summarySpool
+	r.LoopRecords = NewLoopBatcher(saver, time.Hour)
+	r.LoopRecords.Spool = summarySpool
+	defer r.LoopRecords.Close()
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		r.LoopRecords.Add(vantage.ParseLoop(loopPacket(start.Add(time.Duration(i)*2*time.Second), 10+i, 270)))
+	}
+	if err = r.LoopRecords.Flush(); err == nil {
+		t.Fatal("expected the flush to fail while the database is down")
+	}
+	if !summarySpool.Pending() {
+		t.Fatal("expected the batch spooled")
+	}
+
+	saver.down = false
+	if err = r.LoopRecords.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(saver.saved) != 0 {
+		t.Fatal("the spooled batch shouldn't be retried by the batcher")
+	}
+	n, err := r.ReplaySpool()
+	if err != nil || n != 1 || len(saver.saved) != 3 || saver.saved[2].Wind != 12 || !saver.saved[0].Recorded.Equal(start) {
+		t.Fatalf("expected the batch of 3 replayed got %v %v %v", n, len(saver.saved), err)
+	}
+}
+
+func TestFillGaps(t *testing.T) {
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "windygo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		err = store.SaveSummary(&Summary{StartTime: start.Add(time.Duration(i) * time.Minute),
+			EndTime: start.Add(time.Duration(i+1) * time.Minute), SummarySeconds: 60, WindAvg: 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// windygo was down from 12:10 to 12:30 but the console archived every 10 minutes
+	var ars []*vantage.ArchiveRecord
+	for i := 1; i <= 3; i++ {
+		recorded := start.Add(time.Duration(i) * 10 * time.Minute)
+		ars = append(ars, &vantage.ArchiveRecord{ArchiveTime: recorded, HostTime: recorded,
+			WindAvg: 5 * i, WindMax: 8 * i, WindDir: 270, Rainfall: 10, OutsideTemp: 65, HighOutsideTemp: 66,
+			LowOutsideTemp: 64, OutsideHumidity: 50, Barometer: 30})
+	}
+	if err = store.SaveArchiveRecords(ars); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SaveArchiveRecords(ars[1:]); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.GetArchiveRecords(start, start.Add(time.Hour))
+	if err != nil || len(saved) != 3 || !saved[1].HostTime.Equal(ars[1].HostTime) || saved[2].WindMax != 24 {
+		t.Fatalf("unexpected archive records %+v %v", saved, err)
+	}
+
+	filled, err := FillGaps(store, []time.Duration{time.Minute, 24 * time.Hour}, start, start.Add(30*time.Minute), 0, time.UTC)
+	if err != nil || filled != 20 {
+		t.Fatalf("expected 20 filled got %v %v", filled, err)
+	}
+	ss, err := store.GetSummaries(start, 30*time.Minute, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loop, archived := ss[9], ss[10]
+	if loop.Source != "loop" || loop.WindAvg != 10 {
+		t.Fatalf("loop summary changed %+v", loop)
+	}
+	if archived.Source != "archive" || !archived.StartTime.Equal(start.Add(10*time.Minute)) ||
+		archived.WindAvg != 10 || archived.WindGust != 16 || archived.WindDirectionAvg != 270 ||
+		math.Abs(archived.RainTotal-0.01) > 0.0001 || !archived.Partial || archived.Quality != rollup.QualitySuspect {
+		t.Fatalf("unexpected archive summary %+v", archived)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	store := NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 30; i++ {
+		if i >= 10 && i < 20 {
+			continue
+		}
+		// alternate between light from 80 and strong from 100 degrees
+		wind, direction, measurements := 5.0, int64(80), int64(10)
+		if i%2 == 1 {
+			wind, direction, measurements = 15, 100, 30
+		}
+		err := store.SaveSummary(&Summary{StartTime: start.Add(time.Duration(i) * time.Minute),
+			EndTime: start.Add(time.Duration(i+1) * time.Minute), SummarySeconds: 60, Measurements: measurements,
+			ExpectedMeasurements: 30, WindAvg: wind, WindGust: wind + float64(i), WindLull: wind - 1,
+			WindDirectionAvg: direction, WindDirectionMin: direction, WindDirectionMax: direction})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := Query(store, start.Add(time.Minute), start.Add(35*time.Minute), 10*time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 4 || !buckets[0].Start.Equal(start) || !buckets[3].End.Equal(start.Add(40*time.Minute)) {
+		t.Fatalf("unexpected buckets %+v", buckets)
+	}
+	if buckets[1].Summary != nil || buckets[3].Summary != nil {
+		t.Fatalf("expected empty buckets for the gaps %+v", buckets)
+	}
+	// the light minutes are missing samples so the bucket is partial
+	s := buckets[2].Summary
+	if s == nil || s.SummarySeconds != 600 || s.Measurements != 200 || s.WindAvg != 12.5 || s.WindGust != 44 ||
+		s.WindLull != 4 || s.WindDirectionAvg < 94 || s.WindDirectionAvg > 96 || !s.Partial {
+		t.Fatalf("unexpected merged summary %+v", s)
+	}
+	if ss := Summaries(buckets); len(ss) != 4 || ss[0] == nil || ss[1] != nil {
+		t.Fatalf("unexpected summaries %+v", ss)
+	}
+
+	if _, err = Query(store, start, start.Add(time.Hour), 90*time.Second, ""); err == nil {
+		t.Fatal("expected an error for a bucket no interval divides")
+	}
+}
+
+func TestQueryFallsBack(t *testing.T) {
+	store := NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	save := func(at time.Time, interval time.Duration, wind float64) {
+		err := store.SaveSummary(&Summary{StartTime: at, EndTime: at.Add(interval), SummarySeconds: int64(interval / time.Second),
+			Measurements: 30, ExpectedMeasurements: 30, WindAvg: wind, WindGust: wind, WindLull: wind})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// minutes for the closed hour and the one still going, which has no
+	// hourly summary yet
+	for i := 0; i < 65; i++ {
+		save(start.Add(time.Duration(i)*time.Minute), time.Minute, 5)
+	}
+	save(start, time.Hour, 10)
+
+	buckets, err := Query(store, start, start.Add(2*time.Hour), time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 2 || buckets[0].Summary == nil || buckets[0].Summary.WindAvg != 10 {
+		t.Fatalf("expected the hourly summary for the first hour %+v", buckets)
+	}
+	if s := buckets[1].Summary; s == nil || s.WindAvg != 5 || s.Measurements != 150 {
+		t.Fatalf("expected the second hour made from its minutes got %+v", s)
+	}
+}
+
+func testLoopRecords(t *testing.T, store Store, batcher *LoopBatcher) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		store.Record(loopPacket(start.Add(time.Duration(i)*2*time.Second), 10+i, 270))
+	}
+	if lrs, err := store.GetLoopRecords(start, start.Add(time.Minute)); err != nil || len(lrs) != 0 {
+		t.Fatalf("loop records saved before the batch %v %v", len(lrs), err)
+	}
+	if err := batcher.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lrs, err := store.GetLoopRecords(start.Add(2*time.Second), start.Add(8*time.Second))
+	if err != nil || len(lrs) != 3 {
+		t.Fatalf("expected 3 loop records got %v %v", len(lrs), err)
+	}
+	if !lrs[0].Recorded.Equal(start.Add(2*time.Second)) || lrs[0].Wind != 11 || lrs[0].WindDirection != 270 ||
+		lrs[0].OutsideTempRaw != 650 || lrs[0].OutsideHumidity != 50 {
+		t.Fatalf("unexpected loop record %+v", lrs[0])
+	}
+	for _, dryRun := range []bool{true, false} {
+		if deleted, err := store.DeleteLoopRecords(start.Add(4*time.Second), dryRun); err != nil || deleted != 2 {
+			t.Fatalf("expected 2 deleted got %v %v", deleted, err)
+		}
+	}
+
+	// closing saves the last batch
+	store.Record(loopPacket(start.Add(10*time.Second), 20, 270))
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryLoopRecords(t *testing.T) {
+	store := NewMemory()
+	store.LoopRecords = NewLoopBatcher(store, time.Hour)
+	testLoopRecords(t, store, store.LoopRecords)
+	if lrs, err := store.GetLoopRecords(time.Time{}, time.Now()); err != nil || len(lrs) != 4 || lrs[3].Wind != 20 {
+		t.Fatalf("expected the last batch saved on close got %v %v", len(lrs), err)
+	}
+}
+
+func TestSQLiteLoopRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "windygo.db")
+	store, err := NewSQLite(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.LoopRecords = NewLoopBatcher(store, time.Hour)
+	testLoopRecords(t, store, store.LoopRecords)
+
+	store, err = NewSQLite(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if lrs, err := store.GetLoopRecords(time.Time{}, time.Now()); err != nil || len(lrs) != 4 || lrs[3].Wind != 20 {
+		t.Fatalf("expected the last batch saved on close got %v %v", len(lrs), err)
+	}
+}
+
+func testFlags(t *testing.T, store Store) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		err := store.SaveSummary(&Summary{StartTime: start.Add(time.Duration(i) * time.Minute),
+			EndTime: start.Add(time.Duration(i+1) * time.Minute), SummarySeconds: 60, Measurements: 30,
+			ExpectedMeasurements: 30, WindAvg: 10, WindGust: 12, WindLull: 8})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	bird := &Flag{Start: start.Add(2 * time.Minute), End: start.Add(4 * time.Minute), Quality: rollup.QualityInvalid,
+		Reason: "bird on the anemometer", SetBy: "steve", SetAt: start.Add(time.Hour)}
+	gusty := &Flag{Start: start.Add(3 * time.Minute), End: start.Add(6 * time.Minute), Quality: rollup.QualitySuspect,
+		Reason: "odd gusts", SetBy: "steve", SetAt: start.Add(time.Hour)}
+	for _, f := range []*Flag{bird, gusty} {
+		if err := store.SaveFlag(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bird.ID == 0 || gusty.ID == bird.ID {
+		t.Fatalf("expected flag ids got %v %v", bird.ID, gusty.ID)
+	}
+	flags, err := store.GetFlags(start.Add(5*time.Minute), start.Add(time.Hour))
+	if err != nil || len(flags) != 1 || flags[0].ID != gusty.ID || flags[0].Reason != "odd gusts" ||
+		!flags[0].Start.Equal(gusty.Start) || !flags[0].SetAt.Equal(gusty.SetAt) {
+		t.Fatalf("expected the gusty flag got %+v %v", flags, err)
+	}
+
+	ss, err := store.GetSummaryRange(start, start.Add(10*time.Minute), 60)
+	if err != nil || len(ss) != 10 {
+		t.Fatalf("expected 10 summaries got %v %v", len(ss), err)
+	}
+	// the worst flag wins where they overlap
+	for i, quality := range []string{"valid", "valid", "invalid", "invalid", "suspect", "suspect", "valid"} {
+		if ss[i].Quality != quality {
+			t.Fatalf("expected summary %v %v got %v", i, quality, ss[i].Quality)
+		}
+	}
+	if ss[3].QualityReason != "bird on the anemometer" || ss[3].Valid() || !ss[4].Valid() {
+		t.Fatalf("unexpected flagged summary %+v", ss[3])
+	}
+
+	buckets, err := Query(store, start, start.Add(10*time.Minute), time.Minute, rollup.QualityValid)
+	if err != nil || len(buckets) != 10 {
+		t.Fatalf("expected 10 buckets got %v %v", len(buckets), err)
+	}
+	for i, b := range buckets {
+		if flagged := i >= 2 && i < 6; flagged != (b.Summary == nil) {
+			t.Fatalf("unexpected bucket %v %+v", i, b.Summary)
+		}
+	}
+	buckets, err = Query(store, start, start.Add(10*time.Minute), 5*time.Minute, "")
+	if err != nil || len(buckets) != 2 {
+		t.Fatalf("expected 2 buckets got %v %v", len(buckets), err)
+	}
+	if s := buckets[0].Summary; s == nil || s.Measurements != 90 || s.Quality != rollup.QualitySuspect {
+		t.Fatalf("expected the invalid minutes left out got %+v", s)
+	}
+
+	if err = store.DeleteFlag(bird.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.DeleteFlag(bird.ID); err == nil {
+		t.Fatal("expected an error deleting a missing flag")
+	}
+	if ss, err = store.GetSummaryRange(start, start.Add(10*time.Minute), 60); err != nil || ss[2].Quality != rollup.QualityValid {
+		t.Fatalf("expected the bird flag gone %+v %v", ss[2], err)
+	}
+}
+
+func TestMemoryFlags(t *testing.T) {
+	testFlags(t, NewMemory())
+}
+
+func TestSQLiteFlags(t *testing.T) {
+	store, err := NewSQLite(filepath.Join(t.TempDir(), "windygo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testFlags(t, store)
+}
+
+func TestFlaggedLoopRecords(t *testing.T) {
+	store := NewMemory()
+	store.LoopRecords = NewLoopBatcher(store, time.Hour)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		store.Record(loopPacket(start.Add(time.Duration(i)*2*time.Second), 10, 270))
+	}
+	if err := store.LoopRecords.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	err := store.SaveFlag(&Flag{Start: start.Add(2 * time.Second), End: start.Add(6 * time.Second),
+		Quality: rollup.QualityInvalid, SetBy: "steve"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lrs, err := store.GetLoopRecords(start, start.Add(time.Minute))
+	if err != nil || len(lrs) != 3 || !lrs[1].Recorded.Equal(start.Add(6*time.Second)) {
+		t.Fatalf("expected the flagged loop records dropped got %v %v", len(lrs), err)
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+type LoopRecord struct {
+	ID uint `gorm:"primary_key"`
+	vantage.LoopRecord
+}
+
+// Summary is the rollup summary, aliased since everything that reads
+// summaries gets them from a store
+type Summary = rollup.Summary
+
+var insertCols []string = []string{
+	"start_time", "end_time", "measurements", "summary_seconds", "wind_avg",
+	"wind_gust", "wind_lull", "wind_stddev", "wind_direction_avg",
+	"wind_direction_min", "wind_direction_max", "barometer_avg",
+	"barometer_start", "outside_temp_avg", "outside_humidity_avg",
+	"bar_trend_byte", "rain_total", "rain_rate_max", "outside_temp_min",
+	"outside_temp_max", "outside_humidity_min", "outside_humidity_max",
+	"barometer_end", "barometer_change", "inside_temp_avg",
+	"inside_humidity_avg", "dew_point_avg", "wind_direction_range",
+	"wind_direction_stddev", "wind_vector_speed", "wind_vector_direction",
+	"histogram", "expected_measurements", "partial", "station", "source",
+}
+
+// keyCols identify a summary. Postgres adds end_time because a hypertable's
+// unique indexes have to include the time column; it's fixed by start_time
+// and summary_seconds so the key is the same.
+var keyCols = map[string][]string{
+	MysqlDialect:    {"station", "start_time", "summary_seconds"},
+	SQLiteDialect:   {"station", "start_time", "summary_seconds"},
+	PostgresDialect: {"station", "start_time", "summary_seconds", "end_time"},
+}
+
+// upsertStatement inserts a summary or replaces the one with the same key,
+// so writing a summary again (a replay or a rebuild) doesn't duplicate it
+func upsertStatement(dialect string) string {
+	return upsertSql(dialect, "summaries", insertCols, keyCols[dialect])
+}
+
+// upsertSql builds an insert into table that updates the row instead when
+// one with the same keys exists
+func upsertSql(dialect, table string, cols, keys []string) string {
+	placeholders := make([]string, len(cols))
+	for i := range placeholders {
+		if dialect == PostgresDialect {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			placeholders[i] = "?"
+		}
+	}
+	insert := fmt.Sprintf("insert into %v (%v) VALUES (%v)", table, strings.Join(cols, ","), strings.Join(placeholders, ","))
+
+	isKey := make(map[string]bool)
+	for _, col := range keys {
+		isKey[col] = true
+	}
+	var updates []string
+	for _, col := range cols {
+		// mysql still sets the key columns; the first timestamp column may be
+		// ON UPDATE CURRENT_TIMESTAMP on old servers and would change otherwise
+		if isKey[col] && dialect != MysqlDialect {
+			continue
+		}
+		if dialect == MysqlDialect {
+			updates = append(updates, fmt.Sprintf("%v=VALUES(%v)", col, col))
+		} else {
+			updates = append(updates, fmt.Sprintf("%v=excluded.%v", col, col))
+		}
+	}
+	if dialect == MysqlDialect {
+		return insert + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ",")
+	}
+	return fmt.Sprintf("%v ON CONFLICT (%v) DO UPDATE SET %v", insert, strings.Join(keys, ","), strings.Join(updates, ","))
+}
+
+// insertValues are the values for insertCols, in the same order
+func insertValues(s *Summary) []interface{} {
+	return []interface{}{
+		s.StartTime.UTC(),
+		s.EndTime.UTC(),
+		s.Measurements,
+		s.SummarySeconds,
+		s.WindAvg,
+		s.WindGust,
+		s.WindLull,
+		s.WindStddev,
+		s.WindDirectionAvg,
+		s.WindDirectionMin,
+		s.WindDirectionMax,
+		s.BarometerAvg,
+		s.BarometerStart,
+		s.OutsideTempAvg,
+		s.OutsideHumidityAvg,
+		s.BarTrendByte,
+		s.RainTotal,
+		s.RainRateMax,
+		s.OutsideTempMin,
+		s.OutsideTempMax,
+		s.OutsideHumidityMin,
+		s.OutsideHumidityMax,
+		s.BarometerEnd,
+		s.BarometerChange,
+		s.InsideTempAvg,
+		s.InsideHumidityAvg,
+		s.DewPointAvg,
+		s.WindDirectionRange,
+		s.WindDirectionStddev,
+		s.WindVectorSpeed,
+		s.WindVectorDirection,
+		s.Histogram,
+		s.ExpectedMeasurements,
+		s.Partial,
+		s.Station,
+		s.Source,
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/smw1218/windygo/db"
+)
+
+// dedup runs "windygo dedup [count]". It deletes summaries that were saved
+// more than once, keeping the last one saved; count only reports them.
+func dedup(cfg storeConfig, args []string) error {
+	dataSource, err := cfg.dataSource()
+	if err != nil {
+		return err
+	}
+	migrator, err := db.OpenMigrator(cfg.kind, dataSource)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	case "":
+		deleted, err := migrator.Dedup()
+		if err != nil {
+			return err
+		}
+		log.Printf("Deleted %v duplicate summaries", deleted)
+	case "count":
+		count, err := migrator.Duplicates()
+		if err != nil {
+			return err
+		}
+		log.Printf("%v duplicate summaries", count)
+	default:
+		return fmt.Errorf("unknown dedup command %q, use count or nothing", command)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/smw1218/windygo/export"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// exportCmd runs "windygo export [-intervals 1m,5m] <file>". It writes the
+// store's summaries, archive records and quality flags to file, gzipped if
+// it ends in .gz, or to stdout for -.
+func exportCmd(cfg storeConfig, intervalsFlag string, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.StringVar(&intervalsFlag, "intervals", intervalsFlag+",1h,24h", "summary intervals to export")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: windygo export [-intervals 1m,5m,10m,1h,24h] <file>")
+	}
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg, vantage.NewClock(cfg.location), rollup.NewEngine(intervals), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	name := flags.Arg(0)
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if name != "-" {
+		f, err = os.Create(name)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	var gz *gzip.Writer
+	if strings.HasSuffix(name, ".gz") {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	counts, err := export.Write(w, store, export.NewManifest(cfg.station, cfg.location, intervals))
+	// closing flushes the end of the export, so it isn't done until they're
+	// closed
+	if gz != nil {
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if f != nil {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error writing %v: %w", name, err)
+	}
+	log.Printf("Exported %v summaries, %v archive records and %v flags", counts[export.TypeSummary],
+		counts[export.TypeArchiveRecord], counts[export.TypeFlag])
+	return nil
+}
+
+// importCmd runs "windygo import [-restart] <file>". It saves an export into
+// the store, keeping how far it got in <file>.progress so an import that
+// stops part way resumes where it left off when it's run again.
+func importCmd(cfg storeConfig, intervalsFlag string, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	restart := flags.Bool("restart", false, "import from the start even if an earlier import stopped part way")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: windygo import [-restart] <file>")
+	}
+	name := flags.Arg(0)
+	progressFile := name + ".progress"
+	var skip int64
+	if data, err := ioutil.ReadFile(progressFile); err == nil && !*restart {
+		skip, err = strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad progress in %v: %w", progressFile, err)
+		}
+		log.Printf("Resuming after %v entries", skip)
+	}
+
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+	store, err := openStore(cfg, vantage.NewClock(cfg.location), rollup.NewEngine(intervals), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	var r io.Reader = f
+	var gz *gzip.Reader
+	if strings.HasSuffix(name, ".gz") {
+		gz, err = gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r = gz
+	}
+	importer := &export.Importer{
+		Store:         store,
+		Skip:          skip,
+		ProgressEvery: 1000,
+		Progress: func(done int64) error {
+			return ioutil.WriteFile(progressFile, []byte(strconv.FormatInt(done, 10)), 0644)
+		},
+	}
+	m, counts, err := importer.Import(r)
+	if gz != nil {
+		if closeErr := gz.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if m != nil && m.Station != cfg.station {
+		log.Printf("Imported station %q's data as %q", m.Station, cfg.station)
+	}
+	if m != nil && m.TimeZone != cfg.location.String() {
+		log.Printf("The export is from time zone %v, not %v; rebuild its daily summaries and climate", m.TimeZone, cfg.location)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %v summaries, %v archive records and %v flags", counts[export.TypeSummary],
+		counts[export.TypeArchiveRecord], counts[export.TypeFlag])
+	err = os.Remove(progressFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
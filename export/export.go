@@ -0,0 +1,319 @@
+// Package export writes a store's data to a portable file and reads it back
+// into any store, to move windygo between machines or databases.
+//
+// The file is newline delimited JSON. The first line is a Manifest that says
+// what the file is, where it came from and the fields of each type of line.
+// Each line after it is an Entry holding one summary, archive record or
+// quality flag, and the last line is an Entry of TypeEnd with the counts, so
+// a cut off file can be told apart from a finished one.
+package export
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Format and Version identify the file in its manifest
+const (
+	Format  = "windygo-export"
+	Version = 1
+)
+
+// The types of entries
+const (
+	TypeSummary       = "summary"
+	TypeArchiveRecord = "archive_record"
+	TypeFlag          = "flag"
+	TypeEnd           = "end"
+)
+
+// Manifest is the first line of an export
+type Manifest struct {
+	Format   string
+	Version  int
+	Exported time.Time
+	// Station and TimeZone are the config of the windygo that exported it
+	Station  string
+	TimeZone string
+	// Intervals are the summary intervals in the file, in seconds
+	Intervals []int64
+	// Fields lists the fields of each type of entry
+	Fields map[string][]string
+}
+
+// Entry is one line after the manifest. Data is the JSON of a db.Summary,
+// vantage.ArchiveRecord or db.Flag, or of the Counts for TypeEnd.
+type Entry struct {
+	Type string
+	Data json.RawMessage
+}
+
+// Counts is how many of each type of entry an export has
+type Counts map[string]int64
+
+// NewManifest describes an export of station's summaries of intervals
+func NewManifest(station string, loc *time.Location, intervals []time.Duration) *Manifest {
+	m := &Manifest{
+		Format:   Format,
+		Version:  Version,
+		Exported: time.Now().UTC(),
+		Station:  station,
+		TimeZone: loc.String(),
+		Fields: map[string][]string{
+			TypeSummary:       fields(&db.Summary{}),
+			TypeArchiveRecord: fields(&vantage.ArchiveRecord{}),
+			TypeFlag:          fields(&db.Flag{}),
+		},
+	}
+	for _, interval := range intervals {
+		m.Intervals = append(m.Intervals, int64(interval/time.Second))
+	}
+	return m
+}
+
+// fields is the JSON field names of v
+func fields(v interface{}) []string {
+	data, _ := json.Marshal(v)
+	var byName map[string]json.RawMessage
+	json.Unmarshal(data, &byName)
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportChunk is how much of an interval's summaries is read at a time
+const exportChunk = 30 * 24 * time.Hour
+
+// Write writes the manifest then the store's summaries of the manifest's
+// intervals, its archive records and its flags to w. Summaries are read a
+// month at a time so the whole store never has to fit in memory.
+func Write(w io.Writer, store db.Store, m *Manifest) (Counts, error) {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	err := enc.Encode(m)
+	if err != nil {
+		return nil, fmt.Errorf("error writing manifest: %w", err)
+	}
+	counts := Counts{}
+	write := func(typ string, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("error encoding %v: %w", typ, err)
+		}
+		err = enc.Encode(&Entry{Type: typ, Data: data})
+		if err != nil {
+			return fmt.Errorf("error writing %v: %w", typ, err)
+		}
+		counts[typ]++
+		return nil
+	}
+
+	for _, seconds := range m.Intervals {
+		first, last, err := store.SummaryTimes(int(seconds))
+		if err != nil {
+			return nil, err
+		}
+		if first.IsZero() {
+			continue
+		}
+		for start := first; !start.After(last); start = start.Add(exportChunk) {
+			ss, err := store.GetSummaryRange(start, start.Add(exportChunk), int(seconds))
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range ss {
+				// quality comes from the flags, which are exported on their own
+				s.Quality, s.QualityReason = "", ""
+				if err = write(TypeSummary, s); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	forever := time.Now().AddDate(100, 0, 0)
+	ars, err := store.GetArchiveRecords(time.Time{}, forever)
+	if err != nil {
+		return nil, err
+	}
+	for _, ar := range ars {
+		if err = write(TypeArchiveRecord, ar); err != nil {
+			return nil, err
+		}
+	}
+	flags, err := store.GetFlags(time.Time{}, forever)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range flags {
+		if err = write(TypeFlag, f); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.Marshal(counts)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Encode(&Entry{Type: TypeEnd, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("error writing end: %w", err)
+	}
+	return counts, bw.Flush()
+}
+
+// Importer reads an export into Store. Everything is saved as Store's
+// station. Summaries and archive records replace any already saved and
+// flags already saved are skipped, so an import can be run again.
+type Importer struct {
+	Store db.Store
+	// Skip is how many entries were imported by an earlier run; they
+	// aren't saved again
+	Skip int64
+	// Progress is called with the count of entries imported every
+	// ProgressEvery entries and at the end, to save where to resume from
+	Progress      func(done int64) error
+	ProgressEvery int64
+}
+
+// archiveBatch is how many archive records are saved at once
+const archiveBatch = 500
+
+// Import reads the manifest and entries from r and saves them. It returns
+// the manifest and the counts of what was read, and an error if the file
+// ends before its TypeEnd entry or the counts don't match it.
+func (im *Importer) Import(r io.Reader) (*Manifest, Counts, error) {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	m := &Manifest{}
+	err := dec.Decode(m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	if m.Format != Format {
+		return nil, nil, fmt.Errorf("not a windygo export: format %q", m.Format)
+	}
+	if m.Version > Version {
+		return nil, nil, fmt.Errorf("export version %v is newer than %v, upgrade windygo", m.Version, Version)
+	}
+
+	flags, err := im.Store.GetFlags(time.Time{}, time.Now().AddDate(100, 0, 0))
+	if err != nil {
+		return nil, nil, err
+	}
+	counts := Counts{}
+	var done int64
+	var ars []*vantage.ArchiveRecord
+	// saved writes the pending archive records and records the progress
+	saved := func() error {
+		if len(ars) > 0 {
+			if err := im.Store.SaveArchiveRecords(ars); err != nil {
+				return err
+			}
+			ars = ars[:0]
+		}
+		if im.Progress != nil && done > im.Skip {
+			return im.Progress(done)
+		}
+		return nil
+	}
+	var e *Entry
+	for {
+		e = &Entry{}
+		err = dec.Decode(e)
+		if err != nil {
+			// keep what was read so a fixed or finished file resumes here
+			if saveErr := saved(); saveErr != nil {
+				return m, counts, saveErr
+			}
+		}
+		if err == io.EOF {
+			return m, counts, fmt.Errorf("export ends after %v entries without its end, it may be cut off", done)
+		}
+		if err != nil {
+			return m, counts, fmt.Errorf("error reading entry %v: %w", done+1, err)
+		}
+		if e.Type == TypeEnd {
+			break
+		}
+		counts[e.Type]++
+		done++
+		if done <= im.Skip {
+			continue
+		}
+		switch e.Type {
+		case TypeSummary:
+			s := &db.Summary{}
+			if err = json.Unmarshal(e.Data, s); err != nil {
+				return m, counts, fmt.Errorf("bad summary in entry %v: %w", done, err)
+			}
+			s.ID, s.Station = 0, ""
+			err = im.Store.SaveSummary(s)
+		case TypeArchiveRecord:
+			ar := &vantage.ArchiveRecord{}
+			if err = json.Unmarshal(e.Data, ar); err != nil {
+				return m, counts, fmt.Errorf("bad archive record in entry %v: %w", done, err)
+			}
+			ars = append(ars, ar)
+			if len(ars) >= archiveBatch {
+				err = saved()
+			}
+		case TypeFlag:
+			f := &db.Flag{}
+			if err = json.Unmarshal(e.Data, f); err != nil {
+				return m, counts, fmt.Errorf("bad flag in entry %v: %w", done, err)
+			}
+			if !hasFlag(flags, f) {
+				f.ID = 0
+				err = im.Store.SaveFlag(f)
+				flags = append(flags, f)
+			}
+		default:
+			// from a newer version; the manifest says what it is
+			continue
+		}
+		if err != nil {
+			return m, counts, fmt.Errorf("error saving entry %v: %w", done, err)
+		}
+		if im.ProgressEvery > 0 && done%im.ProgressEvery == 0 {
+			if err = saved(); err != nil {
+				return m, counts, err
+			}
+		}
+	}
+	if err = saved(); err != nil {
+		return m, counts, err
+	}
+
+	var want Counts
+	err = json.Unmarshal(e.Data, &want)
+	if err != nil {
+		return m, counts, fmt.Errorf("bad end of export: %w", err)
+	}
+	for typ, n := range want {
+		if counts[typ] != n {
+			return m, counts, fmt.Errorf("export has %v %v entries, its end says %v", counts[typ], typ, n)
+		}
+	}
+	return m, counts, nil
+}
+
+// hasFlag reports whether flags has one the same as f, apart from the ID
+func hasFlag(flags []*db.Flag, f *db.Flag) bool {
+	for _, saved := range flags {
+		if saved.Start.Equal(f.Start) && saved.End.Equal(f.End) && saved.Quality == f.Quality &&
+			saved.Reason == f.Reason && saved.SetBy == f.SetBy {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package export
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+func TestExportImport(t *testing.T) {
+	from := db.NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// more than a chunk apart to read the range in pieces
+	for i := 0; i < 10; i++ {
+		at := start.Add(time.Duration(i) * 10 * 24 * time.Hour)
+		for _, seconds := range []int64{60, 300} {
+			err := from.SaveSummary(&db.Summary{StartTime: at, EndTime: at.Add(time.Duration(seconds) * time.Second),
+				SummarySeconds: seconds, Measurements: 30, WindAvg: float64(i), WindDirectionAvg: 270,
+				Extra: map[string]float64{"gust_count": 2}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	err := from.SaveArchiveRecords([]*vantage.ArchiveRecord{
+		{ArchiveTime: start, HostTime: start, WindAvg: 12, OutsideHumidity: 70},
+		{ArchiveTime: start.Add(30 * time.Minute), HostTime: start.Add(30 * time.Minute), WindAvg: 14},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = from.SaveFlag(&db.Flag{Start: start, End: start.Add(time.Hour), Quality: rollup.QualityInvalid,
+		Reason: "bird", SetBy: "steve", SetAt: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	counts, err := Write(&buf, from, NewManifest("alameda", time.UTC, []time.Duration{time.Minute, 5 * time.Minute, time.Hour}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts[TypeSummary] != 20 || counts[TypeArchiveRecord] != 2 || counts[TypeFlag] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	exported := buf.String()
+
+	// an export that was cut off fails but keeps its progress
+	lines := strings.SplitAfter(exported, "\n")
+	to, err := db.NewSQLite(filepath.Join(t.TempDir(), "windygo.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer to.Close()
+	to.Station = "alameda"
+	var progress int64
+	importer := &Importer{Store: to, ProgressEvery: 4, Progress: func(done int64) error {
+		progress = done
+		return nil
+	}}
+	if _, _, err = importer.Import(strings.NewReader(strings.Join(lines[:11], ""))); err == nil {
+		t.Fatal("expected an error for a cut off export")
+	}
+	if progress != 10 {
+		t.Fatalf("expected progress after 10 entries got %v", progress)
+	}
+
+	importer.Skip = progress
+	m, counts, err := importer.Import(strings.NewReader(exported))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Station != "alameda" || m.TimeZone != "UTC" || len(m.Fields[TypeSummary]) == 0 || progress != 23 {
+		t.Fatalf("unexpected manifest %+v progress %v", m, progress)
+	}
+	if counts[TypeSummary] != 20 {
+		t.Fatalf("unexpected counts %v", counts)
+	}
+	ss, err := to.GetSummaryRange(start, start.Add(100*24*time.Hour), 60)
+	if err != nil || len(ss) != 10 {
+		t.Fatalf("expected 10 summaries got %v %v", len(ss), err)
+	}
+	if ss[9].WindAvg != 9 || ss[9].Station != "alameda" || ss[0].Quality != rollup.QualityInvalid || ss[1].Quality != rollup.QualityValid {
+		t.Fatalf("unexpected summaries %+v %+v", ss[0], ss[9])
+	}
+	ars, err := to.GetArchiveRecords(start, start.Add(time.Hour))
+	if err != nil || len(ars) != 2 || ars[0].WindAvg != 12 || ars[0].OutsideHumidity != 70 {
+		t.Fatalf("unexpected archive records %+v %v", ars, err)
+	}
+
+	// importing again replaces rather than duplicates
+	importer.Skip = 0
+	if _, _, err = importer.Import(strings.NewReader(exported)); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := to.GetFlags(start, start.Add(time.Hour))
+	if err != nil || len(flags) != 1 || flags[0].Reason != "bird" {
+		t.Fatalf("expected one flag got %+v %v", flags, err)
+	}
+	if ss, err = to.GetSummaryRange(start, start.Add(100*24*time.Hour), 300); err != nil || len(ss) != 10 {
+		t.Fatalf("expected 10 summaries got %v %v", len(ss), err)
+	}
+
+	if _, _, err = importer.Import(strings.NewReader(`{"Format": "something"}`)); err == nil {
+		t.Fatal("expected an error for a file that isn't an export")
+	}
+}
@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/go-sql-driver/mysql v1.4.1
 	github.com/jinzhu/gorm v1.9.2
+	github.com/jinzhu/inflection v0.0.0-20180308033659-04140366298a // indirect
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
 )
-
-require github.com/jinzhu/inflection v0.0.0-20180308033659-04140366298a // indirect
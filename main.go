@@ -2,6 +2,8 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -9,12 +11,19 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/smw1218/windygo/api"
+	"github.com/smw1218/windygo/cache"
+	"github.com/smw1218/windygo/climate"
 	"github.com/smw1218/windygo/db"
 	"github.com/smw1218/windygo/plot"
 	"github.com/smw1218/windygo/raw"
+	"github.com/smw1218/windygo/retention"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/spool"
 	"github.com/smw1218/windygo/vantage"
 )
 
@@ -23,17 +32,115 @@ func main() {
 	var rawDir string
 	var doDmp bool
 	var loopPktFile string
+	var storeCfg storeConfig
+	var intervalsFlag string
+	var stateFile string
+	var spoolFile string
+	var spoolMaxMB int64
+	var retentionFlag string
+	var retentionEvery time.Duration
+	var cacheReload time.Duration
+	var tz string
+	var adminToken string
+	var replayCfg replayConfig
+	var rawCompress bool
+	var rawKeep string
+	var rawMaxMB int64
 	flag.StringVar(&host, "h", "", "host:port of the Vantage device")
 	flag.StringVar(&rawDir, "raw", "", "directory to store raw data")
+	flag.BoolVar(&rawCompress, "raw-compress", true, "gzip the -raw files of the hours that are over")
+	flag.StringVar(&rawKeep, "raw-keep", "", "how long to keep -raw files, like 365d; empty keeps them forever")
+	flag.Int64Var(&rawMaxMB, "raw-max", 0, "maximum size of the -raw files in MB, deleting the oldest hours first; 0 is no limit")
 	flag.BoolVar(&doDmp, "dmp", false, "run archive dump and exit")
 	flag.StringVar(&loopPktFile, "f", "", "file to read loop packets from, - for stdin")
+	flag.StringVar(&storeCfg.kind, "store", "mysql", "where to store summaries: mysql, sqlite, postgres or memory")
+	flag.StringVar(&storeCfg.sqliteFile, "sqlite", "windygo.db", "database file for the sqlite store")
+	flag.StringVar(&tz, "tz", "", "station time zone like America/Los_Angeles for days, raw file names and display; defaults to the host's")
+	flag.StringVar(&storeCfg.station, "station", "", "name saved with the summaries to tell stations sharing a database apart")
+	flag.DurationVar(&storeCfg.loopRecords, "loop-records", 0, "how often to save batches of loop records to the database, 0 doesn't keep them")
+	flag.StringVar(&storeCfg.postgresConn, "postgres", "dbname=windygo sslmode=disable", "connection string for the postgres store")
+	flag.StringVar(&intervalsFlag, "intervals", "1m,5m,10m", "summary intervals; the plots need 1m and 5m")
+	flag.StringVar(&stateFile, "state", "windygo.state", "file to keep in-progress summaries in across restarts")
+	flag.StringVar(&spoolFile, "spool", "windygo.spool", "file to keep summaries in while the database is down, empty to disable")
+	flag.Int64Var(&spoolMaxMB, "spool-max", 64, "maximum size of the spool in MB")
+	flag.StringVar(&retentionFlag, "retention", "", "how long to keep each summary interval, like "+retention.DefaultPolicy+"; empty keeps everything")
+	flag.StringVar(&replayCfg.from, "replay", "", "replay the -raw recordings from this time (2006-01-02T15:04 station time) in place of the console")
+	flag.StringVar(&replayCfg.to, "replay-to", "", "end of the replay, defaults to a day after -replay")
+	flag.Float64Var(&replayCfg.speed, "replay-speed", 1, "how many times faster than recorded to replay, 0 for as fast as possible")
+	flag.BoolVar(&replayCfg.shift, "replay-shift", false, "move the replayed packets' timestamps so the replay starts now")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token for the /flags admin API, empty disables it")
+	flag.DurationVar(&retentionEvery, "retention-every", time.Hour, "how often to apply -retention")
+	flag.DurationVar(&cacheReload, "cache-reload", 5*time.Minute, "how often to read the recent summaries again for changes made by other windygo commands, 0 to never")
 	flag.Parse()
 
+	var err error
+	storeCfg.location, err = loadLocation(tz)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	switch flag.Arg(0) {
+	case "migrate":
+		err := migrate(storeCfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error migrating: %v", err)
+		}
+		return
+	case "rebuild":
+		err := rebuild(storeCfg, rawDir, intervalsFlag, retentionFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error rebuilding summaries: %v", err)
+		}
+		return
+	case "archive":
+		err := archive(storeCfg, host, intervalsFlag, retentionFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error filling from the archive: %v", err)
+		}
+		return
+	case "prune":
+		err := prune(storeCfg, retentionFlag, intervalsFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error pruning: %v", err)
+		}
+		return
+	case "climate":
+		err := climateCmd(storeCfg, intervalsFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error rebuilding climate: %v", err)
+		}
+		return
+	case "export":
+		err := exportCmd(storeCfg, intervalsFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error exporting: %v", err)
+		}
+		return
+	case "import":
+		err := importCmd(storeCfg, intervalsFlag, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error importing: %v", err)
+		}
+		return
+	case "convert":
+		err := convertRaw(storeCfg, rawDir, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error converting raw recordings: %v", err)
+		}
+		return
+	case "dedup":
+		err := dedup(storeCfg, flag.Args()[1:])
+		if err != nil {
+			log.Fatalf("Error removing duplicates: %v", err)
+		}
+		return
+	}
+
 	// On my unit, dmp didn't work (it was missing random bytes)
 	// The DMPAFT worked but the data was all screwed up with dates jumping around
 	// also some of the dates are in the future (multiple days)
 	if doDmp {
-		dmp(host)
+		dmp(host, storeCfg.location)
 		return
 	}
 
@@ -48,60 +155,277 @@ func main() {
 	notifyChan := make(chan os.Signal, 1)
 	signal.Notify(notifyChan, os.Interrupt, syscall.SIGTERM)
 
-	db, err := db.NewMysql("windygo", "")
+	clock := vantage.NewClock(storeCfg.location)
+
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
 	if err != nil {
 		log.Fatalln(err)
 	}
-	//db.ORM.LogMode(true)
 
-	gp, err := plot.NewGnuPlot(db)
+	var summarySpool *spool.Spool
+	if spoolFile != "" {
+		summarySpool, err = spool.Open(spoolFile, spoolMaxMB*1024*1024)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	engine := rollup.NewEngine(intervals)
+	engine.Location = storeCfg.location
+	// the recent summaries and live data for the plots and the API
+	recent := cache.New(24 * time.Hour)
+	recent.Location = storeCfg.location
+	storeCfg.cache = recent
+	store, err := openStore(storeCfg, clock, engine, summarySpool)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	recent.Store = store
+	err = recent.Load(intervals, time.Now())
+	if err != nil {
+		log.Printf("Error loading recent summaries: %v", err)
+	}
+	tracker, err := climate.NewTracker(store, storeCfg.station, clock.Location(), climateInterval(intervals))
 	if err != nil {
 		log.Fatalln(err)
 	}
+	tracker.Flags = store.GetFlags
+	engine.AddSink(tracker)
+	climateEvents := tracker.Events()
+	stopReplay := make(chan struct{})
+	if summarySpool != nil {
+		go store.(spooledStore).ReplaySpoolForever(30*time.Second, stopReplay)
+	}
+	if cacheReload > 0 {
+		go recent.LoadEvery(intervals, cacheReload, stopReplay)
+	}
+	replaying := replayCfg.from != ""
+	if !replaying {
+		// finish or resume the summaries that were in progress at shutdown
+		err = engine.LoadState(stateFile, time.Now())
+		if err != nil {
+			log.Printf("Error resuming summaries: %v", err)
+		}
+		engine.Start(func(err error) {
+			log.Printf("Error saving summary: %v", err)
+		})
+	}
+
+	var retentionJob *retention.Job
+	if retentionFlag != "" {
+		policy, err := retention.ParsePolicy(retentionFlag)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		retentionJob = retention.NewJob(store, policy, intervals)
+		retentionJob.Location = storeCfg.location
+		retentionJob.Start(retentionEvery)
+	}
+
+	gp := plot.NewGnuPlot(recent)
 
 	rawRecorder := raw.NewRecorder(rawDir)
+	rawRecorder.Location = storeCfg.location
+	rawRecorder.Station = storeCfg.station
+	var rawJob *raw.Job
+	var rawLock *raw.DirLock
+	if rawDir != "" && !replaying {
+		// keeps convert out while this records
+		rawLock, err = raw.Lock(rawDir)
+		if err != nil {
+			log.Fatalf("Can't record to -raw: %v", err)
+		}
+		rawJob = raw.NewJob(rawDir)
+		rawJob.Location = storeCfg.location
+		rawJob.Compress = rawCompress
+		rawJob.MaxBytes = rawMaxMB * 1024 * 1024
+		if rawKeep != "" {
+			rawJob.MaxAge, err = retention.ParseDays(rawKeep)
+			if err != nil {
+				log.Fatalf("Bad -raw-keep %q: %v", rawKeep, err)
+			}
+		}
+		rawJob.Start(time.Hour)
+	}
 
 	handler := func(loopPkt []byte) {
-		db.Record(loopPkt)
-		if rawDir != "" {
+		store.Record(loopPkt)
+		// replayed packets are already recorded
+		if rawDir != "" && !replaying {
 			rawRecorder.Record(loopPkt)
 		}
 	}
 
-	apiHandler := api.CreateRoutes(db)
+	var flagHandler *api.FlagHandler
+	if adminToken != "" {
+		flagHandler = api.NewFlagHandler(store, storeCfg.location, adminToken)
+		rebuildIntervals := append(append([]time.Duration{}, intervals...), time.Hour, 24*time.Hour)
+		flagHandler.OnChange = func(f *rollup.Flag) {
+			// the recent summaries are read again for their new quality and
+			// the days under the flag are remade without its invalid data
+			go func() {
+				if err := recent.Load(intervals, time.Now()); err != nil {
+					log.Printf("Error reloading recent summaries: %v", err)
+				}
+				from := f.Start.In(storeCfg.location).Format(climate.DayFormat)
+				to := f.End.In(storeCfg.location).Format(climate.DayFormat)
+				err := tracker.Rebuild(store, from, to, rebuildIntervals)
+				if err != nil {
+					log.Printf("Error rebuilding climate from %v to %v: %v", from, to, err)
+				}
+			}()
+		}
+	}
+	apiHandler := api.CreateRoutes(store, recent, storeCfg.location, flagHandler)
 	go func() {
 		log.Println("Listening on port 4444")
 		log.Fatal(http.ListenAndServe(":4444", apiHandler))
 	}()
 
-	go vantage.CollectDataForever(host, handler)
+	if replaying {
+		go func() {
+			err := replayCfg.run(rawDir, storeCfg.location, engine, handler, stopReplay)
+			if err != nil {
+				log.Printf("Error replaying: %v", err)
+			}
+		}()
+	} else {
+		go vantage.CollectDataForever(host, clock, handler)
+	}
 	for {
 		select {
 		case err1 := <-gp.ErrChan:
 			log.Printf("GP error: %v\n", err1)
-		case err2 := <-db.ErrChan:
+		case err2 := <-store.Errors():
 			log.Printf("DB error: %v\n", err2)
+		case event := <-climateEvents:
+			log.Println(event)
 		case <-notifyChan:
 			log.Println("Shutting down")
 			signal.Reset()
+			engine.Stop()
+			if retentionJob != nil {
+				retentionJob.Stop()
+			}
+			// a replay's periods aren't resumed
+			if !replaying {
+				if err := engine.SaveState(stateFile); err != nil {
+					log.Printf("Error saving in-progress summaries: %v", err)
+				}
+			}
+			close(stopReplay)
+			if rawJob != nil {
+				rawJob.Stop()
+			}
 			rawRecorder.Shutdown()
+			if rawLock != nil {
+				rawLock.Unlock()
+			}
+			store.Close()
+			if summarySpool != nil {
+				summarySpool.Close()
+			}
 			os.Exit(0)
 		}
 	}
 }
 
-func dmp(host string) {
+// storeConfig is the flags for picking and connecting to a store
+type storeConfig struct {
+	kind         string
+	sqliteFile   string
+	postgresConn string
+	station      string
+	// location is the station time zone
+	location    *time.Location
+	loopRecords time.Duration
+	// cache is fed by the store; the commands other than the collector
+	// leave it nil
+	cache *cache.Cache
+}
+
+// spooledStore is implemented by all the stores
+type spooledStore interface {
+	ReplaySpoolForever(interval time.Duration, stop <-chan struct{})
+}
+
+// openStore opens the configured store, records loop packets with engine
+// and adds the store as a sink of engine. Failed inserts go to summarySpool
+// if it isn't nil. Loop records are saved in batches if -loop-records is set.
+func openStore(cfg storeConfig, clock *vantage.Clock, engine *rollup.Engine, summarySpool *spool.Spool) (db.Store, error) {
+	var store db.Store
+	var err error
+	switch cfg.kind {
+	case db.MysqlDialect:
+		store, err = db.NewMysql("windygo", "")
+	case db.SQLiteDialect:
+		store, err = db.NewSQLite(cfg.sqliteFile)
+	case db.PostgresDialect:
+		store, err = db.NewPostgres(cfg.postgresConn)
+	case "memory":
+		store = db.NewMemory()
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.Configure(db.Options{
+		Clock:       clock,
+		Engine:      engine,
+		Spool:       summarySpool,
+		Station:     cfg.station,
+		Cache:       cfg.cache,
+		LoopRecords: cfg.loopRecords,
+	})
+	return store, nil
+}
+
+// loadLocation loads the -tz zone; empty is the host's zone
+func loadLocation(tz string) (*time.Location, error) {
+	if tz == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("bad time zone %q: %w", tz, err)
+	}
+	return loc, nil
+}
+
+// dataSource is the driver connect string for the sql stores
+func (cfg storeConfig) dataSource() (string, error) {
+	switch cfg.kind {
+	case db.MysqlDialect:
+		return db.MysqlDataSource("windygo", ""), nil
+	case db.SQLiteDialect:
+		return cfg.sqliteFile, nil
+	case db.PostgresDialect:
+		return cfg.postgresConn, nil
+	}
+	return "", fmt.Errorf("store %q has no database", cfg.kind)
+}
+
+func dmp(host string, loc *time.Location) {
 	vc, err := vantage.Dial(host)
 	if err != nil {
 		log.Fatalf("Error connecting to vantage: %v", err)
 	}
+	// archive records only have console time so the offset is
+	// needed to put them on the host timeline
+	vc.Clock = vantage.NewClock(loc)
+	err = vc.SyncClock()
+	if err != nil {
+		log.Fatalf("Error reading console time: %v", err)
+	}
+	log.Printf("Console clock offset: %v", vc.Clock.Offset())
 
 	ars, err := vc.GetArchiveRecords()
 	if err != nil {
 		log.Fatalf("Error getting archive: %v\n", err)
 	}
 	for _, ar := range ars {
-		fmt.Printf("I:%v\tJ:%v\t%v\t%v\t%v\n", ar.ArchivePage, ar.ArchivePageRecord, ar.ArchiveTime, ar.WindAvg, ar.OutsideTemp)
+		fmt.Printf("I:%v\tJ:%v\t%v\t%v\t%v\t%v\n", ar.ArchivePage, ar.ArchivePageRecord, ar.ArchiveTime, ar.HostTime, ar.WindAvg, ar.OutsideTemp)
 	}
 }
 
@@ -116,17 +440,33 @@ func printLoopFile(fileName string) error {
 	}
 
 	defer f.Close()
-	bufferdReader := bufio.NewReader(f)
-	var loopPkt []byte = make([]byte, vantage.LOOP_RECORD_SIZE)
+	var bufferdReader io.Reader = bufio.NewReader(f)
+	if strings.HasSuffix(fileName, ".gz") {
+		gz, err := gzip.NewReader(bufferdReader)
+		if err != nil {
+			return fmt.Errorf("error opening loop packet file: %w", err)
+		}
+		defer gz.Close()
+		bufferdReader = gz
+	}
+	d := raw.NewDecoder(bufferdReader)
 	for {
-		_, err = io.ReadFull(bufferdReader, loopPkt)
+		rec, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, raw.ErrChecksum) {
+			fmt.Printf("skipped: %v\n", err)
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
-				return nil
-			}
 			return fmt.Errorf("error reading loop packet: %w", err)
 		}
-		loopRecord := vantage.ParseLoop(loopPkt)
+		if rec.Type != raw.TypeLoop {
+			fmt.Printf("%v\ttype %v record of %v bytes\n", rec.Time, rec.Type, len(rec.Data))
+			continue
+		}
+		loopRecord := vantage.ParseLoop(rec.Stamped())
 		fmt.Printf("%v\tW:%v\tT:%v\n", loopRecord.Recorded, loopRecord.WindAvg, loopRecord.OutsideTemp())
 	}
 }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/smw1218/windygo/db"
+)
+
+// migrate runs "windygo migrate [up|down|status] [version]". up with no
+// version migrates to the latest. down needs the version to revert to, or
+// -all to revert everything, which drops all the tables.
+func migrate(cfg storeConfig, args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+		args = args[1:]
+	}
+	flags := flag.NewFlagSet("migrate "+command, flag.ContinueOnError)
+	all := flags.Bool("all", false, "with down, revert every migration and drop all the tables")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	target := 0
+	if flags.NArg() > 0 {
+		target, err = strconv.Atoi(flags.Arg(0))
+		if err != nil {
+			return fmt.Errorf("bad version %q: %w", flags.Arg(0), err)
+		}
+	}
+	if command == "down" && *all && flags.NArg() > 0 {
+		return fmt.Errorf("migrate down takes a version or -all, not both")
+	}
+	if command == "down" && !*all && target <= 0 {
+		return fmt.Errorf("migrate down needs a version above 0 to revert to, or -all to revert everything")
+	}
+
+	dataSource, err := cfg.dataSource()
+	if err != nil {
+		return err
+	}
+	migrator, err := db.OpenMigrator(cfg.kind, dataSource)
+	if err != nil {
+		return err
+	}
+	defer migrator.Close()
+
+	switch command {
+	case "up":
+		err = migrator.Up(target)
+	case "down":
+		err = migrator.Down(target)
+	case "status":
+	default:
+		return fmt.Errorf("unknown migrate command %q, use up, down or status", command)
+	}
+	if err != nil {
+		return err
+	}
+	version, err := migrator.Version()
+	if err != nil {
+		return err
+	}
+	log.Printf("Schema version %v, latest %v", version, migrator.Latest())
+	return nil
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"time"
 
+	"github.com/smw1218/windygo/cache"
 	"github.com/smw1218/windygo/db"
 )
 
@@ -99,55 +100,46 @@ var barTrendFont = map[byte]string{
 // GnuPlot creates a time series plot every minute. The plot only shows 5 minute averages but
 // you can see the time gap at the end of the graph. It includes wind avg, lull and gust and also
 // direction using a custom arrow font.
-// It has a ring buffer of summaries so it can plot the last 12 hours every minute.
-// Initially it queries the database to get exisitng summaries
-// on boot. The summaries are then pulled directly from the mysql.SavedChan as they're created.
+// The last 12 hours of 5 minute summaries are read from the cache each time a minute summary
+// arrives from its subscription.
 type GnuPlot struct {
-	// TODO mutex
-	saved         []*db.Summary
-	nextSave      int
-	currentMinute *db.Summary
-	summaryChan   chan *db.Summary
-	ErrChan       chan error
+	cache   *cache.Cache
+	sub     *cache.Subscription
+	ErrChan chan error
 }
 
-func NewGnuPlot(mysql *db.Mysql) (*GnuPlot, error) {
-	gp := &GnuPlot{}
-	var err error
-	reportSize := 12 * time.Hour
-	gp.saved, err = mysql.GetSummaries(time.Now().Add(-reportSize), reportSize, summarySecondsForGraph)
-	if err != nil {
-		return nil, err
-	}
+const reportSize = 12 * time.Hour
 
-	gp.summaryChan = mysql.SavedChan
-	gp.ErrChan = make(chan error, 5)
+func NewGnuPlot(c *cache.Cache) *GnuPlot {
+	gp := &GnuPlot{
+		cache:   c,
+		sub:     c.Subscribe(false),
+		ErrChan: make(chan error, 5),
+	}
 	go gp.generator()
-	return gp, nil
+	return gp
 }
 
 func (gp *GnuPlot) generator() {
-	for summary := range gp.summaryChan {
-		if summary.SummarySeconds == summarySecondsForGraph {
-			gp.saved[gp.nextSave%len(gp.saved)] = summary
-			gp.nextSave++
-		} else if summary.SummarySeconds == summarySecondsForGeneration {
-			gp.currentMinute = summary
-			err := CreateFullReport(gp.LinearSummaries(), summary)
-			if err != nil {
-				gp.sendError(err)
-			}
+	for update := range gp.sub.C {
+		summary := update.Summary
+		if summary.SummarySeconds != summarySecondsForGeneration {
+			continue
+		}
+		summaries, err := gp.LinearSummaries(summary.EndTime)
+		if err == nil {
+			err = CreateFullReport(summaries, summary)
+		}
+		if err != nil {
+			gp.sendError(err)
 		}
 	}
 }
 
-func (gp *GnuPlot) LinearSummaries() []*db.Summary {
-	lensaved := len(gp.saved)
-	newSummaries := make([]*db.Summary, 0, lensaved)
-	ringStart := gp.nextSave % lensaved
-	newSummaries = append(newSummaries, gp.saved[ringStart:]...)
-	newSummaries = append(newSummaries, gp.saved[:ringStart]...)
-	return newSummaries
+// LinearSummaries is the 5 minute summaries of the 12 hours up to end,
+// with nils for the gaps
+func (gp *GnuPlot) LinearSummaries(end time.Time) ([]*db.Summary, error) {
+	return gp.cache.Window(summarySecondsForGraph*time.Second, end.Add(-reportSize), end)
 }
 
 func (gp *GnuPlot) sendError(err error) {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/retention"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// prune runs "windygo prune [-n]" which generates the hourly and daily
+// summaries and deletes the old ones once, using the -retention policy or
+// the default one. -n only reports what it would do.
+func prune(cfg storeConfig, policyFlag, intervalsFlag string, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	dryRun := flags.Bool("n", false, "dry run, only report what would be generated and deleted")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if policyFlag == "" {
+		policyFlag = retention.DefaultPolicy
+	}
+	policy, err := retention.ParsePolicy(policyFlag)
+	if err != nil {
+		return err
+	}
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+
+	store, err := openStore(cfg, vantage.NewClock(cfg.location), rollup.NewEngine(intervals), nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	job := retention.NewJob(store, policy, intervals)
+	job.DryRun = *dryRun
+	job.Location = cfg.location
+	return job.Run(time.Now())
+}
+
+// regenerate makes the hourly and daily summaries over start up to end
+// again after rebuild or archive fill changed the summaries they're made
+// from, using the -retention policy or the default one
+func regenerate(store db.Store, cfg storeConfig, policyFlag string, intervals []time.Duration, start, end time.Time) error {
+	if policyFlag == "" {
+		policyFlag = retention.DefaultPolicy
+	}
+	policy, err := retention.ParsePolicy(policyFlag)
+	if err != nil {
+		return err
+	}
+	job := retention.NewJob(store, policy, intervals)
+	job.Location = cfg.location
+	_, err = job.Regenerate(start, end)
+	return err
+}
@@ -0,0 +1,368 @@
+package raw
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+// The recordings come in two formats.
+//
+// Version 1 is a bare run of loop packets, each the 8 byte little endian
+// UnixNano receive time followed by the 99 byte LOOP packet.
+//
+// Version 2 starts with a header: the magic "WGRW", the version byte, a
+// little endian uint16 length, that many bytes of Header as JSON and the
+// CRC-32 (IEEE) of the JSON as a little endian uint32. Records follow, each
+// a RecordType byte, a uint32 length, the int64 UnixNano receive time, the
+// length bytes of the packet and the CRC-32 of everything before it in the
+// record, all little endian.
+//
+// A header can come again between records, like when a file is appended to
+// after an upgrade or a gzipped hour gets another member, and the records
+// after it are read in its version.
+const (
+	Version1 = 1
+	Version2 = 2
+)
+
+var magic = []byte("WGRW")
+
+// RecordType is the kind of packet a version 2 record holds
+type RecordType uint8
+
+const (
+	// TypeLoop is a LOOP packet
+	TypeLoop RecordType = 1
+	// TypeLoop2 is a LOOP2 packet
+	TypeLoop2 RecordType = 2
+	// TypeArchivePage is a page of the console's archive from DMP
+	TypeArchivePage RecordType = 3
+)
+
+// maxRecordSize is the longest packet a record can hold; a longer length
+// means the file is corrupt
+const maxRecordSize = 64 * 1024
+
+// ErrChecksum is returned by Decoder.Next for a record that doesn't match
+// its checksum. The record is skipped so the next call reads the one after.
+var ErrChecksum = errors.New("raw record checksum mismatch")
+
+// Header describes a version 2 file
+type Header struct {
+	Station  string
+	TimeZone string
+	Created  time.Time
+}
+
+// Record is one packet from a recording
+type Record struct {
+	Type RecordType
+	// Time is when the host received it
+	Time time.Time
+	// Data is the packet as the console sent it
+	Data []byte
+}
+
+// Stamped is a loop record in the version 1 layout, the receive time then
+// the packet, which is what vantage.ParseLoop and the loop handlers take
+func (r *Record) Stamped() []byte {
+	pkt := make([]byte, 8+len(r.Data))
+	binary.LittleEndian.PutUint64(pkt, uint64(r.Time.UnixNano()))
+	copy(pkt[8:], r.Data)
+	return pkt
+}
+
+// Loop parses a TypeLoop record, nil for any other type
+func (r *Record) Loop() *vantage.LoopRecord {
+	if r.Type != TypeLoop {
+		return nil
+	}
+	return vantage.ParseLoop(r.Stamped())
+}
+
+// LoopRecord is the record from a loop handler's packet, the receive time
+// then the LOOP packet
+func LoopRecord(loopPkt []byte) *Record {
+	return &Record{
+		Type: TypeLoop,
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(loopPkt))),
+		Data: loopPkt[8:],
+	}
+}
+
+// Encoder writes version 2 recordings
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder that writes to w. The header is written
+// first unless it's nil, for appending to a version 2 file.
+func NewEncoder(w io.Writer, h *Header) (*Encoder, error) {
+	e := &Encoder{w: w}
+	if h == nil {
+		return e, nil
+	}
+	data, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, len(magic)+3+len(data)+4)
+	buf = append(buf, magic...)
+	buf = append(buf, Version2)
+	buf = appendUint16(buf, uint16(len(data)))
+	buf = append(buf, data...)
+	buf = appendUint32(buf, crc32.ChecksumIEEE(data))
+	if _, err = w.Write(buf); err != nil {
+		return nil, fmt.Errorf("error writing raw header: %w", err)
+	}
+	return e, nil
+}
+
+// Encode writes the record in one Write
+func (e *Encoder) Encode(r *Record) error {
+	if len(r.Data) > maxRecordSize {
+		return fmt.Errorf("raw record of %v bytes is too long", len(r.Data))
+	}
+	buf := make([]byte, 0, 1+4+8+len(r.Data)+4)
+	buf = append(buf, byte(r.Type))
+	buf = appendUint32(buf, uint32(len(r.Data)))
+	buf = appendUint64(buf, uint64(r.Time.UnixNano()))
+	buf = append(buf, r.Data...)
+	buf = appendUint32(buf, crc32.ChecksumIEEE(buf))
+	_, err := e.w.Write(buf)
+	return err
+}
+
+// Decoder reads version 1 and 2 recordings
+type Decoder struct {
+	r       *bufio.Reader
+	version int
+	header  *Header
+	offset  int64
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r), version: Version1}
+}
+
+// Version is the format of the records being read, 1 until a header is read
+func (d *Decoder) Version() int {
+	return d.version
+}
+
+// Header is the last header read, nil for a version 1 recording
+func (d *Decoder) Header() *Header {
+	return d.header
+}
+
+// Offset is how many bytes the headers and whole records read so far take
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Next returns the next record. It returns io.EOF at the end,
+// io.ErrUnexpectedEOF for a record cut short and an error wrapping
+// ErrChecksum for a corrupt record, after which it can carry on.
+func (d *Decoder) Next() (*Record, error) {
+	for {
+		start, err := d.r.Peek(len(magic))
+		if err == io.EOF && len(start) == 0 {
+			return nil, io.EOF
+		}
+		if len(start) == len(magic) && bytes.Equal(start, magic) {
+			if err = d.readHeader(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if d.version == Version1 {
+			return d.nextV1()
+		}
+		return d.nextV2()
+	}
+}
+
+func (d *Decoder) readHeader() error {
+	fixed := make([]byte, len(magic)+3)
+	if _, err := io.ReadFull(d.r, fixed); err != nil {
+		return unexpected(err)
+	}
+	version := int(fixed[len(magic)])
+	if version != Version2 {
+		return fmt.Errorf("raw format version %v is newer than this windygo reads", version)
+	}
+	data := make([]byte, int(binary.LittleEndian.Uint16(fixed[len(magic)+1:]))+4)
+	if _, err := io.ReadFull(d.r, data); err != nil {
+		return unexpected(err)
+	}
+	data, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(data) != sum {
+		return fmt.Errorf("raw header checksum mismatch")
+	}
+	h := &Header{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return fmt.Errorf("bad raw header: %w", err)
+	}
+	d.version, d.header = version, h
+	d.offset += int64(len(fixed) + len(data) + 4)
+	return nil
+}
+
+func (d *Decoder) nextV1() (*Record, error) {
+	pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+	if _, err := io.ReadFull(d.r, pkt); err != nil {
+		return nil, err
+	}
+	d.offset += int64(len(pkt))
+	return LoopRecord(pkt), nil
+}
+
+func (d *Decoder) nextV2() (*Record, error) {
+	fixed := make([]byte, 1+4+8)
+	if _, err := io.ReadFull(d.r, fixed); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(fixed[1:])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("raw record of %v bytes, the recording is corrupt", length)
+	}
+	rest := make([]byte, int(length)+4)
+	if _, err := io.ReadFull(d.r, rest); err != nil {
+		return nil, unexpected(err)
+	}
+	d.offset += int64(len(fixed) + len(rest))
+	r := &Record{
+		Type: RecordType(fixed[0]),
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(fixed[5:]))),
+		Data: rest[:length],
+	}
+	sum := crc32.NewIEEE()
+	sum.Write(fixed)
+	sum.Write(r.Data)
+	if sum.Sum32() != binary.LittleEndian.Uint32(rest[length:]) {
+		return nil, fmt.Errorf("type %v record at %v: %w", r.Type, r.Time, ErrChecksum)
+	}
+	return r, nil
+}
+
+// Convert copies every record from src to a version 2 recording with header
+// h in dst and returns how many. Corrupt records are dropped.
+func Convert(dst io.Writer, src io.Reader, h *Header) (int, error) {
+	e, err := NewEncoder(dst, h)
+	if err != nil {
+		return 0, err
+	}
+	d := NewDecoder(src)
+	converted := 0
+	for {
+		r, err := d.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return converted, nil
+		}
+		if errors.Is(err, ErrChecksum) {
+			continue
+		}
+		if err != nil {
+			return converted, err
+		}
+		if err = e.Encode(r); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+}
+
+// FileVersion is the format a recording starts in
+func FileVersion(fileName string) (int, error) {
+	f, err := openFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return startVersion(bufio.NewReader(f)), nil
+}
+
+// startVersion peeks at the start of r for a header
+func startVersion(r *bufio.Reader) int {
+	if start, err := r.Peek(len(magic)); err == nil && bytes.Equal(start, magic) {
+		return Version2
+	}
+	return Version1
+}
+
+// ConvertFile rewrites a recording in the version 2 format with header h,
+// gzipped again if it ends in .gz. It returns false without changing a file
+// that's already version 2.
+func ConvertFile(fileName string, h *Header) (bool, error) {
+	src, err := openFile(fileName)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	buffered := bufio.NewReader(src)
+	if startVersion(buffered) != Version1 {
+		return false, nil
+	}
+
+	tmpName := fileName + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return false, fmt.Errorf("error converting %v: %w", fileName, err)
+	}
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+	var dst io.Writer = tmp
+	var gz *gzip.Writer
+	if strings.HasSuffix(fileName, ".gz") {
+		gz = gzip.NewWriter(tmp)
+		dst = gz
+	}
+	if _, err = Convert(dst, buffered, h); err != nil {
+		return false, fmt.Errorf("error converting %v: %w", fileName, err)
+	}
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			return false, fmt.Errorf("error converting %v: %w", fileName, err)
+		}
+	}
+	if err = tmp.Sync(); err != nil {
+		return false, fmt.Errorf("error converting %v: %w", fileName, err)
+	}
+	if err = os.Rename(tmpName, fileName); err != nil {
+		return false, fmt.Errorf("error converting %v: %w", fileName, err)
+	}
+	return true, nil
+}
+
+// unexpected is err with a clean EOF part way through something turned into
+// io.ErrUnexpectedEOF
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	return append(buf, byte(v), byte(v>>8))
+}
+
+func appendUint32(buf []byte, v uint32) []byte {
+	return append(buf, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	return appendUint32(appendUint32(buf, uint32(v)), uint32(v>>32))
+}
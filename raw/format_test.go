@@ -0,0 +1,239 @@
+package raw
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func testLoopPkt(at time.Time, wind int) []byte {
+	pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+	binary.LittleEndian.PutUint64(pkt, uint64(at.UnixNano()))
+	pkt[8+14] = byte(wind)
+	return pkt
+}
+
+func decodeAll(t *testing.T, r io.Reader) ([]*Record, int) {
+	d := NewDecoder(r)
+	var records []*Record
+	skipped := 0
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			return records, skipped
+		}
+		if errors.Is(err, ErrChecksum) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := &Header{Station: "test", TimeZone: "UTC", Created: start}
+
+	// a version 1 file then a header and version 2 records appended to it
+	buf := &bytes.Buffer{}
+	buf.Write(testLoopPkt(start, 1))
+	buf.Write(testLoopPkt(start.Add(2*time.Second), 2))
+	e, err := NewEncoder(buf, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Encode(LoopRecord(testLoopPkt(start.Add(4*time.Second), 3))); err != nil {
+		t.Fatal(err)
+	}
+	page := &Record{Type: TypeArchivePage, Time: start.Add(5 * time.Second), Data: []byte("page")}
+	if err = e.Encode(page); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Encode(LoopRecord(testLoopPkt(start.Add(6*time.Second), 4))); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(bytes.NewReader(buf.Bytes()))
+	for i := 0; i < 3; i++ {
+		if _, err = d.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.Version() != Version2 || d.Header().Station != "test" || !d.Header().Created.Equal(start) {
+		t.Fatalf("unexpected header %v %+v", d.Version(), d.Header())
+	}
+
+	records, skipped := decodeAll(t, bytes.NewReader(buf.Bytes()))
+	if len(records) != 5 || skipped != 0 {
+		t.Fatalf("expected 5 records got %v, %v skipped", len(records), skipped)
+	}
+	for i, wind := range map[int]int{0: 1, 1: 2, 2: 3, 4: 4} {
+		if records[i].Type != TypeLoop || vantage.ParseLoop(records[i].Stamped()).Wind != wind {
+			t.Fatalf("unexpected record %v %+v", i, records[i])
+		}
+	}
+	if records[3].Type != TypeArchivePage || string(records[3].Data) != "page" || !records[3].Time.Equal(page.Time) {
+		t.Fatalf("unexpected archive page %+v", records[3])
+	}
+
+	// a corrupt record is skipped and the rest read
+	corrupt := append([]byte(nil), buf.Bytes()...)
+	corrupt[len(corrupt)-10] ^= 0xff
+	if records, skipped = decodeAll(t, bytes.NewReader(corrupt)); len(records) != 4 || skipped != 1 {
+		t.Fatalf("expected 4 records and 1 skipped got %v, %v", len(records), skipped)
+	}
+
+	// cut short
+	d = NewDecoder(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	for err == nil {
+		_, err = d.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected an unexpected EOF got %v", err)
+	}
+
+	converted := &bytes.Buffer{}
+	n, err := Convert(converted, bytes.NewReader(buf.Bytes()), h)
+	if err != nil || n != 5 {
+		t.Fatalf("unexpected convert %v %v", n, err)
+	}
+	if records, _ = decodeAll(t, converted); len(records) != 5 || records[3].Type != TypeArchivePage {
+		t.Fatalf("unexpected converted records %+v", records)
+	}
+}
+
+func TestConvertFile(t *testing.T) {
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	h := &Header{Station: "test", TimeZone: "UTC", Created: start}
+	v1 := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		v1.Write(testLoopPkt(start.Add(time.Duration(i)*2*time.Second), i))
+	}
+	plain := filepath.Join(t.TempDir(), "12+0000.rec")
+	if err := ioutil.WriteFile(plain, v1.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write(v1.Bytes())
+	gz.Close()
+	zipped := filepath.Join(t.TempDir(), "12+0000.rec.gz")
+	if err := ioutil.WriteFile(zipped, compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileName := range []string{plain, zipped} {
+		if ok, err := ConvertFile(fileName, h); !ok || err != nil {
+			t.Fatalf("expected %v converted got %v %v", fileName, ok, err)
+		}
+		if version, err := FileVersion(fileName); version != Version2 || err != nil {
+			t.Fatalf("expected %v in version 2 got %v %v", fileName, version, err)
+		}
+		if ok, err := ConvertFile(fileName, h); ok || err != nil {
+			t.Fatalf("expected %v left alone got %v %v", fileName, ok, err)
+		}
+		f, err := openFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := decodeAll(t, f)
+		f.Close()
+		if len(records) != 3 || records[2].Loop().Wind != 2 {
+			t.Fatalf("unexpected records from %v %+v", fileName, records)
+		}
+	}
+}
+
+func TestRepairEnd(t *testing.T) {
+	baseDir := t.TempDir()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	recorder := NewRecorder(baseDir)
+	recorder.Record(testLoopPkt(start, 1))
+	recorder.Shutdown()
+
+	// a crash part way through a record
+	fileName := FileName(baseDir, start, nil)
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{byte(TypeLoop), 99, 0, 0})
+	f.Close()
+
+	recorder = NewRecorder(baseDir)
+	recorder.Record(testLoopPkt(start.Add(2*time.Second), 2))
+	recorder.Shutdown()
+	var winds []int
+	err = Read(baseDir, nil, start, start.Add(time.Hour), func(loopPkt []byte) error {
+		winds = append(winds, vantage.ParseLoop(loopPkt).Wind)
+		return nil
+	})
+	if err != nil || len(winds) != 2 || winds[1] != 2 {
+		t.Fatalf("expected both packets after the partial one got %v %v", winds, err)
+	}
+}
+
+func TestHeaderWriteFails(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes")
+	}
+	baseDir := t.TempDir()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	fileName := FileName(baseDir, start, nil)
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// every write to the hour's file fails like on a full disk
+	if err := os.Symlink("/dev/full", fileName); err != nil {
+		t.Fatal(err)
+	}
+	recorder := NewRecorder(baseDir)
+	recorder.Record(testLoopPkt(start, 1))
+	recorder.Record(testLoopPkt(start.Add(time.Second), 2))
+
+	// and once there's room again the next packet is recorded
+	if err := os.Remove(fileName); err != nil {
+		t.Fatal(err)
+	}
+	recorder.Record(testLoopPkt(start.Add(2*time.Second), 3))
+	recorder.Shutdown()
+	var winds []int
+	err := Read(baseDir, nil, start, start.Add(time.Hour), func(loopPkt []byte) error {
+		winds = append(winds, vantage.ParseLoop(loopPkt).Wind)
+		return nil
+	})
+	if err != nil || len(winds) != 1 || winds[0] != 3 {
+		t.Fatalf("expected just the last packet got %v %v", winds, err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	baseDir := t.TempDir()
+	lock, err := Lock(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Lock(baseDir); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected the directory locked got %v", err)
+	}
+	if err = lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = Lock(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock.Unlock()
+}
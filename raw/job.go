@@ -0,0 +1,274 @@
+package raw
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// compressGrace is how long after the end of an hour its file is left alone
+// in case a late packet is still being written
+const compressGrace = 5 * time.Minute
+
+// ManifestName is the file in the base directory that lists the hours
+// recorded, as a Manifest
+const ManifestName = "hours.json"
+
+// Hour is one hour file
+type Hour struct {
+	Start time.Time
+	// File is relative to the base directory
+	File       string
+	Bytes      int64
+	Compressed bool
+}
+
+// Manifest lists the hours recorded, oldest first
+type Manifest struct {
+	Updated time.Time
+	Bytes   int64
+	Hours   []Hour
+}
+
+// Job looks after the recordings: it gzips the files of the hours that are
+// over, deletes the hours older than MaxAge and then the oldest hours until
+// the recordings fit in MaxBytes, and writes the Manifest. The hour being
+// recorded is never touched.
+type Job struct {
+	BaseDir string
+	// Location is the station time zone the files are named in, nil is
+	// time.Local
+	Location *time.Location
+	Compress bool
+	// MaxAge and MaxBytes are 0 for no limit
+	MaxAge   time.Duration
+	MaxBytes int64
+	mutex    sync.Mutex
+	stop     chan struct{}
+}
+
+func NewJob(baseDir string) *Job {
+	return &Job{
+		BaseDir:  baseDir,
+		Compress: true,
+	}
+}
+
+// Hours lists the hour files in baseDir, oldest first. Files named without
+// the offset by older versions are read in loc.
+func Hours(baseDir string, loc *time.Location) ([]Hour, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	hours := make([]Hour, 0)
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		name := strings.TrimSuffix(rel, ".gz")
+		if !strings.HasSuffix(name, ".rec") {
+			return nil
+		}
+		start, err := time.Parse("2006/01/02/15-0700.rec", name)
+		if err != nil {
+			start, err = time.ParseInLocation("2006/01/02/15.rec", name, loc)
+		}
+		if err != nil {
+			// not one of ours
+			return nil
+		}
+		hours = append(hours, Hour{Start: start, File: rel, Bytes: info.Size(), Compressed: name != rel})
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return hours, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing %v: %w", baseDir, err)
+	}
+	sort.SliceStable(hours, func(i, j int) bool { return hours[i].Start.Before(hours[j].Start) })
+	return hours, nil
+}
+
+// Run compresses, prunes and writes the manifest once
+func (j *Job) Run(now time.Time) error {
+	hours, err := Hours(j.BaseDir, j.Location)
+	if err != nil {
+		return err
+	}
+	over := func(h Hour) bool {
+		return !now.Before(h.Start.Add(time.Hour + compressGrace))
+	}
+
+	if j.Compress {
+		compressed := 0
+		for _, h := range hours {
+			if h.Compressed || !over(h) {
+				continue
+			}
+			if err = compressFile(filepath.Join(j.BaseDir, h.File)); err != nil {
+				return err
+			}
+			compressed++
+		}
+		if compressed > 0 {
+			log.Printf("Compressed %v raw hours", compressed)
+			if hours, err = Hours(j.BaseDir, j.Location); err != nil {
+				return err
+			}
+		}
+	}
+
+	var total int64
+	for _, h := range hours {
+		total += h.Bytes
+	}
+	kept := hours[:0]
+	deleted := 0
+	for _, h := range hours {
+		tooOld := j.MaxAge > 0 && h.Start.Add(time.Hour).Before(now.Add(-j.MaxAge))
+		tooBig := j.MaxBytes > 0 && total > j.MaxBytes
+		if over(h) && (tooOld || tooBig) {
+			if err = j.remove(h.File); err != nil {
+				return err
+			}
+			total -= h.Bytes
+			deleted++
+			continue
+		}
+		kept = append(kept, h)
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %v raw hours, %v MB left", deleted, total/1024/1024)
+	}
+	if j.MaxBytes > 0 && total > j.MaxBytes {
+		log.Printf("Raw recordings are %v MB, over the %v MB limit, with only the current hour left", total/1024/1024, j.MaxBytes/1024/1024)
+	}
+	return j.writeManifest(&Manifest{Updated: now, Bytes: total, Hours: kept})
+}
+
+// compressFile gzips fileName to fileName.gz and removes it. If there's
+// already a .gz, from packets recorded after it was compressed, the file is
+// added to it as another gzip member, which readers read straight through.
+func compressFile(fileName string) error {
+	gzName := fileName + ".gz"
+	tmpName := gzName + ".tmp"
+	tmp, err := os.Create(tmpName)
+	if err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	defer os.Remove(tmpName)
+	defer tmp.Close()
+
+	if existing, err := os.Open(gzName); err == nil {
+		_, err = io.Copy(tmp, existing)
+		existing.Close()
+		if err != nil {
+			return fmt.Errorf("error compressing %v: %w", fileName, err)
+		}
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(tmp)
+	if _, err = io.Copy(gz, f); err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	if err = gz.Close(); err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	if err = tmp.Sync(); err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	if err = os.Rename(tmpName, gzName); err != nil {
+		return fmt.Errorf("error compressing %v: %w", fileName, err)
+	}
+	return os.Remove(fileName)
+}
+
+// remove deletes the hour file and the day, month and year directories it
+// leaves empty
+func (j *Job) remove(file string) error {
+	err := os.Remove(filepath.Join(j.BaseDir, file))
+	if err != nil {
+		return fmt.Errorf("error deleting %v: %w", file, err)
+	}
+	for dir := filepath.Dir(file); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		// fails if the directory isn't empty
+		if os.Remove(filepath.Join(j.BaseDir, dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (j *Job) writeManifest(m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(j.BaseDir, 0755)
+	if err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	fileName := filepath.Join(j.BaseDir, ManifestName)
+	err = ioutil.WriteFile(fileName+".tmp", data, 0644)
+	if err != nil {
+		return fmt.Errorf("error writing the raw manifest: %w", err)
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// Start runs the job now and then every interval until Stop
+func (j *Job) Start(every time.Duration) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.stop != nil {
+		return
+	}
+	j.stop = make(chan struct{})
+	go j.loop(every, j.stop)
+}
+
+func (j *Job) loop(every time.Duration, stop chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		if err := j.Run(time.Now()); err != nil {
+			log.Printf("Raw recordings error: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (j *Job) Stop() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+}
@@ -0,0 +1,102 @@
+package raw
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func TestJob(t *testing.T) {
+	baseDir := t.TempDir()
+	recorder := NewRecorder(baseDir)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	record := func(at time.Time, wind int) {
+		pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+		binary.LittleEndian.PutUint64(pkt, uint64(at.UnixNano()))
+		pkt[8+14] = byte(wind)
+		recorder.Record(pkt)
+	}
+	// a packet every 10 minutes for 3 hours
+	for i := 0; i < 18; i++ {
+		record(start.Add(time.Duration(i)*10*time.Minute), i)
+	}
+	winds := func() []int {
+		var winds []int
+		err := Read(baseDir, nil, start, start.Add(3*time.Hour), func(loopPkt []byte) error {
+			winds = append(winds, vantage.ParseLoop(loopPkt).Wind)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return winds
+	}
+
+	// the last hour is still being recorded
+	job := NewJob(baseDir)
+	if err := job.Run(start.Add(2*time.Hour + 30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	hours, err := Hours(baseDir, nil)
+	if err != nil || len(hours) != 3 || !hours[0].Compressed || !hours[1].Compressed || hours[2].Compressed {
+		t.Fatalf("expected the first 2 hours compressed %+v %v", hours, err)
+	}
+	if w := winds(); len(w) != 18 || w[0] != 0 || w[17] != 17 {
+		t.Fatalf("expected all 18 packets got %v", w)
+	}
+
+	// a packet for a compressed hour, like after the clock jumped back
+	record(start.Add(55*time.Minute), 50)
+	recorder.Shutdown()
+	if err = job.Run(start.Add(4 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if w := winds(); len(w) != 19 || w[6] != 50 || w[18] != 17 {
+		t.Fatalf("expected the late packet after its hour's others got %v", w)
+	}
+	if hours, err = Hours(baseDir, nil); err != nil || len(hours) != 3 || !hours[0].Compressed || !hours[2].Compressed {
+		t.Fatalf("expected every hour compressed %+v %v", hours, err)
+	}
+
+	// the oldest hours go first to fit, then by age
+	job.MaxBytes = hours[1].Bytes + hours[2].Bytes
+	if err = job.Run(start.Add(4 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if w := winds(); len(w) != 12 || w[0] != 6 {
+		t.Fatalf("expected the first hour deleted got %v", w)
+	}
+	job.MaxAge = 90 * time.Minute
+	if err = job.Run(start.Add(4*time.Hour + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if w := winds(); len(w) != 6 || w[0] != 12 {
+		t.Fatalf("expected the second hour deleted got %v", w)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(baseDir, ManifestName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Hours) != 1 || !m.Hours[0].Start.Equal(start.Add(2*time.Hour)) || m.Bytes != m.Hours[0].Bytes {
+		t.Fatalf("unexpected manifest %+v", m)
+	}
+
+	job.MaxAge = time.Minute
+	if err = job.Run(start.Add(4 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(baseDir, "2021")); !os.IsNotExist(err) {
+		t.Fatalf("expected the empty directories deleted: %v", err)
+	}
+}
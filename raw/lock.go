@@ -0,0 +1,49 @@
+package raw
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// LockName is the file in the base directory the Lock is held on
+const LockName = ".lock"
+
+// ErrLocked is returned by Lock when another process has the directory
+var ErrLocked = errors.New("raw directory is in use by another windygo")
+
+// DirLock is a Lock on a base directory
+type DirLock struct {
+	f *os.File
+}
+
+// Lock takes the base directory for this process: windygo holds it while it
+// records and runs the Job, and convert holds it while it rewrites files, so
+// they never change the same hour at once. It doesn't wait; it returns
+// ErrLocked if another process has it. The lock goes with the process if it
+// dies.
+func Lock(baseDir string) (*DirLock, error) {
+	err := os.MkdirAll(baseDir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(baseDir, LockName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening the raw lock: %w", err)
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w: %v", ErrLocked, baseDir)
+		}
+		return nil, fmt.Errorf("error locking %v: %w", baseDir, err)
+	}
+	return &DirLock{f: f}, nil
+}
+
+func (l *DirLock) Unlock() error {
+	unlockFile(l.f)
+	return l.f.Close()
+}
@@ -0,0 +1,13 @@
+package raw
+
+import (
+	"os"
+)
+
+// Windows has no flock; don't run convert while windygo is recording
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) {}
@@ -0,0 +1,216 @@
+package raw
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reader reads the records in a time range of a raw directory in the order
+// they were recorded, across the hour files. Files named without the offset
+// by older versions are read too, and files gzipped by Job along with the
+// packets recorded after them. Hours without a file are skipped, a packet
+// cut short at the end of a file is ignored and corrupt ones are skipped.
+type Reader struct {
+	// Location is the station time zone the files are named in, nil is
+	// time.Local
+	Location *time.Location
+	// Filter, when set, skips the records it returns false for
+	Filter  func(r *Record) bool
+	baseDir string
+	from    time.Time
+	to      time.Time
+	// hour is the next hour to read the files of, zero until Next starts
+	// from the hour of from in Location
+	hour    time.Time
+	pending []*Record
+	read    map[string]bool
+}
+
+// Open returns a reader of the records from from up to to in baseDir. Files
+// are opened as the reader gets to their hour.
+func Open(baseDir string, from, to time.Time) *Reader {
+	r := &Reader{
+		baseDir: baseDir,
+		to:      to,
+	}
+	r.Seek(from)
+	return r
+}
+
+// Seek moves the reader so Next returns the first record at or after t,
+// backwards or forwards
+func (r *Reader) Seek(t time.Time) {
+	r.from = t
+	r.hour = time.Time{}
+	r.pending = nil
+	r.read = make(map[string]bool)
+}
+
+// Next returns the next record, or io.EOF after the last one
+func (r *Reader) Next() (*Record, error) {
+	if r.hour.IsZero() {
+		r.hour = hourStart(r.from, r.Location)
+	}
+	for len(r.pending) == 0 {
+		if !r.hour.Before(r.to) {
+			return nil, io.EOF
+		}
+		err := r.readHour(r.hour)
+		if err != nil {
+			return nil, err
+		}
+		r.hour = r.hour.Add(time.Hour)
+	}
+	rec := r.pending[0]
+	r.pending = r.pending[1:]
+	return rec, nil
+}
+
+// Close releases the records read ahead. Files are only open while an hour
+// is being read, so there's nothing else to close.
+func (r *Reader) Close() error {
+	r.pending = nil
+	r.read = nil
+	return nil
+}
+
+// hourStart is the start of t's hour in loc, which isn't on the hour in UTC
+// for zones with a half hour offset
+func hourStart(t time.Time, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.Local
+	}
+	_, offset := t.In(loc).Zone()
+	shift := time.Duration(offset) * time.Second
+	return t.Add(shift).Truncate(time.Hour).Add(-shift)
+}
+
+// readHour reads the records of an hour's files into pending, sorted by time
+// since a late packet can be appended after a file was compressed
+func (r *Reader) readHour(hour time.Time) error {
+	legacy, current := legacyFileName(r.baseDir, hour, r.Location), FileName(r.baseDir, hour, r.Location)
+	for _, fileName := range []string{legacy + ".gz", legacy, current + ".gz", current} {
+		// a legacy file has both hours repeated when DST ends
+		if r.read[fileName] {
+			continue
+		}
+		r.read[fileName] = true
+		err := r.readFile(fileName)
+		if err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(r.pending, func(i, j int) bool { return r.pending[i].Time.Before(r.pending[j].Time) })
+	return nil
+}
+
+func (r *Reader) readFile(fileName string) error {
+	reader, err := openFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	d := NewDecoder(reader)
+	for {
+		rec, err := d.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Printf("Ignoring partial packet at the end of %v", fileName)
+			return nil
+		}
+		if errors.Is(err, ErrChecksum) {
+			log.Printf("Skipping a corrupt packet in %v: %v", fileName, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %v: %w", fileName, err)
+		}
+		if rec.Time.Before(r.from) || !rec.Time.Before(r.to) {
+			continue
+		}
+		if r.Filter != nil && !r.Filter(rec) {
+			continue
+		}
+		r.pending = append(r.pending, rec)
+	}
+}
+
+// OfType is a Reader.Filter for records of the types given
+func OfType(types ...RecordType) func(r *Record) bool {
+	return func(r *Record) bool {
+		for _, t := range types {
+			if r.Type == t {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Read calls handler with every loop packet recorded from start up to end
+// in the order they were recorded, from files named in loc (nil is
+// time.Local), like a Reader. An error from handler stops the read.
+func Read(baseDir string, loc *time.Location, start, end time.Time, handler func(loopPkt []byte) error) error {
+	r := Open(baseDir, start, end)
+	defer r.Close()
+	r.Location = loc
+	r.Filter = OfType(TypeLoop)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = handler(rec.Stamped())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// openFile opens a recording, gunzipping it if it ends in .gz
+func openFile(fileName string) (io.ReadCloser, error) {
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening %v: %w", fileName, err)
+	}
+	if !strings.HasSuffix(fileName, ".gz") {
+		return f, nil
+	}
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading %v: %w", fileName, err)
+	}
+	return &gzipFile{Reader: gz, f: f}, nil
+}
+
+// gzipFile closes the file under the gzip reader too
+type gzipFile struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g *gzipFile) Close() error {
+	g.Reader.Close()
+	return g.f.Close()
+}
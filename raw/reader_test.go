@@ -0,0 +1,181 @@
+package raw
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func TestRead(t *testing.T) {
+	baseDir := t.TempDir()
+	recorder := NewRecorder(baseDir)
+	start := time.Date(2021, 6, 1, 12, 30, 0, 0, time.Local)
+	// a packet every 10 minutes for 3 hours
+	for i := 0; i < 18; i++ {
+		pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+		binary.LittleEndian.PutUint64(pkt, uint64(start.Add(time.Duration(i)*10*time.Minute).UnixNano()))
+		pkt[8+14] = byte(i)
+		recorder.Record(pkt)
+	}
+	recorder.Shutdown()
+
+	var winds []int
+	err := Read(baseDir, nil, start.Add(time.Hour), start.Add(2*time.Hour), func(loopPkt []byte) error {
+		winds = append(winds, vantage.ParseLoop(loopPkt).Wind)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winds) != 6 || winds[0] != 6 || winds[5] != 11 {
+		t.Fatalf("expected packets 6 to 11 got %v", winds)
+	}
+}
+
+func TestReadAcrossFallBack(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("no zone data: %v", err)
+	}
+	baseDir := t.TempDir()
+	recorder := NewRecorder(baseDir)
+	recorder.Location = loc
+	// 00:30 PDT to 02:30 PST is 3 hours with 01:00 twice
+	start := time.Date(2021, 11, 7, 0, 30, 0, 0, loc)
+	for i := 0; i < 18; i++ {
+		pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+		binary.LittleEndian.PutUint64(pkt, uint64(start.Add(time.Duration(i)*10*time.Minute).UnixNano()))
+		pkt[8+14] = byte(i)
+		recorder.Record(pkt)
+	}
+	recorder.Shutdown()
+
+	dayDir := filepath.Join(baseDir, "2021", "11", "07")
+	for _, name := range []string{"00-0700.rec", "01-0700.rec", "01-0800.rec", "02-0800.rec"} {
+		if _, err = os.Stat(filepath.Join(dayDir, name)); err != nil {
+			t.Fatalf("expected %v: %v", name, err)
+		}
+	}
+	// files from before the offset was in the name are still read
+	err = os.Rename(filepath.Join(dayDir, "02-0800.rec"), filepath.Join(dayDir, "02.rec"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var winds []int
+	err = Read(baseDir, loc, start, start.Add(3*time.Hour), func(loopPkt []byte) error {
+		winds = append(winds, vantage.ParseLoop(loopPkt).Wind)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(winds) != 18 {
+		t.Fatalf("expected 18 packets got %v", winds)
+	}
+	for i, wind := range winds {
+		if wind != i {
+			t.Fatalf("packets out of order %v", winds)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	baseDir := t.TempDir()
+	recorder := NewRecorder(baseDir)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	// a packet every 10 minutes for 3 hours with an archive page each hour
+	for i := 0; i < 18; i++ {
+		at := start.Add(time.Duration(i) * 10 * time.Minute)
+		recorder.Record(testLoopPkt(at, i))
+		if i%6 == 5 {
+			recorder.RecordPacket(&Record{Type: TypeArchivePage, Time: at.Add(time.Second), Data: []byte{byte(i)}})
+		}
+	}
+	// late, in an hour that's already written
+	recorder.Record(testLoopPkt(start.Add(5*time.Minute), 50))
+	recorder.Shutdown()
+
+	r := Open(baseDir, start, start.Add(3*time.Hour))
+	defer r.Close()
+	var records []*Record
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rec)
+	}
+	if len(records) != 22 {
+		t.Fatalf("expected 22 records got %v", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Time.Before(records[i-1].Time) {
+			t.Fatalf("record %v at %v is before the one before it", i, records[i].Time)
+		}
+	}
+	if records[1].Loop().Wind != 50 || records[7].Type != TypeArchivePage || records[7].Loop() != nil {
+		t.Fatalf("unexpected records %+v %+v", records[1], records[7])
+	}
+
+	// just the loop packets from the middle of the second hour, then back
+	r.Filter = OfType(TypeLoop)
+	r.Seek(start.Add(90 * time.Minute))
+	rec, err := r.Next()
+	if err != nil || rec.Loop().Wind != 9 {
+		t.Fatalf("expected packet 9 got %+v %v", rec, err)
+	}
+	r.Seek(start.Add(50 * time.Minute))
+	winds := []int{}
+	for {
+		rec, err = r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		winds = append(winds, rec.Loop().Wind)
+	}
+	if len(winds) != 13 || winds[0] != 5 || winds[12] != 17 {
+		t.Fatalf("expected packets 5 to 17 got %v", winds)
+	}
+}
+
+func TestReaderHalfHourZone(t *testing.T) {
+	baseDir := t.TempDir()
+	loc := time.FixedZone("IST", 5*3600+30*60)
+	recorder := NewRecorder(baseDir)
+	recorder.Location = loc
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, loc)
+	for i, minutes := range []int{10, 50, 65} {
+		recorder.Record(testLoopPkt(start.Add(time.Duration(minutes)*time.Minute), i))
+	}
+	recorder.Shutdown()
+
+	r := Open(baseDir, start.Add(15*time.Minute), start.Add(75*time.Minute))
+	defer r.Close()
+	r.Location = loc
+	winds := []int{}
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		winds = append(winds, rec.Loop().Wind)
+	}
+	if len(winds) != 2 || winds[0] != 1 || winds[1] != 2 {
+		t.Fatalf("expected packets 1 and 2 got %v", winds)
+	}
+}
@@ -1,22 +1,28 @@
 package raw
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path"
 	"strconv"
 	"sync"
 	"time"
-
-	"github.com/smw1218/windygo/vantage"
 )
 
-// Recorder records raw loop packets to files with a timestamp
+// Recorder records raw packets to an hour's file in the version 2 format
 type Recorder struct {
+	// Location is the station time zone the files are named in, nil is
+	// time.Local
+	Location *time.Location
+	// Station goes in the file headers
+	Station     string
 	baseDir     string
 	writeMutex  sync.Mutex
 	currentFile *os.File
+	encoder     *Encoder
 }
 
 func NewRecorder(baseDir string) *Recorder {
@@ -39,17 +45,23 @@ func (r *Recorder) Shutdown() {
 	}
 }
 
+// Record records a loop handler's packet, the receive time then the LOOP
+// packet
 func (r *Recorder) Record(loopPkt []byte) {
-	loopRecord := vantage.ParseLoop(loopPkt)
+	r.RecordPacket(LoopRecord(loopPkt))
+}
+
+// RecordPacket records a packet of any type
+func (r *Recorder) RecordPacket(rec *Record) {
 	r.writeMutex.Lock()
 	defer r.writeMutex.Unlock()
-	fn := r.fileName(loopRecord.Recorded)
+	fn := r.fileName(rec.Time)
 	err := r.ensureCurrentFile(fn)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	_, err = r.currentFile.Write(loopPkt)
+	err = r.encoder.Encode(rec)
 	if err != nil {
 		log.Printf("Error writing to file %v: %v", fn, err)
 		return
@@ -69,17 +81,77 @@ func (r *Recorder) ensureCurrentFile(fileName string) error {
 			if err != nil {
 				log.Printf("Error closing file %v: %v", r.currentFile.Name(), err)
 			}
+			r.currentFile, r.encoder = nil, nil
 		}
 
 		newFile, err := r.open(fileName)
 		if err != nil {
 			return fmt.Errorf("error opening file %v: %v", fileName, err)
 		}
-		r.currentFile = newFile
+		// a version 2 file is appended to as it is; a new file, or one
+		// from before version 2, gets a header first
+		version, err := repairEnd(fileName)
+		if err != nil {
+			log.Printf("Error checking the end of %v: %v", fileName, err)
+		}
+		var header *Header
+		if version != Version2 {
+			header = &Header{Station: r.Station, TimeZone: r.location().String(), Created: time.Now().UTC()}
+		}
+		encoder, err := NewEncoder(newFile, header)
+		if err != nil {
+			// left closed so the next packet tries again
+			newFile.Close()
+			return fmt.Errorf("error starting file %v: %v", fileName, err)
+		}
+		r.currentFile, r.encoder = newFile, encoder
 	}
 	return nil
 }
 
+// repairEnd truncates a record cut short at the end of the file, like by a
+// crash, so the records appended after it can be read. It returns the
+// version the file ends in, 0 if it's empty or doesn't exist.
+func repairEnd(fileName string) (int, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, err
+	}
+	d := NewDecoder(f)
+	for {
+		_, err = d.Next()
+		if err == io.EOF {
+			return d.Version(), nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil && !errors.Is(err, ErrChecksum) {
+			return d.Version(), err
+		}
+	}
+	log.Printf("Truncating a partial record at the end of %v", fileName)
+	if err = f.Truncate(d.Offset()); err != nil {
+		return 0, err
+	}
+	return d.Version(), nil
+}
+
+func (r *Recorder) location() *time.Location {
+	if r.Location == nil {
+		return time.Local
+	}
+	return r.Location
+}
+
 func (r *Recorder) open(fileName string) (*os.File, error) {
 	dir := path.Dir(fileName)
 	err := os.MkdirAll(dir, 0755)
@@ -89,12 +161,36 @@ func (r *Recorder) open(fileName string) (*os.File, error) {
 	return os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 }
 
-// baseDir/<year>/<month>/<day>/<hour>.rec
 func (r *Recorder) fileName(now time.Time) string {
-	return path.Join(r.baseDir,
-		strconv.Itoa(now.Year()),
-		fmt.Sprintf("%02d", now.Month()),
-		fmt.Sprintf("%02d", now.Day()),
-		fmt.Sprintf("%02d.rec", now.Hour()),
+	return FileName(r.baseDir, now, r.Location)
+}
+
+// FileName is the file packets recorded at t are in:
+// baseDir/<year>/<month>/<day>/<hour><offset>.rec in the station zone, like
+// 2021/11/07/01-0700.rec. The offset puts the hour repeated when DST ends in
+// its own file. A nil loc is time.Local.
+func FileName(baseDir string, t time.Time, loc *time.Location) string {
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	return path.Join(dayDir(baseDir, t), fmt.Sprintf("%02d%v.rec", t.Hour(), t.Format("-0700")))
+}
+
+// legacyFileName is the name files had before the offset was added; both
+// hours were appended to one file when DST ended
+func legacyFileName(baseDir string, t time.Time, loc *time.Location) string {
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	return path.Join(dayDir(baseDir, t), fmt.Sprintf("%02d.rec", t.Hour()))
+}
+
+func dayDir(baseDir string, t time.Time) string {
+	return path.Join(baseDir,
+		strconv.Itoa(t.Year()),
+		fmt.Sprintf("%02d", t.Month()),
+		fmt.Sprintf("%02d", t.Day()),
 	)
 }
@@ -0,0 +1,73 @@
+package raw
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Player replays recorded packets to a handler at the pace they were
+// recorded, or faster
+type Player struct {
+	BaseDir string
+	// Location is the station time zone the files are named in, nil is
+	// time.Local
+	Location *time.Location
+	// Speed is how many times faster than recorded to play, like 60 for an
+	// hour a minute; 0 plays as fast as the handler takes them
+	Speed float64
+	// Shift moves every packet's timestamp by the same amount so the first
+	// one is when the replay started, instead of when it was recorded
+	Shift bool
+	// Stop ends the replay early when closed; it may be nil
+	Stop <-chan struct{}
+}
+
+// Play sends the packets recorded from start up to end to handler and
+// returns how many it sent. The packets handler gets are copies, so it may
+// keep them.
+func (p *Player) Play(start, end time.Time, handler func(loopPkt []byte)) (int, error) {
+	if p.Speed < 0 {
+		return 0, fmt.Errorf("bad replay speed %v", p.Speed)
+	}
+	var first, began time.Time
+	played := 0
+	err := Read(p.BaseDir, p.Location, start, end, func(loopPkt []byte) error {
+		recorded := vantage.ParseLoop(loopPkt).Recorded
+		if first.IsZero() {
+			first, began = recorded, time.Now()
+		}
+		if p.Speed > 0 {
+			due := began.Add(time.Duration(float64(recorded.Sub(first)) / p.Speed))
+			if wait := time.Until(due); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-p.Stop:
+					timer.Stop()
+					return errStopped
+				}
+			}
+		}
+		select {
+		case <-p.Stop:
+			return errStopped
+		default:
+		}
+		pkt := append([]byte(nil), loopPkt...)
+		if p.Shift {
+			binary.LittleEndian.PutUint64(pkt, uint64(recorded.Add(began.Sub(first)).UnixNano()))
+		}
+		handler(pkt)
+		played++
+		return nil
+	})
+	if err == errStopped {
+		err = nil
+	}
+	return played, err
+}
+
+var errStopped = fmt.Errorf("replay stopped")
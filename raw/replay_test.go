@@ -0,0 +1,62 @@
+package raw
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func TestPlay(t *testing.T) {
+	baseDir := t.TempDir()
+	recorder := NewRecorder(baseDir)
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	// a packet every 2 seconds for a minute
+	for i := 0; i < 30; i++ {
+		pkt := make([]byte, vantage.LOOP_RECORD_SIZE)
+		binary.LittleEndian.PutUint64(pkt, uint64(start.Add(time.Duration(i)*2*time.Second).UnixNano()))
+		pkt[8+14] = byte(i)
+		recorder.Record(pkt)
+	}
+	recorder.Shutdown()
+
+	var records []*vantage.LoopRecord
+	handler := func(loopPkt []byte) {
+		records = append(records, vantage.ParseLoop(loopPkt))
+	}
+	// a minute in 100ms
+	player := &Player{BaseDir: baseDir, Speed: 600}
+	began := time.Now()
+	played, err := player.Play(start, start.Add(time.Hour), handler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(began); elapsed < 90*time.Millisecond {
+		t.Fatalf("played a minute at 600x in %v", elapsed)
+	}
+	if played != 30 || len(records) != 30 || records[29].Wind != 29 || !records[29].Recorded.Equal(start.Add(58*time.Second)) {
+		t.Fatalf("unexpected replay %v %+v", played, records[29])
+	}
+
+	// shifted to now as fast as possible
+	records = nil
+	player = &Player{BaseDir: baseDir, Shift: true}
+	began = time.Now()
+	if played, err = player.Play(start, start.Add(time.Hour), handler); err != nil || played != 30 {
+		t.Fatalf("unexpected replay %v %v", played, err)
+	}
+	if first := records[0].Recorded; first.Before(began) || first.After(time.Now()) {
+		t.Fatalf("expected the first packet shifted to %v got %v", began, first)
+	}
+	if gap := records[29].Recorded.Sub(records[0].Recorded); gap != 58*time.Second {
+		t.Fatalf("expected the packets 58s apart got %v", gap)
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	player = &Player{BaseDir: baseDir, Stop: stop}
+	if played, err = player.Play(start, start.Add(time.Hour), handler); err != nil || played != 0 {
+		t.Fatalf("expected a stopped replay got %v %v", played, err)
+	}
+}
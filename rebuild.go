@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smw1218/windygo/raw"
+	"github.com/smw1218/windygo/rollup"
+	"github.com/smw1218/windygo/vantage"
+)
+
+// rebuild runs "windygo rebuild -from <time> -to <time>". It reads the raw
+// recordings for the range and saves the summaries made from them, replacing
+// the ones already saved. The range is widened to whole periods of the
+// longest interval so no summary is rebuilt from part of its packets. The
+// hourly and daily summaries retention made from the range are made again.
+func rebuild(cfg storeConfig, rawDir string, intervalsFlag, policyFlag string, args []string) error {
+	live, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet("rebuild", flag.ContinueOnError)
+	from := flags.String("from", "", "start of the range, 2006-01-02 or 2006-01-02T15:04 station time")
+	to := flags.String("to", "", "end of the range, defaults to now")
+	flags.StringVar(&intervalsFlag, "intervals", intervalsFlag, "summary intervals to rebuild")
+	calibrate := flags.String("calibrate", "", "corrections like wind=1.05,direction=-10,temp=-0.5,humidity=3,barometer=0.02")
+	err = flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if rawDir == "" {
+		return fmt.Errorf("rebuild needs the raw directory, set -raw")
+	}
+	if *from == "" {
+		return fmt.Errorf("rebuild needs -from")
+	}
+	start, err := parseLocalTime(*from, cfg.location)
+	if err != nil {
+		return err
+	}
+	end := time.Now()
+	if *to != "" {
+		end, err = parseLocalTime(*to, cfg.location)
+		if err != nil {
+			return err
+		}
+	}
+	intervals, err := rollup.ParseIntervals(intervalsFlag)
+	if err != nil {
+		return err
+	}
+	calibration, err := vantage.ParseCalibration(*calibrate)
+	if err != nil {
+		return err
+	}
+
+	longest := intervals[0]
+	for _, interval := range intervals {
+		if interval > longest {
+			longest = interval
+		}
+	}
+	start = rollup.PeriodStart(start, longest, cfg.location)
+	if rounded := rollup.PeriodStart(end, longest, cfg.location); !rounded.Equal(end) {
+		end = rollup.PeriodEnd(rounded, longest, cfg.location)
+	}
+
+	clock := vantage.NewClock(cfg.location)
+	engine := rollup.NewEngine(intervals)
+	engine.Location = cfg.location
+	var saved int
+	engine.AddSink(rollup.SinkFunc(func(s *rollup.Summary) error {
+		saved++
+		return nil
+	}))
+	store, err := openStore(cfg, clock, engine, nil)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	log.Printf("Rebuilding %v summaries from %v to %v", intervals, start, end)
+	var packets int
+	day := rollup.PeriodStart(start, 24*time.Hour, cfg.location)
+	err = raw.Read(rawDir, cfg.location, start, end, func(loopPkt []byte) error {
+		loopRecord := clock.ParseLoop(loopPkt)
+		calibration.Apply(loopRecord)
+		if d := rollup.PeriodStart(loopRecord.Recorded, 24*time.Hour, cfg.location); d.After(day) {
+			log.Printf("Rebuilt up to %v, %v packets, %v summaries", d, packets, saved)
+			day = d
+		}
+		packets++
+		return engine.Record(loopRecord)
+	})
+	if err == nil {
+		err = engine.FlushAll()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Rebuilt %v summaries from %v packets", saved, packets)
+	return regenerate(store, cfg, policyFlag, live, start, end)
+}
+
+// parseLocalTime parses a date or a date and time in the station zone
+func parseLocalTime(value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		t, err := time.ParseInLocation(layout, value, loc)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q, use 2006-01-02 or 2006-01-02T15:04", value)
+}
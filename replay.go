@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/smw1218/windygo/raw"
+	"github.com/smw1218/windygo/rollup"
+)
+
+// replayConfig is the flags for replaying raw recordings through the
+// pipeline in place of the console
+type replayConfig struct {
+	from  string
+	to    string
+	speed float64
+	shift bool
+}
+
+// run plays the raw recordings in rawDir from cfg.from to cfg.to through
+// handler, then saves the periods the last packets were in. Periods are
+// closed by the packets, not the wall clock, since the packets aren't from
+// now unless they're shifted.
+func (cfg replayConfig) run(rawDir string, loc *time.Location, engine *rollup.Engine, handler func(loopPkt []byte), stop <-chan struct{}) error {
+	if rawDir == "" {
+		return fmt.Errorf("replay needs the raw directory, set -raw")
+	}
+	start, err := parseLocalTime(cfg.from, loc)
+	if err != nil {
+		return err
+	}
+	end := start.Add(24 * time.Hour)
+	if cfg.to != "" {
+		end, err = parseLocalTime(cfg.to, loc)
+		if err != nil {
+			return err
+		}
+	}
+	player := &raw.Player{
+		BaseDir:  rawDir,
+		Location: loc,
+		Speed:    cfg.speed,
+		Shift:    cfg.shift,
+		Stop:     stop,
+	}
+	log.Printf("Replaying %v to %v at %vx", start, end, cfg.speed)
+	played, err := player.Play(start, end, handler)
+	if err != nil {
+		return err
+	}
+	log.Printf("Replayed %v packets", played)
+	return engine.FlushAll()
+}
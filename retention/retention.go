@@ -0,0 +1,370 @@
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+	"github.com/smw1218/windygo/rollup"
+)
+
+// DefaultPolicy keeps the minute summaries for a month and the 5 and 10
+// minute ones for half a year. Hourly and daily summaries are made from
+// them and kept forever.
+const DefaultPolicy = "1m=30d,5m=180d,10m=180d,1h,24h"
+
+// Tier is one summary interval and how long it's kept
+type Tier struct {
+	Interval time.Duration
+	Keep     time.Duration // 0 keeps it forever
+}
+
+// Policy is how long each tier is kept
+type Policy struct {
+	Tiers []Tier // shortest interval first
+	// LoopRecords is how long loop records are kept, 0 is forever
+	LoopRecords time.Duration
+}
+
+// ParsePolicy parses a comma separated list of interval=keep like
+// "1m=30d,5m=180d,1h". Keep is a duration that can also be in days (d); a
+// tier without one is kept forever. "loop=7d" sets how long loop records
+// are kept.
+func ParsePolicy(policy string) (*Policy, error) {
+	p := &Policy{}
+	for _, part := range strings.Split(policy, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		var keep time.Duration
+		if len(kv) == 2 {
+			var err error
+			keep, err = ParseDays(kv[1])
+			if err != nil {
+				return nil, fmt.Errorf("bad retention %q: %w", part, err)
+			}
+		}
+		if kv[0] == "loop" {
+			p.LoopRecords = keep
+			continue
+		}
+		intervals, err := rollup.ParseIntervals(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		p.Tiers = append(p.Tiers, Tier{Interval: intervals[0], Keep: keep})
+	}
+	sort.Slice(p.Tiers, func(i, j int) bool { return p.Tiers[i].Interval < p.Tiers[j].Interval })
+	return p, nil
+}
+
+// ParseDays parses a duration that can also be a whole number of days like 30d
+func ParseDays(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Job makes the summaries of the tiers that aren't made live from the
+// tiers below them, then deletes the summaries that are older than their
+// tier keeps. Generated summaries are aligned like the live ones so a day
+// is a day in Location.
+type Job struct {
+	Store  db.Store
+	Policy *Policy
+	// Location is the station time zone, nil for UTC
+	Location *time.Location
+	// Live are the intervals the rollup engine makes; the other tiers are
+	// generated
+	Live []time.Duration
+	// DryRun reports what would be generated and deleted without
+	// changing anything
+	DryRun bool
+	// mutex guards stop and done, which are set while the loop is running
+	mutex sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewJob(store db.Store, policy *Policy, live []time.Duration) *Job {
+	return &Job{
+		Store:  store,
+		Policy: policy,
+		Live:   live,
+	}
+}
+
+// batchPeriods is how many generated periods are read and saved at a time
+const batchPeriods = 24
+
+// errStopped is returned from a pass that Stop cut short
+var errStopped = errors.New("retention job stopped")
+
+// Run generates and prunes once, logging its progress
+func (j *Job) Run(now time.Time) error {
+	return j.run(now, nil)
+}
+
+// run is Run that gives up between batches once stop is closed
+func (j *Job) run(now time.Time, stop <-chan struct{}) error {
+	prefix := ""
+	if j.DryRun {
+		prefix = "Dry run: "
+	}
+
+	for i, tier := range j.Policy.Tiers {
+		if j.isLive(tier.Interval) {
+			continue
+		}
+		if stopped(stop) {
+			return errStopped
+		}
+		source, ok := j.source(i)
+		if !ok {
+			log.Printf("%vNo shorter tier divides %v, not generating it", prefix, tier.Interval)
+			continue
+		}
+		generated, err := j.generate(tier.Interval, source, now, prefix, stop)
+		if err != nil {
+			return err
+		}
+		log.Printf("%vGenerated %v %v summaries from %v", prefix, generated, tier.Interval, source)
+	}
+
+	for _, tier := range j.Policy.Tiers {
+		if tier.Keep <= 0 {
+			continue
+		}
+		if stopped(stop) {
+			return errStopped
+		}
+		before := now.Add(-tier.Keep)
+		deleted, err := j.Store.DeleteSummaries(before, int(tier.Interval/time.Second), j.DryRun)
+		if err != nil {
+			return err
+		}
+		log.Printf("%vPruned %v %v summaries from before %v", prefix, deleted, tier.Interval, before)
+	}
+	if j.Policy.LoopRecords > 0 {
+		if stopped(stop) {
+			return errStopped
+		}
+		before := now.Add(-j.Policy.LoopRecords)
+		deleted, err := j.Store.DeleteLoopRecords(before, j.DryRun)
+		if err != nil {
+			return err
+		}
+		log.Printf("%vPruned %v loop records from before %v", prefix, deleted, before)
+	}
+	return nil
+}
+
+// stopped reports whether stop is closed; a nil stop never is
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (j *Job) isLive(interval time.Duration) bool {
+	for _, live := range j.Live {
+		if live == interval {
+			return true
+		}
+	}
+	return false
+}
+
+// source is the longest shorter tier that divides tier i evenly
+func (j *Job) source(i int) (time.Duration, bool) {
+	interval := j.Policy.Tiers[i].Interval
+	for k := i - 1; k >= 0; k-- {
+		if shorter := j.Policy.Tiers[k].Interval; interval%shorter == 0 {
+			return shorter, true
+		}
+	}
+	return 0, false
+}
+
+// generate merges the source summaries into interval summaries for every
+// finished period after the last one generated, stopping between batches
+// once stop is closed
+func (j *Job) generate(interval, source time.Duration, now time.Time, prefix string, stop <-chan struct{}) (int, error) {
+	secs := int(interval / time.Second)
+	_, last, err := j.Store.SummaryTimes(secs)
+	if err != nil {
+		return 0, err
+	}
+	start := rollup.PeriodEnd(last, interval, j.Location)
+	if last.IsZero() {
+		first, _, err := j.Store.SummaryTimes(int(source / time.Second))
+		if err != nil || first.IsZero() {
+			return 0, err
+		}
+		start = rollup.PeriodStart(first, interval, j.Location)
+	}
+	// leave time for the last source summary to close
+	end := rollup.PeriodStart(now.Add(-source-time.Minute), interval, j.Location)
+	return j.generateRange(interval, source, start, end, prefix, stop, false)
+}
+
+// Regenerate makes the generated tiers' summaries from start up to end
+// again, for when rebuild or an archive fill has changed the summaries
+// they're made from. Only the periods Run has already generated are redone.
+// A period is only replaced if its summaries now have at least as many
+// measurements as before, since the older ones may have been pruned.
+func (j *Job) Regenerate(start, end time.Time) (int, error) {
+	prefix := ""
+	if j.DryRun {
+		prefix = "Dry run: "
+	}
+	regenerated := 0
+	for i, tier := range j.Policy.Tiers {
+		if j.isLive(tier.Interval) {
+			continue
+		}
+		source, ok := j.source(i)
+		if !ok {
+			continue
+		}
+		_, last, err := j.Store.SummaryTimes(int(tier.Interval / time.Second))
+		if err != nil {
+			return regenerated, err
+		}
+		if last.IsZero() {
+			continue
+		}
+		to := rollup.PeriodStart(end, tier.Interval, j.Location)
+		if to.Before(end) {
+			to = rollup.PeriodEnd(to, tier.Interval, j.Location)
+		}
+		if generatedEnd := rollup.PeriodEnd(last, tier.Interval, j.Location); to.After(generatedEnd) {
+			to = generatedEnd
+		}
+		n, err := j.generateRange(tier.Interval, source, rollup.PeriodStart(start, tier.Interval, j.Location), to, prefix, nil, true)
+		regenerated += n
+		if err != nil {
+			return regenerated, err
+		}
+		log.Printf("%vRegenerated %v %v summaries from %v", prefix, n, tier.Interval, source)
+	}
+	return regenerated, nil
+}
+
+// generateRange merges the source summaries into interval summaries for the
+// periods from start up to end. With replace only the periods the source
+// covers at least as well as the summary already saved are saved.
+func (j *Job) generateRange(interval, source time.Duration, start, end time.Time, prefix string, stop <-chan struct{}, replace bool) (int, error) {
+	if !start.Before(end) {
+		return 0, nil
+	}
+	total := int(end.Sub(start) / interval)
+	done, generated := 0, 0
+	for batchStart := start; batchStart.Before(end); {
+		if stopped(stop) {
+			return generated, errStopped
+		}
+		batchEnd := batchStart
+		for i := 0; i < batchPeriods && batchEnd.Before(end); i++ {
+			batchEnd = rollup.PeriodEnd(batchEnd, interval, j.Location)
+		}
+		ss, err := j.Store.GetSummaryRange(batchStart, batchEnd, int(source/time.Second))
+		if err != nil {
+			return generated, err
+		}
+		var saved map[int64]*db.Summary
+		if replace {
+			old, err := j.Store.GetSummaryRange(batchStart, batchEnd, int(interval/time.Second))
+			if err != nil {
+				return generated, err
+			}
+			saved = make(map[int64]*db.Summary, len(old))
+			for _, s := range old {
+				saved[s.StartTime.Unix()] = s
+			}
+		}
+		for period := batchStart; period.Before(batchEnd); period = rollup.PeriodEnd(period, interval, j.Location) {
+			done++
+			merged := rollup.Merge(period, interval, j.Location, ss)
+			if merged == nil {
+				continue
+			}
+			if old := saved[period.Unix()]; old != nil && merged.Measurements < old.Measurements {
+				continue
+			}
+			generated++
+			if j.DryRun {
+				continue
+			}
+			err = j.Store.SaveSummary(merged)
+			if err != nil {
+				return generated, err
+			}
+		}
+		log.Printf("%vGenerating %v summaries: %v/%v periods, up to %v", prefix, interval, done, total, batchEnd)
+		batchStart = batchEnd
+	}
+	return generated, nil
+}
+
+// Start runs the job now and then every interval until Stop
+func (j *Job) Start(every time.Duration) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.stop != nil {
+		return
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+	go j.loop(every, j.stop, j.done)
+}
+
+func (j *Job) loop(every time.Duration, stop, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		err := j.run(time.Now(), stop)
+		if err == errStopped {
+			return
+		}
+		if err != nil {
+			log.Printf("Retention error: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Stop ends the loop, cutting a pass short after the batch it's on, and
+// waits for it so the store can be closed
+func (j *Job) Stop() {
+	j.mutex.Lock()
+	stop, done := j.stop, j.done
+	j.stop, j.done = nil, nil
+	j.mutex.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
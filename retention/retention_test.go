@@ -0,0 +1,154 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/db"
+)
+
+func TestJob(t *testing.T) {
+	policy, err := ParsePolicy("1m=2d,1h,loop=7d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Tiers) != 2 || policy.Tiers[0].Keep != 48*time.Hour || policy.Tiers[1].Keep != 0 || policy.LoopRecords != 7*24*time.Hour {
+		t.Fatalf("unexpected policy %+v", policy)
+	}
+
+	store := db.NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// two hours of minutes
+	for i := 0; i < 120; i++ {
+		err = store.SaveSummary(&db.Summary{
+			StartTime:            start.Add(time.Duration(i) * time.Minute),
+			EndTime:              start.Add(time.Duration(i+1) * time.Minute),
+			SummarySeconds:       60,
+			Measurements:         30,
+			ExpectedMeasurements: 30,
+			WindAvg:              float64(i / 60 * 10),
+			WindGust:             float64(i),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	job := NewJob(store, policy, []time.Duration{time.Minute})
+	job.DryRun = true
+	if err = job.Run(start.Add(72 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, last, _ := store.SummaryTimes(60); last.IsZero() {
+		t.Fatal("dry run deleted summaries")
+	}
+
+	job.DryRun = false
+	if err = job.Run(start.Add(72 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	hours, err := store.GetSummaryRange(start, start.Add(2*time.Hour), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 2 || hours[0].WindAvg != 0 || hours[1].WindAvg != 10 || hours[1].WindGust != 119 ||
+		hours[1].Measurements != 1800 || hours[1].Partial {
+		t.Fatalf("unexpected hourly summaries %+v", hours)
+	}
+	if first, _, _ := store.SummaryTimes(60); !first.IsZero() {
+		t.Fatal("minute summaries should be pruned")
+	}
+}
+
+// stoppingStore closes stop when the job reads its first batch
+type stoppingStore struct {
+	db.Store
+	stop  chan struct{}
+	reads int
+}
+
+func (s *stoppingStore) GetSummaryRange(start, end time.Time, summarySeconds int) ([]*db.Summary, error) {
+	s.reads++
+	if s.reads == 1 {
+		close(s.stop)
+	}
+	return s.Store.GetSummaryRange(start, end, summarySeconds)
+}
+
+func TestStopBetweenBatches(t *testing.T) {
+	policy, err := ParsePolicy("1m=1d,1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := db.NewMemory()
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	// three days of minutes is three batches of hours
+	for i := 0; i < 3*24*60; i++ {
+		err = memory.SaveSummary(&db.Summary{
+			StartTime:      start.Add(time.Duration(i) * time.Minute),
+			EndTime:        start.Add(time.Duration(i+1) * time.Minute),
+			SummarySeconds: 60,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store := &stoppingStore{Store: memory, stop: make(chan struct{})}
+	job := NewJob(store, policy, []time.Duration{time.Minute})
+	if err = job.run(start.Add(4*24*time.Hour), store.stop); err != errStopped {
+		t.Fatalf("expected errStopped got %v", err)
+	}
+	if store.reads != 1 {
+		t.Fatalf("expected 1 batch read got %v", store.reads)
+	}
+	if first, _, _ := memory.SummaryTimes(60); !first.Equal(start) {
+		t.Fatal("a stopped pass shouldn't prune")
+	}
+}
+
+func TestRegenerate(t *testing.T) {
+	policy, err := ParsePolicy("1m=2d,1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := db.NewMemory()
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	saveMinutes := func(from, to int, wind float64) {
+		for i := from; i < to; i++ {
+			err := store.SaveSummary(&db.Summary{
+				StartTime:            start.Add(time.Duration(i) * time.Minute),
+				EndTime:              start.Add(time.Duration(i+1) * time.Minute),
+				SummarySeconds:       60,
+				Measurements:         30,
+				ExpectedMeasurements: 30,
+				WindAvg:              wind,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	saveMinutes(0, 120, 10)
+	job := NewJob(store, policy, []time.Duration{time.Minute})
+	if err = job.Run(start.Add(72 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// rebuilt minutes for the first hour, a few filled in the second after
+	// its minutes were pruned and some past the hours generated so far
+	saveMinutes(0, 60, 20)
+	saveMinutes(60, 65, 30)
+	saveMinutes(120, 180, 40)
+	n, err := job.Regenerate(start, start.Add(3*time.Hour))
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 regenerated got %v %v", n, err)
+	}
+	hours, err := store.GetSummaryRange(start, start.Add(3*time.Hour), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 2 || hours[0].WindAvg != 20 || hours[1].WindAvg != 10 || hours[1].Measurements != 1800 {
+		t.Fatalf("unexpected hourly summaries %+v", hours)
+	}
+}
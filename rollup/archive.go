@@ -0,0 +1,87 @@
+package rollup
+
+import (
+	"math"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+// Sources of summaries
+const (
+	SourceLoop    = "loop"
+	SourceArchive = "archive"
+)
+
+// FromArchive makes a coarse summary for the period from the console's
+// archive records, for when there were no loop packets. Each record covers
+// archivePeriod up to its HostTime; records that don't overlap the period
+// are ignored. The archive only has averages so the lull is the lowest
+// average and there's no speed deviation. Rain is split in proportion to
+// how much of each record's period overlaps. A summary shorter than
+// archivePeriod, or with less than PartialCoverage of it covered, is
+// Partial since it's an average over more than its period. Daily periods end
+// at the next midnight in period's zone. It returns nil if no records
+// overlap.
+func FromArchive(period time.Time, interval, archivePeriod time.Duration, records []*vantage.ArchiveRecord) *Summary {
+	end := PeriodEnd(period, interval, period.Location())
+	r := NewRollup(period, interval)
+	var windMax, rainRateMax int
+	var rain, covered float64
+	tempMin, tempMax := math.MaxFloat64, -math.MaxFloat64
+	for _, ar := range records {
+		start := ar.HostTime.Add(-archivePeriod)
+		overlap := minTime(ar.HostTime, end).Sub(maxTime(start, period))
+		if overlap <= 0 {
+			continue
+		}
+		covered += float64(overlap)
+		rain += float64(ar.Rainfall) * float64(overlap) / float64(archivePeriod)
+		if ar.WindMax > windMax {
+			windMax = ar.WindMax
+		}
+		if ar.HighRainRate > rainRateMax {
+			rainRateMax = ar.HighRainRate
+		}
+		tempMin = math.Min(tempMin, float64(ar.LowOutsideTemp))
+		tempMax = math.Max(tempMax, float64(ar.HighOutsideTemp))
+		r.Update(&vantage.LoopRecord{
+			Recorded:        ar.HostTime,
+			Wind:            ar.WindAvg,
+			WindDirection:   ar.WindDir,
+			BarometerRaw:    int(math.Round(float64(ar.Barometer) * 1000)),
+			InsideTempRaw:   int(math.Round(float64(ar.InsideTemp) * 10)),
+			OutsideTempRaw:  int(math.Round(float64(ar.OutsideTemp) * 10)),
+			InsideHumidity:  ar.InsideHumidity,
+			OutsideHumidity: ar.OutsideHumidity,
+		})
+	}
+	if r.Count == 0 {
+		return nil
+	}
+	s := r.Summary()
+	s.Source = SourceArchive
+	s.ExpectedMeasurements = int64(math.Ceil(float64(interval) / float64(archivePeriod)))
+	s.Partial = archivePeriod > interval || covered < PartialCoverage*float64(end.Sub(period))
+	s.WindGust = float64(windMax)
+	s.WindStddev = 0
+	s.OutsideTempMin = tempMin
+	s.OutsideTempMax = tempMax
+	s.RainTotal = rain / 100
+	s.RainRateMax = float64(rainRateMax) / 100
+	return s
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,265 @@
+package rollup
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+// DefaultIntervals are the summaries windygo has always made. The plots
+// need the 1 and 5 minute summaries.
+var DefaultIntervals = []time.Duration{time.Minute, 5 * time.Minute, 10 * time.Minute}
+
+// Aggregator adds custom values to summaries, usually in Summary.Extra.
+// A new one is made by its AggregatorFactory for each rollup period.
+type Aggregator interface {
+	Update(loopRecord *vantage.LoopRecord)
+	Summarize(s *Summary)
+}
+
+type AggregatorFactory func() Aggregator
+
+// Sink receives completed summaries. All the stores are sinks.
+type Sink interface {
+	SaveSummary(s *Summary) error
+}
+
+// SinkFunc adapts a function to a Sink
+type SinkFunc func(s *Summary) error
+
+func (f SinkFunc) SaveSummary(s *Summary) error {
+	return f(s)
+}
+
+// closeGrace is how long after the end of a period the timer waits for
+// packets before closing it; packets come every couple of seconds
+const closeGrace = 5 * time.Second
+
+// Engine keeps a rollup for each interval and sends the summary to every sink
+// when the interval is done. Intervals are closed by the next packet or by
+// the wall clock (see Start) so a summary isn't held back when packets stop.
+// It's safe for concurrent use.
+type Engine struct {
+	intervals   []time.Duration
+	aggregators []AggregatorFactory
+	sinks       []Sink
+	rollups     []*Rollup
+	closed      []time.Time // end of the last closed period for each interval
+	lastDayRain int
+	mutex       sync.Mutex
+	stop        chan struct{}
+	// SampleInterval is how often packets are expected, for coverage
+	SampleInterval time.Duration
+	// Location is the station time zone; daily periods start at its
+	// midnight. Nil is UTC.
+	Location *time.Location
+}
+
+func NewEngine(intervals []time.Duration, sinks ...Sink) *Engine {
+	return &Engine{
+		intervals:      intervals,
+		sinks:          sinks,
+		rollups:        make([]*Rollup, len(intervals)),
+		closed:         make([]time.Time, len(intervals)),
+		lastDayRain:    -1,
+		SampleInterval: DefaultSampleInterval,
+	}
+}
+
+func (e *Engine) Intervals() []time.Duration {
+	return e.intervals
+}
+
+func (e *Engine) AddSink(sink Sink) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.sinks = append(e.sinks, sink)
+}
+
+// AddAggregator adds a custom aggregator starting with the next rollup period
+func (e *Engine) AddAggregator(factory AggregatorFactory) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.aggregators = append(e.aggregators, factory)
+}
+
+func (e *Engine) newRollup(period time.Time, interval time.Duration) *Rollup {
+	rollup := NewRollup(period, interval)
+	rollup.End = PeriodEnd(period, interval, e.Location)
+	rollup.SampleInterval = e.SampleInterval
+	// carry the rain total over so rain between the periods isn't lost
+	rollup.LastDayRain = e.lastDayRain
+	rollup.extras = e.newExtras()
+	return rollup
+}
+
+func (e *Engine) newExtras() []Aggregator {
+	extras := make([]Aggregator, 0, len(e.aggregators))
+	for _, factory := range e.aggregators {
+		extras = append(extras, factory())
+	}
+	return extras
+}
+
+// Record adds the loop record to the rollups and saves any that finished.
+// Every sink gets every summary; the first error is returned.
+func (e *Engine) Record(loopRecord *vantage.LoopRecord) error {
+	e.mutex.Lock()
+	finished := make([]*Rollup, 0, len(e.intervals))
+	for idx, interval := range e.intervals {
+		tint := PeriodStart(loopRecord.Recorded, interval, e.Location)
+		// a late packet for a period the timer already closed
+		if tint.Before(e.closed[idx]) {
+			continue
+		}
+		rollup := e.rollups[idx]
+		if rollup == nil {
+			rollup = e.newRollup(tint, interval)
+			e.rollups[idx] = rollup
+		}
+		// the current loop record is after the rollup period
+		// save the old rollup as finished and create a new one
+		if !rollup.Period.Equal(tint) {
+			finished = append(finished, e.finish(idx))
+			rollup = e.newRollup(tint, interval)
+			e.rollups[idx] = rollup
+		}
+		rollup.Update(loopRecord)
+	}
+	e.lastDayRain = loopRecord.DayRainRaw
+	sinks := e.sinks
+	e.mutex.Unlock()
+
+	return saveAll(finished, sinks)
+}
+
+// finish marks the rollup for the interval done and removes it; the
+// mutex must be held
+func (e *Engine) finish(idx int) *Rollup {
+	rollup := e.rollups[idx]
+	rollup.Done = true
+	e.rollups[idx] = nil
+	e.closed[idx] = rollup.PeriodEnd()
+	return rollup
+}
+
+// Flush saves every rollup whose period ended before now
+func (e *Engine) Flush(now time.Time) error {
+	e.mutex.Lock()
+	finished := make([]*Rollup, 0, len(e.intervals))
+	for idx, rollup := range e.rollups {
+		if rollup != nil && !now.Before(rollup.PeriodEnd().Add(closeGrace)) {
+			finished = append(finished, e.finish(idx))
+		}
+	}
+	sinks := e.sinks
+	e.mutex.Unlock()
+
+	return saveAll(finished, sinks)
+}
+
+// FlushAll saves every rollup however much of its period is left, for the
+// end of a rebuild
+func (e *Engine) FlushAll() error {
+	e.mutex.Lock()
+	finished := make([]*Rollup, 0, len(e.intervals))
+	for idx, rollup := range e.rollups {
+		if rollup != nil {
+			finished = append(finished, e.finish(idx))
+		}
+	}
+	sinks := e.sinks
+	e.mutex.Unlock()
+
+	return saveAll(finished, sinks)
+}
+
+// Start closes periods on the wall clock every second until Stop.
+// Errors from the sinks go to errHandler.
+func (e *Engine) Start(errHandler func(err error)) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stop != nil {
+		return
+	}
+	e.stop = make(chan struct{})
+	go e.closeLoop(e.stop, errHandler)
+}
+
+func (e *Engine) closeLoop(stop chan struct{}, errHandler func(err error)) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := e.Flush(now); err != nil {
+				errHandler(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (e *Engine) Stop() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.stop != nil {
+		close(e.stop)
+		e.stop = nil
+	}
+}
+
+func saveAll(finished []*Rollup, sinks []Sink) error {
+	var firstErr error
+	for _, done := range finished {
+		err := save(done, sinks)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func save(rollup *Rollup, sinks []Sink) error {
+	if rollup.Count == 0 {
+		return nil
+	}
+	var firstErr error
+	for _, sink := range sinks {
+		// each sink gets its own copy since some convert the times
+		s := rollup.Summary()
+		err := sink.SaveSummary(s)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// ParseIntervals parses a comma separated list of durations like "10s,1m,5m"
+func ParseIntervals(intervals string) ([]time.Duration, error) {
+	parts := strings.Split(intervals, ",")
+	ret := make([]time.Duration, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		interval, err := time.ParseDuration(part)
+		if err != nil {
+			return nil, fmt.Errorf("bad interval %q: %w", part, err)
+		}
+		if interval < time.Second || interval%time.Second != 0 {
+			return nil, fmt.Errorf("interval %v must be whole seconds", interval)
+		}
+		ret = append(ret, interval)
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no intervals in %q", intervals)
+	}
+	return ret, nil
+}
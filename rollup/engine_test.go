@@ -0,0 +1,175 @@
+package rollup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+type maxHumidity struct {
+	max int
+}
+
+func (m *maxHumidity) Update(loopRecord *vantage.LoopRecord) {
+	if loopRecord.OutsideHumidity > m.max {
+		m.max = loopRecord.OutsideHumidity
+	}
+}
+
+func (m *maxHumidity) Summarize(s *Summary) {
+	if s.Extra == nil {
+		s.Extra = make(map[string]float64)
+	}
+	s.Extra["humidity_max"] = float64(m.max)
+}
+
+func TestEngine(t *testing.T) {
+	var first, second []*Summary
+	engine := NewEngine([]time.Duration{10 * time.Second, time.Minute},
+		SinkFunc(func(s *Summary) error { first = append(first, s); return nil }))
+	engine.AddSink(SinkFunc(func(s *Summary) error { second = append(second, s); return nil }))
+	engine.AddAggregator(func() Aggregator { return &maxHumidity{} })
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i <= 30; i++ {
+		err := engine.Record(&vantage.LoopRecord{
+			Recorded:        start.Add(time.Duration(i) * 2 * time.Second),
+			Wind:            i % 10,
+			WindDirection:   90,
+			OutsideHumidity: 50 + i,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 6 ten second summaries and the minute summary
+	if len(first) != 7 || len(second) != 7 {
+		t.Fatalf("expected 7 summaries in each sink got %v and %v", len(first), len(second))
+	}
+	if first[0] == second[0] {
+		t.Fatal("sinks should get their own copy")
+	}
+	s := first[0]
+	if s.SummarySeconds != 10 || s.Measurements != 5 || s.WindAvg != 2 || s.WindGust != 4 || s.WindLull != 0 {
+		t.Fatalf("unexpected ten second summary %+v", s)
+	}
+	if s.Extra["humidity_max"] != 54 {
+		t.Fatalf("expected humidity_max 54 got %v", s.Extra)
+	}
+	minute := first[6]
+	if minute.SummarySeconds != 60 || minute.Measurements != 30 || minute.WindDirectionAvg != 90 {
+		t.Fatalf("unexpected minute summary %+v", minute)
+	}
+}
+
+func TestParseIntervals(t *testing.T) {
+	intervals, err := ParseIntervals("10s, 1m,5m,15m,1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(intervals) != 5 || intervals[4] != time.Hour {
+		t.Fatalf("unexpected intervals %v", intervals)
+	}
+	if _, err = ParseIntervals("1500ms"); err == nil {
+		t.Fatal("expected error for fractional seconds")
+	}
+}
+
+func TestEngineFlushAndResume(t *testing.T) {
+	var saved []*Summary
+	sink := SinkFunc(func(s *Summary) error { saved = append(saved, s); return nil })
+	engine := NewEngine([]time.Duration{time.Minute, 5 * time.Minute}, sink)
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	// 40 seconds of packets then they stop
+	for i := 0; i < 20; i++ {
+		engine.Record(&vantage.LoopRecord{Recorded: start.Add(time.Duration(i) * 2 * time.Second), Wind: 5})
+	}
+	if err := engine.Flush(start.Add(time.Minute)); err != nil || len(saved) != 0 {
+		t.Fatalf("nothing should close inside the grace period, got %v %v", saved, err)
+	}
+	if err := engine.Flush(start.Add(70 * time.Second)); err != nil || len(saved) != 1 {
+		t.Fatalf("expected the minute to close on the clock, got %v %v", saved, err)
+	}
+	if s := saved[0]; s.Measurements != 20 || s.ExpectedMeasurements != 30 || !s.Partial {
+		t.Fatalf("expected partial summary got %+v", s)
+	}
+	// a late packet for the closed minute doesn't make another summary
+	engine.Record(&vantage.LoopRecord{Recorded: start.Add(59 * time.Second), Wind: 5})
+	engine.Record(&vantage.LoopRecord{Recorded: start.Add(2 * time.Minute), Wind: 5})
+	if len(saved) != 1 {
+		t.Fatalf("late packet made a summary %+v", saved[1:])
+	}
+
+	// restart in the same 5 minutes, the minute is finished
+	stateFile := filepath.Join(t.TempDir(), "state")
+	if err := engine.SaveState(stateFile); err != nil {
+		t.Fatal(err)
+	}
+	saved = nil
+	resumed := NewEngine([]time.Duration{time.Minute, 5 * time.Minute}, sink)
+	if err := resumed.LoadState(stateFile, start.Add(4*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 1 || saved[0].SummarySeconds != 60 || saved[0].Measurements != 1 {
+		t.Fatalf("expected the stale minute to be saved, got %+v", saved)
+	}
+	resumed.Record(&vantage.LoopRecord{Recorded: start.Add(5 * time.Minute), Wind: 5})
+	if len(saved) != 2 || saved[1].SummarySeconds != 300 || saved[1].Measurements != 22 {
+		t.Fatalf("expected resumed five minutes with 22 samples, got %+v", saved)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Fatal("state file should be removed after loading")
+	}
+}
+
+func TestDailyPeriodsAcrossDST(t *testing.T) {
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("no zone data: %v", err)
+	}
+	for _, c := range []struct {
+		at    time.Time
+		start time.Time
+		hours float64
+	}{
+		{time.Date(2021, 3, 14, 15, 0, 0, 0, loc), time.Date(2021, 3, 14, 0, 0, 0, 0, loc), 23},
+		{time.Date(2021, 11, 7, 1, 30, 0, 0, loc).Add(time.Hour), time.Date(2021, 11, 7, 0, 0, 0, 0, loc), 25},
+		{time.Date(2021, 6, 1, 23, 59, 0, 0, loc), time.Date(2021, 6, 1, 0, 0, 0, 0, loc), 24},
+	} {
+		start := PeriodStart(c.at, 24*time.Hour, loc)
+		end := PeriodEnd(start, 24*time.Hour, loc)
+		if !start.Equal(c.start) || end.Sub(start).Hours() != c.hours {
+			t.Fatalf("day of %v is %v to %v", c.at, start, end)
+		}
+	}
+	if !PeriodStart(time.Date(2021, 3, 14, 15, 7, 0, 0, loc), 5*time.Minute, loc).Equal(time.Date(2021, 3, 14, 15, 5, 0, 0, loc)) {
+		t.Fatal("short periods should truncate")
+	}
+
+	// the daily summary of the spring forward day is 23 hours
+	var saved []*Summary
+	engine := NewEngine([]time.Duration{24 * time.Hour}, SinkFunc(func(s *Summary) error { saved = append(saved, s); return nil }))
+	engine.Location = loc
+	for _, at := range []time.Time{
+		time.Date(2021, 3, 14, 0, 0, 0, 0, loc),
+		time.Date(2021, 3, 14, 23, 59, 0, 0, loc),
+		time.Date(2021, 3, 15, 0, 0, 0, 0, loc),
+	} {
+		if err = engine.Record(&vantage.LoopRecord{Recorded: at, Wind: 10}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(saved) != 1 {
+		t.Fatalf("expected one daily summary got %v", len(saved))
+	}
+	s := saved[0]
+	if !s.StartTime.Equal(time.Date(2021, 3, 14, 0, 0, 0, 0, loc)) || !s.EndTime.Equal(time.Date(2021, 3, 15, 0, 0, 0, 0, loc)) ||
+		s.Measurements != 2 || s.ExpectedMeasurements != 23*1800 || s.SummarySeconds != 86400 {
+		t.Fatalf("unexpected daily summary %+v", s)
+	}
+}
@@ -0,0 +1,110 @@
+package rollup
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+)
+
+const Sectors = 16
+const DegreesPerSector = 360.0 / Sectors
+
+// Histogram is the distribution of the samples in a summary so wind roses and
+// percentiles can be made for any time range without the raw data. Speeds
+// are in 1 mph bins where the index is the speed. It's stored as JSON.
+type Histogram struct {
+	Direction     [Sectors]int   `json:"dir"`
+	Speed         []int          `json:"speed"`
+	SpeedBySector [Sectors][]int `json:"speed_by_sector"`
+}
+
+// Sector is the 16 point compass sector of the direction, 0 is N
+func Sector(direction int) int {
+	return int(float64(direction%360)/DegreesPerSector+0.5) % Sectors
+}
+
+func (h *Histogram) Add(wind, direction int) {
+	sector := Sector(direction)
+	h.Direction[sector]++
+	h.Speed = addBin(h.Speed, wind, 1)
+	h.SpeedBySector[sector] = addBin(h.SpeedBySector[sector], wind, 1)
+}
+
+// Merge adds the counts from other
+func (h *Histogram) Merge(other *Histogram) {
+	for sector := range other.Direction {
+		h.Direction[sector] += other.Direction[sector]
+		for speed, count := range other.SpeedBySector[sector] {
+			h.SpeedBySector[sector] = addBin(h.SpeedBySector[sector], speed, count)
+		}
+	}
+	for speed, count := range other.Speed {
+		h.Speed = addBin(h.Speed, speed, count)
+	}
+}
+
+func addBin(bins []int, bin, count int) []int {
+	if bin < 0 {
+		bin = 0
+	}
+	for len(bins) <= bin {
+		bins = append(bins, 0)
+	}
+	bins[bin] += count
+	return bins
+}
+
+func (h *Histogram) Clone() Histogram {
+	c := Histogram{Direction: h.Direction}
+	c.Speed = append([]int(nil), h.Speed...)
+	for sector := range h.SpeedBySector {
+		c.SpeedBySector[sector] = append([]int(nil), h.SpeedBySector[sector]...)
+	}
+	return c
+}
+
+func (h *Histogram) Count() int {
+	total := 0
+	for _, count := range h.Speed {
+		total += count
+	}
+	return total
+}
+
+// SpeedPercentile is the speed that p (0-1) of the samples are at or below
+func (h *Histogram) SpeedPercentile(p float64) int {
+	total := h.Count()
+	if total == 0 {
+		return 0
+	}
+	need := int(p*float64(total) + 0.5)
+	seen := 0
+	for speed, count := range h.Speed {
+		seen += count
+		if seen >= need {
+			return speed
+		}
+	}
+	return len(h.Speed) - 1
+}
+
+func (h Histogram) Value() (driver.Value, error) {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (h *Histogram) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*h = Histogram{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, h)
+	case string:
+		return json.Unmarshal([]byte(v), h)
+	}
+	return fmt.Errorf("can't scan %T into Histogram", src)
+}
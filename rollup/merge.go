@@ -0,0 +1,154 @@
+package rollup
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Merge combines summaries of a shorter interval into one summary for the
+// period, for making hourly and daily summaries from the minute ones. Averages
+// are weighted by the measurements in each summary, extremes are the extremes
+// of the summaries and the histograms are added together. The speed and
+// direction deviations are pooled from each summary's deviation and how far
+// its average is from the overall average. Summaries outside the period or
+// flagged invalid are ignored; it returns nil if none are left. The merged
+// summary has the worst quality of the rest. Daily periods end at the next
+// midnight in loc like the engine's.
+func Merge(period time.Time, interval time.Duration, loc *time.Location, summaries []*Summary) *Summary {
+	end := PeriodEnd(period, interval, loc)
+	inside := make([]*Summary, 0, len(summaries))
+	for _, s := range summaries {
+		if !s.StartTime.Before(period) && !s.EndTime.After(end) && s.Measurements > 0 && s.Quality != QualityInvalid {
+			inside = append(inside, s)
+		}
+	}
+	if len(inside) == 0 {
+		return nil
+	}
+	sort.Slice(inside, func(i, j int) bool { return inside[i].StartTime.Before(inside[j].StartTime) })
+	first, last := inside[0], inside[len(inside)-1]
+
+	m := &Summary{
+		Station:            first.Station,
+		Source:             SourceLoop,
+		StartTime:          period,
+		EndTime:            end,
+		SummarySeconds:     int64(interval / time.Second),
+		WindGust:           -math.MaxFloat64,
+		WindLull:           math.MaxFloat64,
+		OutsideTempMin:     math.MaxFloat64,
+		OutsideTempMax:     -math.MaxFloat64,
+		OutsideHumidityMin: math.MaxFloat64,
+		OutsideHumidityMax: -math.MaxFloat64,
+		BarometerStart:     first.BarometerStart,
+		BarometerEnd:       last.BarometerEnd,
+		BarTrendByte:       last.BarTrendByte,
+	}
+	m.BarometerChange = m.BarometerEnd - m.BarometerStart
+
+	var n, dirX, dirY, vecX, vecY, dewPointN float64
+	// covered is the time the summaries cover and sample the shortest time
+	// between their expected measurements
+	var covered, sample time.Duration
+	seen := NewRollup(period, interval)
+	for _, s := range inside {
+		w := float64(s.Measurements)
+		n += w
+		m.Measurements += s.Measurements
+		m.ExpectedMeasurements += s.ExpectedMeasurements
+		length := s.EndTime.Sub(s.StartTime)
+		covered += length
+		if s.ExpectedMeasurements > 0 && (sample == 0 || length/time.Duration(s.ExpectedMeasurements) < sample) {
+			sample = length / time.Duration(s.ExpectedMeasurements)
+		}
+		if s.Source != SourceLoop && s.Source != "" {
+			m.Source = s.Source
+		}
+		if Worse(s.Quality, m.Quality) {
+			m.Quality, m.QualityReason = s.Quality, s.QualityReason
+		}
+
+		m.WindAvg += w * s.WindAvg
+		m.WindGust = math.Max(m.WindGust, s.WindGust)
+		m.WindLull = math.Min(m.WindLull, s.WindLull)
+		dirX += w * math.Cos(float64(s.WindDirectionAvg)*RadiansPerDegree)
+		dirY += w * math.Sin(float64(s.WindDirectionAvg)*RadiansPerDegree)
+		vecX += w * s.WindVectorSpeed * math.Cos(float64(s.WindVectorDirection)*RadiansPerDegree)
+		vecY += w * s.WindVectorSpeed * math.Sin(float64(s.WindVectorDirection)*RadiansPerDegree)
+		markArc(seen, int(s.WindDirectionMin), int(s.WindDirectionMax))
+
+		m.BarometerAvg += w * s.BarometerAvg
+		m.OutsideTempAvg += w * s.OutsideTempAvg
+		m.OutsideTempMin = math.Min(m.OutsideTempMin, s.OutsideTempMin)
+		m.OutsideTempMax = math.Max(m.OutsideTempMax, s.OutsideTempMax)
+		m.OutsideHumidityAvg += w * s.OutsideHumidityAvg
+		m.OutsideHumidityMin = math.Min(m.OutsideHumidityMin, s.OutsideHumidityMin)
+		m.OutsideHumidityMax = math.Max(m.OutsideHumidityMax, s.OutsideHumidityMax)
+		m.InsideTempAvg += w * s.InsideTempAvg
+		m.InsideHumidityAvg += w * s.InsideHumidityAvg
+		if s.DewPointAvg != 0 {
+			m.DewPointAvg += w * s.DewPointAvg
+			dewPointN += w
+		}
+		m.RainTotal += s.RainTotal
+		m.RainRateMax = math.Max(m.RainRateMax, s.RainRateMax)
+		m.Histogram.Merge(&s.Histogram)
+	}
+	m.WindAvg /= n
+	m.BarometerAvg /= n
+	m.OutsideTempAvg /= n
+	m.OutsideHumidityAvg /= n
+	m.InsideTempAvg /= n
+	m.InsideHumidityAvg /= n
+	if dewPointN > 0 {
+		m.DewPointAvg /= dewPointN
+	}
+	m.WindDirectionAvg = vectorDirection(dirX, dirY)
+	m.WindVectorSpeed = math.Hypot(vecX, vecY) / n
+	m.WindVectorDirection = vectorDirection(vecX, vecY)
+	dirMin, dirMax, dirRange := seen.WindDirRange()
+	m.WindDirectionMin, m.WindDirectionMax, m.WindDirectionRange = int64(dirMin), int64(dirMax), int64(dirRange)
+
+	// pooled deviations: each summary's variance plus its offset from the mean
+	var speedVar, dirVar float64
+	for _, s := range inside {
+		w := float64(s.Measurements)
+		d := s.WindAvg - m.WindAvg
+		speedVar += w * (s.WindStddev*s.WindStddev + d*d)
+		a := angleDiff(float64(s.WindDirectionAvg), float64(m.WindDirectionAvg))
+		dirVar += w * (s.WindDirectionStddev*s.WindDirectionStddev + a*a)
+	}
+	m.WindStddev = math.Sqrt(speedVar / n)
+	m.WindDirectionStddev = math.Sqrt(dirVar / n)
+
+	// the time no summary covers counts as missing samples, which works for
+	// summaries of different intervals
+	if sample == 0 {
+		sample = DefaultSampleInterval
+	}
+	if uncovered := end.Sub(period) - covered; uncovered > 0 {
+		m.ExpectedMeasurements += int64(uncovered / sample)
+	}
+	m.Partial = float64(m.Measurements) < PartialCoverage*float64(m.ExpectedMeasurements)
+	return m
+}
+
+// markArc marks the directions from min clockwise to max as seen
+func markArc(r *Rollup, min, max int) {
+	for dir := min % 360; ; dir = (dir + 1) % 360 {
+		r.WindDirSeen[dir/64] |= 1 << uint(dir%64)
+		if dir == max%360 {
+			return
+		}
+	}
+}
+
+// angleDiff is the smallest difference between two directions in degrees
+func angleDiff(a, b float64) float64 {
+	d := math.Mod(math.Abs(a-b), 360)
+	if d > 180 {
+		d = 360 - d
+	}
+	return d
+}
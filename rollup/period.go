@@ -0,0 +1,36 @@
+package rollup
+
+import "time"
+
+const day = 24 * time.Hour
+
+// PeriodStart is the start of the period of interval that t is in. Periods
+// of whole days start at midnight in loc so daily summaries are the station's
+// days; shorter ones are aligned like Truncate. A nil loc is UTC.
+func PeriodStart(t time.Time, interval time.Duration, loc *time.Location) time.Time {
+	if interval%day != 0 {
+		return t.Truncate(interval)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := t.In(loc)
+	// count calendar days so periods of several days line up the same way
+	// whatever the offset
+	date := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	date = date.Truncate(interval)
+	return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+}
+
+// PeriodEnd is the end of the period of interval that starts at start.
+// Across a DST change a day is 23 or 25 hours.
+func PeriodEnd(start time.Time, interval time.Duration, loc *time.Location) time.Time {
+	if interval%day != 0 {
+		return start.Add(interval)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := start.In(loc)
+	return time.Date(local.Year(), local.Month(), local.Day()+int(interval/day), 0, 0, 0, 0, loc)
+}
@@ -0,0 +1,77 @@
+package rollup
+
+import (
+	"fmt"
+	"time"
+)
+
+// Qualities of data, best first. Data without a flag is valid.
+const (
+	QualityValid   = "valid"
+	QualitySuspect = "suspect"
+	QualityInvalid = "invalid"
+)
+
+var qualityRank = map[string]int{
+	"":             0,
+	QualityValid:   0,
+	QualitySuspect: 1,
+	QualityInvalid: 2,
+}
+
+// CheckQuality returns an error if quality isn't one of the qualities
+func CheckQuality(quality string) error {
+	if _, ok := qualityRank[quality]; !ok || quality == "" {
+		return fmt.Errorf("bad quality %q, use %v, %v or %v", quality, QualityValid, QualitySuspect, QualityInvalid)
+	}
+	return nil
+}
+
+// Worse reports whether quality a is worse than b
+func Worse(a, b string) bool {
+	return qualityRank[a] > qualityRank[b]
+}
+
+// Flag marks the data from Start up to End, like a bird sitting on the
+// anemometer or the sensors being swapped. It covers summaries and loop
+// records alike.
+type Flag struct {
+	ID      int64
+	Station string
+	Start   time.Time
+	End     time.Time
+	Quality string
+	Reason  string
+	SetBy   string // who set it
+	SetAt   time.Time
+}
+
+// Overlaps reports whether the flag covers any of start up to end
+func (f *Flag) Overlaps(start, end time.Time) bool {
+	return f.Start.Before(end) && start.Before(f.End)
+}
+
+// ArchiveReason is the quality reason of summaries made from the console's
+// archive records
+const ArchiveReason = "made from the console's archive records"
+
+// ApplyFlags sets the quality of each summary to the worst of the flags
+// over it, with that flag's reason. Summaries without a flag are valid,
+// except the ones made from the archive, which are suspect since they only
+// have the averages of longer periods.
+func ApplyFlags(ss []*Summary, flags []*Flag) {
+	for _, s := range ss {
+		if s == nil {
+			continue
+		}
+		s.Quality, s.QualityReason = QualityValid, ""
+		if s.Source == SourceArchive {
+			s.Quality, s.QualityReason = QualitySuspect, ArchiveReason
+		}
+		for _, f := range flags {
+			if f.Overlaps(s.StartTime, s.EndTime) && Worse(f.Quality, s.Quality) {
+				s.Quality, s.QualityReason = f.Quality, f.Reason
+			}
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package rollup
+
+import (
+	"math"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+const DegreesPerRadian = 180 / math.Pi
+const RadiansPerDegree = math.Pi / 180
+
+// DefaultSampleInterval is how often the console sends LOOP packets
+const DefaultSampleInterval = 2 * time.Second
+
+// PartialCoverage is the fraction of the expected samples below which a
+// summary is flagged partial
+const PartialCoverage = 0.8
+
+type Summary struct {
+	ID int64
+	// Station tells summaries from different stations apart when they
+	// share a database. Together with StartTime and SummarySeconds it
+	// identifies a summary.
+	Station string
+	// Source is SourceLoop for summaries made from loop packets and
+	// SourceArchive for ones filled in from the console's archive
+	Source       string
+	StartTime    time.Time
+	EndTime      time.Time
+	Measurements int64
+	// ExpectedMeasurements is how many samples a full period has; Partial
+	// is set when too few arrived, which means an outage not a calm
+	ExpectedMeasurements int64
+	Partial              bool
+	SummarySeconds       int64
+	WindAvg              float64
+	WindGust             float64
+	WindLull             float64
+	WindStddev           float64
+	WindDirectionAvg     int64
+	// WindDirectionMin and Max are the ends of the shortest arc that covers
+	// every direction going clockwise, so a northerly is min 350 max 10
+	WindDirectionMin    int64
+	WindDirectionMax    int64
+	WindDirectionRange  int64   // degrees covered by the arc
+	WindDirectionStddev float64 // Yamartino
+	// WindVector is the speed weighted average, so calm periods don't
+	// pull the direction around like they do for WindDirectionAvg
+	WindVectorSpeed     float64
+	WindVectorDirection int64
+	BarometerAvg        float64
+	BarometerStart      float64
+	OutsideTempAvg      float64
+	OutsideHumidityAvg  float64
+	BarTrendByte        byte
+	RainTotal           float64 // in
+	RainRateMax         float64 // in/hr
+	OutsideTempMin      float64
+	OutsideTempMax      float64
+	OutsideHumidityMin  float64
+	OutsideHumidityMax  float64
+	BarometerEnd        float64
+	BarometerChange     float64 // end - start
+	InsideTempAvg       float64
+	InsideHumidityAvg   float64
+	DewPointAvg         float64 // F
+	Histogram           Histogram
+	// Extra holds the values from custom aggregators
+	Extra map[string]float64 `gorm:"-"`
+	// Quality is set from the flags over the summary when it's read; it
+	// isn't saved with it
+	Quality       string `gorm:"-"`
+	QualityReason string `gorm:"-"`
+}
+
+func (s *Summary) WindDirAvgCardinal() int {
+	tmp := int(math.Floor(float64(s.WindDirectionAvg)/22.5+.5) * 22.5)
+	if tmp == 360 {
+		tmp = 0
+	}
+	return tmp
+}
+
+func (s *Summary) OutsideTempAvgCelsius() float64 {
+	return (s.OutsideTempAvg - 32) * 5 / 9
+}
+
+// In returns the summary with its times set to loc for display
+func (s *Summary) In(loc *time.Location) *Summary {
+	s.StartTime = s.StartTime.In(loc)
+	s.EndTime = s.EndTime.In(loc)
+	return s
+}
+
+// Valid is false for summaries flagged invalid and for impossible winds
+func (s *Summary) Valid() bool {
+	return s.Quality != QualityInvalid && s.WindAvg < 100 && s.WindGust < 100
+}
+
+type Rollup struct {
+	Period             time.Time
+	Interval           time.Duration
+	End                time.Time     // end of the period, zero for Period plus Interval
+	SampleInterval     time.Duration // for the expected count
+	Count              int           // number of samples
+	WindSum            int           // sum
+	WindSum2           int           // sum of squares
+	WindMax            int
+	WindMin            int
+	WindDirXSum        float64   // sum of unit vectors
+	WindDirYSum        float64   // sum of unit vectors
+	WindVecXSum        float64   // sum of speed weighted vectors
+	WindVecYSum        float64   // sum of speed weighted vectors
+	WindDirSeen        [6]uint64 // bitset of the directions seen, 0-359
+	Histogram          Histogram
+	BarometerSum       float64
+	BarometerStart     float64
+	BarometerEnd       float64
+	OutsideTempSum     float64
+	OutsideTempMax     float64
+	OutsideTempMin     float64
+	OutsideHumiditySum int
+	OutsideHumidityMax int
+	OutsideHumidityMin int
+	InsideTempSum      float64
+	InsideHumiditySum  int
+	DewPointSum        float64
+	DewPointCount      int // samples with humidity
+	RainClicks         int // clicks == 0.01in
+	RainRateMax        int // clicks/hr
+	LastDayRain        int // day rain clicks of the last sample, -1 if unknown
+	BarTrendByte       byte
+	Done               bool
+	extras             []Aggregator
+}
+
+func NewRollup(period time.Time, interval time.Duration) *Rollup {
+	return &Rollup{
+		Period:             period,
+		Interval:           interval,
+		SampleInterval:     DefaultSampleInterval,
+		WindMin:            math.MaxInt32,
+		OutsideTempMax:     -math.MaxFloat32,
+		OutsideTempMin:     math.MaxFloat32,
+		OutsideHumidityMin: math.MaxInt32,
+		LastDayRain:        -1,
+	}
+}
+
+func (r *Rollup) Update(loopRecord *vantage.LoopRecord) {
+	r.Count++
+	// wind
+	wind := loopRecord.Wind
+	r.WindSum += wind
+	r.WindSum2 += wind * wind
+	if wind > r.WindMax {
+		r.WindMax = wind
+	}
+	if wind < r.WindMin {
+		r.WindMin = wind
+	}
+	// wind direction
+	winddir := loopRecord.WindDirection
+	winddirx := math.Cos(float64(winddir) * RadiansPerDegree)
+	winddiry := math.Sin(float64(winddir) * RadiansPerDegree)
+
+	r.WindDirXSum += winddirx
+	r.WindDirYSum += winddiry
+	r.WindVecXSum += float64(wind) * winddirx
+	r.WindVecYSum += float64(wind) * winddiry
+	seen := winddir % 360
+	r.WindDirSeen[seen/64] |= 1 << uint(seen%64)
+	r.Histogram.Add(wind, winddir)
+	// other stuff
+	r.BarometerSum += float64(loopRecord.Barometer())
+	if r.Count == 1 {
+		r.BarometerStart = float64(loopRecord.Barometer())
+	}
+	r.BarometerEnd = float64(loopRecord.Barometer())
+	temp := float64(loopRecord.OutsideTemp())
+	r.OutsideTempSum += temp
+	r.OutsideTempMax = math.Max(r.OutsideTempMax, temp)
+	r.OutsideTempMin = math.Min(r.OutsideTempMin, temp)
+	humidity := loopRecord.OutsideHumidity
+	r.OutsideHumiditySum += humidity
+	if humidity > r.OutsideHumidityMax {
+		r.OutsideHumidityMax = humidity
+	}
+	if humidity < r.OutsideHumidityMin {
+		r.OutsideHumidityMin = humidity
+	}
+	if humidity > 0 {
+		r.DewPointSum += DewPoint(temp, float64(humidity))
+		r.DewPointCount++
+	}
+	r.InsideTempSum += float64(loopRecord.InsideTemp())
+	r.InsideHumiditySum += loopRecord.InsideHumidity
+	r.updateRain(loopRecord)
+	r.BarTrendByte = loopRecord.BarTrendByte
+	for _, extra := range r.extras {
+		extra.Update(loopRecord)
+	}
+}
+
+// updateRain adds the rain since the last sample. The console only has
+// totals, and the day total goes back to 0 at midnight.
+func (r *Rollup) updateRain(loopRecord *vantage.LoopRecord) {
+	if loopRecord.RainRateRaw > r.RainRateMax {
+		r.RainRateMax = loopRecord.RainRateRaw
+	}
+	dayRain := loopRecord.DayRainRaw
+	if r.LastDayRain >= 0 {
+		if dayRain >= r.LastDayRain {
+			r.RainClicks += dayRain - r.LastDayRain
+		} else {
+			r.RainClicks += dayRain
+		}
+	}
+	r.LastDayRain = dayRain
+}
+
+func (r *Rollup) WindAvg() float64 {
+	return float64(r.WindSum) / float64(r.Count)
+}
+func (r *Rollup) WindStddev() float64 {
+	//variance = (SumSq - (Sum × Sum) ⁄ n) ⁄ n
+	return math.Sqrt((float64(r.WindSum2) - float64(r.WindSum*r.WindSum)/float64(r.Count)) / float64(r.Count))
+}
+func (r *Rollup) WindDirAvg() int64 {
+	return vectorDirection(r.WindDirXSum, r.WindDirYSum)
+}
+
+// WindDirStddev is the Yamartino estimate of the standard deviation of
+// the direction in degrees
+func (r *Rollup) WindDirStddev() float64 {
+	sa := r.WindDirYSum / float64(r.Count)
+	ca := r.WindDirXSum / float64(r.Count)
+	epsilon := math.Sqrt(math.Max(0, 1-(sa*sa+ca*ca)))
+	return math.Asin(epsilon) * (1 + (2/math.Sqrt(3)-1)*epsilon*epsilon*epsilon) * DegreesPerRadian
+}
+
+// WindDirRange finds the shortest arc covering every direction seen. It's
+// the circle minus the biggest gap between directions. The arc starts at min
+// and goes clockwise to max.
+func (r *Rollup) WindDirRange() (min, max, degrees int) {
+	first, last, prev := -1, -1, -1
+	biggestGap := 0
+	for dir := 0; dir < 360; dir++ {
+		if r.WindDirSeen[dir/64]&(1<<uint(dir%64)) == 0 {
+			continue
+		}
+		if first < 0 {
+			first = dir
+		} else if gap := dir - prev; gap > biggestGap {
+			biggestGap, min, max = gap, dir, prev
+		}
+		prev = dir
+		last = dir
+	}
+	if first < 0 {
+		return 0, 0, 0
+	}
+	// the gap that goes through north
+	if gap := first + 360 - last; gap >= biggestGap {
+		biggestGap, min, max = gap, first, last
+	}
+	return min, max, 360 - biggestGap
+}
+
+func (r *Rollup) WindVectorSpeed() float64 {
+	return math.Hypot(r.WindVecXSum, r.WindVecYSum) / float64(r.Count)
+}
+
+func (r *Rollup) WindVectorDirection() int64 {
+	return vectorDirection(r.WindVecXSum, r.WindVecYSum)
+}
+
+func vectorDirection(x, y float64) int64 {
+	rads := math.Atan2(y, x)
+	if rads < 0 {
+		rads += 2 * math.Pi
+	}
+	deg := int64(rads*DegreesPerRadian + 0.5)
+	if deg == 360 {
+		deg = 0
+	}
+	return deg
+}
+
+func (r *Rollup) BarometerAvg() float64 {
+	return r.BarometerSum / float64(r.Count)
+}
+func (r *Rollup) OutsideTempAvg() float64 {
+	return r.OutsideTempSum / float64(r.Count)
+}
+func (r *Rollup) OutsideHumidityAvg() int {
+	return r.OutsideHumiditySum / r.Count
+}
+func (r *Rollup) InsideTempAvg() float64 {
+	return r.InsideTempSum / float64(r.Count)
+}
+func (r *Rollup) InsideHumidityAvg() float64 {
+	return float64(r.InsideHumiditySum) / float64(r.Count)
+}
+func (r *Rollup) DewPointAvg() float64 {
+	if r.DewPointCount == 0 {
+		return 0
+	}
+	return r.DewPointSum / float64(r.DewPointCount)
+}
+
+// DewPoint in F from temperature in F and relative humidity in %
+// using the Magnus formula
+func DewPoint(tempF, humidity float64) float64 {
+	const b = 17.62
+	const c = 243.12
+	tempC := (tempF - 32) * 5 / 9
+	gamma := math.Log(humidity/100) + b*tempC/(c+tempC)
+	dewPointC := c * gamma / (b - gamma)
+	return dewPointC*9/5 + 32
+}
+
+// PeriodEnd is the end of the period; days are 23 or 25 hours across DST
+// changes
+func (r *Rollup) PeriodEnd() time.Time {
+	if r.End.IsZero() {
+		return r.Period.Add(r.Interval)
+	}
+	return r.End
+}
+
+// Expected is how many samples the period should have
+func (r *Rollup) Expected() int {
+	if r.SampleInterval <= 0 {
+		return 0
+	}
+	return int(r.PeriodEnd().Sub(r.Period) / r.SampleInterval)
+}
+
+func (r *Rollup) Summary() *Summary {
+	dirMin, dirMax, dirRange := r.WindDirRange()
+	expected := r.Expected()
+	s := &Summary{
+		ID:                   0,
+		Source:               SourceLoop,
+		StartTime:            r.Period,
+		EndTime:              r.PeriodEnd(),
+		Measurements:         int64(r.Count),
+		ExpectedMeasurements: int64(expected),
+		Partial:              float64(r.Count) < PartialCoverage*float64(expected),
+		SummarySeconds:       int64(r.Interval / time.Second),
+		WindAvg:              r.WindAvg(),
+		WindGust:             float64(r.WindMax),
+		WindLull:             float64(r.WindMin),
+		WindStddev:           r.WindStddev(),
+		WindDirectionAvg:     r.WindDirAvg(),
+		WindDirectionMin:     int64(dirMin),
+		WindDirectionMax:     int64(dirMax),
+		WindDirectionRange:   int64(dirRange),
+		WindDirectionStddev:  r.WindDirStddev(),
+		WindVectorSpeed:      r.WindVectorSpeed(),
+		WindVectorDirection:  r.WindVectorDirection(),
+		BarometerAvg:         r.BarometerAvg(),
+		BarometerStart:       r.BarometerStart,
+		OutsideTempAvg:       r.OutsideTempAvg(),
+		OutsideHumidityAvg:   float64(r.OutsideHumidityAvg()),
+		BarTrendByte:         r.BarTrendByte,
+		RainTotal:            float64(r.RainClicks) / 100,
+		RainRateMax:          float64(r.RainRateMax) / 100,
+		OutsideTempMin:       r.OutsideTempMin,
+		OutsideTempMax:       r.OutsideTempMax,
+		OutsideHumidityMin:   float64(r.OutsideHumidityMin),
+		OutsideHumidityMax:   float64(r.OutsideHumidityMax),
+		BarometerEnd:         r.BarometerEnd,
+		BarometerChange:      r.BarometerEnd - r.BarometerStart,
+		InsideTempAvg:        r.InsideTempAvg(),
+		InsideHumidityAvg:    r.InsideHumidityAvg(),
+		DewPointAvg:          r.DewPointAvg(),
+		Histogram:            r.Histogram.Clone(),
+	}
+	for _, extra := range r.extras {
+		extra.Summarize(s)
+	}
+	return s
+}
@@ -0,0 +1,107 @@
+package rollup
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/smw1218/windygo/vantage"
+)
+
+func rollupOf(winds, directions []int) *Rollup {
+	r := NewRollup(time.Time{}, time.Minute)
+	for i := range winds {
+		r.Update(&vantage.LoopRecord{Wind: winds[i], WindDirection: directions[i]})
+	}
+	return r
+}
+
+func TestWindDirRangeNortherly(t *testing.T) {
+	r := rollupOf([]int{10, 10, 10, 10}, []int{350, 355, 5, 10})
+	min, max, degrees := r.WindDirRange()
+	if min != 350 || max != 10 || degrees != 20 {
+		t.Fatalf("expected 350-10 (20) got %v-%v (%v)", min, max, degrees)
+	}
+	if avg := r.WindDirAvg(); avg != 0 {
+		t.Fatalf("expected avg 0 got %v", avg)
+	}
+
+	r = rollupOf([]int{10, 10}, []int{90, 90})
+	min, max, degrees = r.WindDirRange()
+	if min != 90 || max != 90 || degrees != 0 {
+		t.Fatalf("expected 90-90 (0) got %v-%v (%v)", min, max, degrees)
+	}
+	if stddev := r.WindDirStddev(); stddev != 0 {
+		t.Fatalf("expected no deviation got %v", stddev)
+	}
+}
+
+func TestWindDirStddev(t *testing.T) {
+	// northerly and southerly deviations should match
+	north := rollupOf([]int{10, 10, 10}, []int{340, 0, 20}).WindDirStddev()
+	south := rollupOf([]int{10, 10, 10}, []int{160, 180, 200}).WindDirStddev()
+	if math.Abs(north-south) > 1e-9 {
+		t.Fatalf("expected the same deviation got %v and %v", north, south)
+	}
+	// close to the linear deviation of 16.3 for small angles
+	if north < 15 || north > 18 {
+		t.Fatalf("unexpected deviation %v", north)
+	}
+}
+
+func TestWindVector(t *testing.T) {
+	// a strong westerly with a light easterly averages to a westerly
+	r := rollupOf([]int{20, 2}, []int{270, 90})
+	if dir := r.WindVectorDirection(); dir != 270 {
+		t.Fatalf("expected vector direction 270 got %v", dir)
+	}
+	if speed := r.WindVectorSpeed(); math.Abs(speed-9) > 1e-9 {
+		t.Fatalf("expected vector speed 9 got %v", speed)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := rollupOf([]int{5, 10, 10, 20}, []int{355, 10, 12, 90})
+	h := r.Summary().Histogram
+	if h.Direction[0] != 2 || h.Direction[1] != 1 || h.Direction[4] != 1 {
+		t.Fatalf("unexpected sectors %v", h.Direction)
+	}
+	if p := h.SpeedPercentile(0.5); p != 10 {
+		t.Fatalf("expected median 10 got %v", p)
+	}
+	if p := h.SpeedPercentile(0.9); p != 20 {
+		t.Fatalf("expected p90 20 got %v", p)
+	}
+	h.Merge(&h)
+	if h.Count() != 8 || h.SpeedBySector[4][20] != 2 {
+		t.Fatalf("unexpected merge %+v", h)
+	}
+	if r.Histogram.Count() != 4 {
+		t.Fatal("summary histogram should be a copy")
+	}
+}
+
+func TestMergeMixedIntervals(t *testing.T) {
+	start := time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)
+	summary := func(at time.Time, interval time.Duration) *Summary {
+		expected := int64(interval / DefaultSampleInterval)
+		return &Summary{StartTime: at, EndTime: at.Add(interval), SummarySeconds: int64(interval / time.Second),
+			Measurements: expected, ExpectedMeasurements: expected}
+	}
+	// 5 minute summaries for the first hour then an hourly one
+	var ss []*Summary
+	for i := 0; i < 12; i++ {
+		ss = append(ss, summary(start.Add(time.Duration(i)*5*time.Minute), 5*time.Minute))
+	}
+	ss = append(ss, summary(start.Add(time.Hour), time.Hour))
+
+	m := Merge(start, 2*time.Hour, time.UTC, ss)
+	if m.Measurements != 3600 || m.ExpectedMeasurements != 3600 || m.Partial {
+		t.Fatalf("expected 3600 of 3600 measurements got %v of %v partial %v", m.Measurements, m.ExpectedMeasurements, m.Partial)
+	}
+	// the rest of the day is missing
+	m = Merge(start, 24*time.Hour, time.UTC, ss)
+	if m.ExpectedMeasurements != 43200 || !m.Partial {
+		t.Fatalf("expected 43200 expected measurements got %v partial %v", m.ExpectedMeasurements, m.Partial)
+	}
+}
@@ -0,0 +1,115 @@
+package rollup
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state is what's saved between restarts. Custom aggregators aren't saved
+// so they start over with the resumed rollups.
+type state struct {
+	Saved       time.Time
+	LastDayRain int
+	Rollups     []*Rollup
+}
+
+// SaveState writes the in-progress rollups to fileName so a restart can
+// pick up where this one left off
+func (e *Engine) SaveState(fileName string) error {
+	e.mutex.Lock()
+	st := state{
+		Saved:       time.Now(),
+		LastDayRain: e.lastDayRain,
+	}
+	for _, rollup := range e.rollups {
+		if rollup != nil {
+			st.Rollups = append(st.Rollups, rollup)
+		}
+	}
+	b, err := json.Marshal(st)
+	e.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("error encoding rollup state: %w", err)
+	}
+
+	// write then rename so a crash doesn't leave half a file
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error creating rollup state file: %w", err)
+	}
+	_, err = tmp.Write(b)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing rollup state: %w", err)
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// LoadState resumes the rollups saved by SaveState. Rollups whose period
+// is still going at now carry on; the rest are saved to the sinks (they'll
+// be flagged partial if too much was missed). The file is removed so the
+// rollups can't be resumed twice. A missing file isn't an error.
+func (e *Engine) LoadState(fileName string, now time.Time) error {
+	b, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading rollup state: %w", err)
+	}
+	var st state
+	err = json.Unmarshal(b, &st)
+	if err != nil {
+		return fmt.Errorf("error decoding rollup state %v: %w", fileName, err)
+	}
+
+	e.mutex.Lock()
+	finished := make([]*Rollup, 0, len(st.Rollups))
+	e.lastDayRain = st.LastDayRain
+	for _, saved := range st.Rollups {
+		idx := e.intervalIndex(saved.Interval)
+		if idx < 0 {
+			log.Printf("Dropping saved rollup for %v, interval not configured", saved.Interval)
+			continue
+		}
+		if saved.Period.Equal(PeriodStart(now, saved.Interval, e.Location)) && e.rollups[idx] == nil {
+			saved.extras = e.newExtras()
+			e.rollups[idx] = saved
+			continue
+		}
+		saved.Done = true
+		if end := saved.PeriodEnd(); end.After(e.closed[idx]) {
+			e.closed[idx] = end
+		}
+		finished = append(finished, saved)
+	}
+	sinks := e.sinks
+	e.mutex.Unlock()
+
+	err = os.Remove(fileName)
+	if err != nil {
+		log.Printf("Error removing rollup state: %v", err)
+	}
+	return saveAll(finished, sinks)
+}
+
+func (e *Engine) intervalIndex(interval time.Duration) int {
+	for idx, configured := range e.intervals {
+		if configured == interval {
+			return idx
+		}
+	}
+	return -1
+}
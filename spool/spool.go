@@ -0,0 +1,324 @@
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Kinds of entries
+const (
+	KindSummary = "summary"
+	KindLoop    = "loop"
+)
+
+// ErrFull is returned by Append when the spool is at its size limit
+var ErrFull = errors.New("spool is full")
+
+// Entry is one spooled write. Key identifies the row so replaying
+// the same row twice only writes it once.
+type Entry struct {
+	Kind string          `json:"kind"`
+	Key  string          `json:"key"`
+	Data json.RawMessage `json:"data"`
+}
+
+// Spool is an append-only file of writes that couldn't be made to the
+// database. Every append is fsync'd so nothing is lost if the power goes out.
+// Each line is a crc32 of the entry then the entry as JSON; a torn line at
+// the end from a crash is truncated when the spool is opened.
+type Spool struct {
+	fileName string
+	maxBytes int64
+	mutex    sync.Mutex
+	// replayMutex keeps to one replay at a time
+	replayMutex sync.Mutex
+	file        *os.File
+	size        int64
+}
+
+// Open opens or creates the spool. maxBytes limits the file size, 0 is
+// no limit.
+func Open(fileName string, maxBytes int64) (*Spool, error) {
+	s := &Spool{
+		fileName: fileName,
+		maxBytes: maxBytes,
+	}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Spool) open() error {
+	err := repairEnd(s.fileName)
+	if err != nil {
+		return fmt.Errorf("error repairing spool: %w", err)
+	}
+	f, err := os.OpenFile(s.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening spool: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening spool: %w", err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// repairEnd truncates a line cut short at the end of the file, like by a
+// crash, so the next append isn't glued onto it and lost along with it
+func repairEnd(fileName string) error {
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// back to just after the last newline
+	end := info.Size()
+	buf := make([]byte, 4096)
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		_, err = f.ReadAt(buf[:n], end-n)
+		if err != nil {
+			return err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end += int64(i) + 1 - n
+			break
+		}
+		end -= n
+	}
+	if end == info.Size() {
+		return nil
+	}
+	log.Printf("Truncating a partial entry at the end of %v", fileName)
+	err = f.Truncate(end)
+	if err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Pending is true if there are entries waiting to be replayed
+func (s *Spool) Pending() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size > 0
+}
+
+// Size is the size of the spool file in bytes
+func (s *Spool) Size() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.size
+}
+
+// Append writes v as JSON and syncs the file
+func (s *Spool) Append(kind, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding %v %v: %w", kind, key, err)
+	}
+	line, err := encodeLine(Entry{Kind: kind, Key: key, Data: data})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.maxBytes > 0 && s.size+int64(len(line)) > s.maxBytes {
+		return fmt.Errorf("%w: dropping %v %v", ErrFull, kind, key)
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing spool: %w", err)
+	}
+	err = s.file.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing spool: %w", err)
+	}
+	return nil
+}
+
+func encodeLine(e Entry) ([]byte, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding spool entry: %w", err)
+	}
+	line := make([]byte, 0, len(b)+10)
+	line = append(line, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(b))...)
+	line = append(line, b...)
+	return append(line, '\n'), nil
+}
+
+func decodeLine(line []byte) (Entry, error) {
+	var e Entry
+	space := bytes.IndexByte(line, ' ')
+	if space < 0 {
+		return e, fmt.Errorf("no checksum")
+	}
+	sum, err := strconv.ParseUint(string(line[:space]), 16, 32)
+	if err != nil {
+		return e, fmt.Errorf("bad checksum: %w", err)
+	}
+	b := line[space+1:]
+	if crc32.ChecksumIEEE(b) != uint32(sum) {
+		return e, fmt.Errorf("checksum mismatch")
+	}
+	err = json.Unmarshal(b, &e)
+	return e, err
+}
+
+// Replay calls fn with each entry in the order they were appended. When an
+// entry has been appended more than once (same kind and key) only the last
+// one is replayed. If fn returns an error the replay stops and that entry
+// and the ones after it stay in the spool for next time. fn is called
+// without the lock held, so appends made during the replay aren't held up;
+// they stay in the spool behind the entries that weren't replayed.
+func (s *Spool) Replay(fn func(e Entry) error) (int, error) {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+
+	s.mutex.Lock()
+	size := s.size
+	entries, err := s.read(0, size)
+	s.mutex.Unlock()
+	if size == 0 || err != nil {
+		return 0, err
+	}
+
+	last := make(map[string]int, len(entries))
+	for i, e := range entries {
+		last[e.Kind+"\x00"+e.Key] = i
+	}
+	replayed := 0
+	var left []Entry
+	var replayErr error
+	for i, e := range entries {
+		if last[e.Kind+"\x00"+e.Key] != i {
+			continue
+		}
+		replayErr = fn(e)
+		if replayErr != nil {
+			left = entries[i:]
+			break
+		}
+		replayed++
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	appended, err := s.read(size, s.size)
+	if err == nil {
+		err = s.rewrite(append(left, appended...))
+	}
+	if replayErr != nil {
+		if err != nil {
+			log.Printf("Error rewriting spool: %v", err)
+		}
+		return replayed, replayErr
+	}
+	return replayed, err
+}
+
+// read returns the entries in the file from offset from up to to; the mutex
+// must be held
+func (s *Spool) read(from, to int64) ([]Entry, error) {
+	if from >= to {
+		return nil, nil
+	}
+	f, err := os.Open(s.fileName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading spool: %w", err)
+	}
+	defer f.Close()
+	reader := bufio.NewReader(io.NewSectionReader(f, from, to-from))
+	var entries []Entry
+	for lineNum := 1; ; lineNum++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return entries, nil
+		}
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("error reading spool: %w", err)
+		}
+		e, decodeErr := decodeLine(bytes.TrimRight(line, "\n"))
+		if decodeErr != nil {
+			// most likely a write that was cut off by a crash
+			log.Printf("Skipping bad spool entry on line %v: %v", lineNum, decodeErr)
+			continue
+		}
+		entries = append(entries, e)
+	}
+}
+
+// rewrite replaces the spool with entries; the mutex must be held
+func (s *Spool) rewrite(entries []Entry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.fileName), filepath.Base(s.fileName)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error rewriting spool: %w", err)
+	}
+	writer := bufio.NewWriter(tmp)
+	for _, e := range entries {
+		line, err := encodeLine(e)
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return fmt.Errorf("error rewriting spool: %w", err)
+		}
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error rewriting spool: %w", err)
+	}
+
+	s.file.Close()
+	err = os.Rename(tmp.Name(), s.fileName)
+	if err != nil {
+		return fmt.Errorf("error replacing spool: %w", err)
+	}
+	return s.open()
+}
+
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.file.Close()
+}
@@ -0,0 +1,137 @@
+package spool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "spool")
+	s, err := Open(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range []string{"a", "b", "a", "c"} {
+		if err = s.Append(KindSummary, key, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a write cut off by a crash
+	f, _ := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("1234abcd {\"kind\":")
+	f.Close()
+
+	var replayed []string
+	down := errors.New("down")
+	n, err := s.Replay(func(e Entry) error {
+		if e.Key == "c" {
+			return down
+		}
+		replayed = append(replayed, e.Key+string(e.Data))
+		return nil
+	})
+	if err != down || n != 2 {
+		t.Fatalf("expected to stop at c after 2 got %v %v", n, err)
+	}
+	// the first a is replaced by the second
+	if len(replayed) != 2 || replayed[0] != "b1" || replayed[1] != "a2" {
+		t.Fatalf("unexpected replay order %v", replayed)
+	}
+
+	replayed = nil
+	n, err = s.Replay(func(e Entry) error {
+		replayed = append(replayed, e.Key)
+		return nil
+	})
+	if err != nil || n != 1 || replayed[0] != "c" {
+		t.Fatalf("expected c to be left got %v %v %v", n, replayed, err)
+	}
+	if s.Pending() {
+		t.Fatal("spool should be empty")
+	}
+}
+
+func TestFull(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "spool"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(KindLoop, "1", "0123456789"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(KindLoop, "2", "0123456789"); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected full got %v", err)
+	}
+}
+
+func TestAppendDuringReplay(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "spool"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b"} {
+		if err = s.Append(KindSummary, key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	down := errors.New("down")
+	_, err = s.Replay(func(e Entry) error {
+		// the live path appends while the database is slow
+		if appendErr := s.Append(KindLoop, "during-"+e.Key, e.Key); appendErr != nil {
+			t.Fatal(appendErr)
+		}
+		if e.Key == "b" {
+			return down
+		}
+		return nil
+	})
+	if err != down {
+		t.Fatalf("expected to stop at b got %v", err)
+	}
+
+	var left []string
+	if _, err = s.Replay(func(e Entry) error {
+		left = append(left, e.Key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 3 || left[0] != "b" || left[1] != "during-a" || left[2] != "during-b" {
+		t.Fatalf("expected b and the appends after it got %v", left)
+	}
+}
+
+func TestAppendAfterTornTail(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "spool")
+	s, err := Open(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Append(KindSummary, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	// a crash part way through the next append
+	f, _ := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("1234abcd {\"kind\":")
+	f.Close()
+
+	s, err = Open(fileName, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.Append(KindSummary, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	var replayed []string
+	n, err := s.Replay(func(e Entry) error {
+		replayed = append(replayed, e.Key)
+		return nil
+	})
+	if err != nil || n != 2 || replayed[0] != "a" || replayed[1] != "b" {
+		t.Fatalf("expected a and b replayed got %v %v %v", n, replayed, err)
+	}
+}
@@ -16,7 +16,8 @@ const DATA_RECORD_LENGTH = 52
 type ArchiveRecord struct {
 	ArchivePage       int
 	ArchivePageRecord int
-	ArchiveTime       time.Time
+	ArchiveTime       time.Time // console time in the station time zone
+	HostTime          time.Time // ArchiveTime moved onto the host clock, UTC
 	OutsideTemp       float32
 	HighOutsideTemp   float32
 	LowOutsideTemp    float32
@@ -130,6 +131,9 @@ func (vc *Conn) dmpArchive(pages, firstRecordOffset int, archiveChan chan *Archi
 		}
 	*/
 	pkt := make([]byte, PAGE_SIZE)
+	// records come out oldest first so the previous time resolves
+	// the repeated hour at the end of DST
+	var prev time.Time
 	for i := 0; i < pages; i++ {
 		vc.conn.SetReadDeadline(time.Now().Add(30 * time.Second))
 		c, err := io.ReadFull(vc.buf, pkt)
@@ -146,13 +150,14 @@ func (vc *Conn) dmpArchive(pages, firstRecordOffset int, archiveChan chan *Archi
 		//log.Printf("%v of %v Got pkt: %v crcC: %x s: %x\n", i, c, pkt, crcCalc, crcSent)
 		var toSend byte = ACK
 		if crcCalc == crcSent {
-			ars, err := parseArchive(pkt)
+			ars, err := parseArchive(pkt, vc.Clock, prev)
 			if err != nil { //TODO
 			}
 			for j, ar := range ars {
 				if (i > 0 && i < 512) ||
 					(i == 0 && j >= firstRecordOffset) ||
 					(i == 512 && j < firstRecordOffset) {
+					prev = ar.ArchiveTime
 					archiveChan <- ar
 				}
 			}
@@ -177,19 +182,21 @@ func (vc *Conn) dmpArchive(pages, firstRecordOffset int, archiveChan chan *Archi
 	close(archiveChan)
 }
 
-func parseArchive(pkt []byte) ([]*ArchiveRecord, error) {
+func parseArchive(pkt []byte, clock *Clock, prev time.Time) ([]*ArchiveRecord, error) {
 	ret := make([]*ArchiveRecord, 0, 5)
 	for i := 0; i < 5; i++ {
 		dr := pkt[i*DATA_RECORD_LENGTH+1 : (i+1)*DATA_RECORD_LENGTH]
-		tm := parseArchiveTime(toInt(dr[0], dr[1]), toInt(dr[2], dr[3]))
+		tm := parseArchiveTime(toInt(dr[0], dr[1]), toInt(dr[2], dr[3]), clock, prev)
 		if tm == (time.Time{}) {
 			continue
 		}
+		prev = tm
 		// TODO CRC
 		ar := &ArchiveRecord{
 			ArchivePage:       int(pkt[0]),
 			ArchivePageRecord: i,
 			ArchiveTime:       tm,
+			HostTime:          clock.HostTime(tm),
 			OutsideTemp:       float32(toInt(dr[4], dr[5])) / 10,
 			HighOutsideTemp:   float32(toInt(dr[6], dr[7])) / 10,
 			LowOutsideTemp:    float32(toInt(dr[8], dr[9])) / 10,
@@ -203,8 +210,8 @@ func parseArchive(pkt []byte) ([]*ArchiveRecord, error) {
 			OutsideHumidity:   int(dr[23]),
 			WindAvg:           int(dr[24]),
 			WindMax:           int(dr[25]),
-			WindMaxDir:        archiveDirectionLookup[int(26)],
-			WindDir:           archiveDirectionLookup[int(27)],
+			WindMaxDir:        archiveDirectionLookup[int(dr[26])],
+			WindDir:           archiveDirectionLookup[int(dr[27])],
 			UVIndexAvg:        float32(int(dr[28])) / 10,
 			ET:                float32(int(dr[29])) / 1000,
 			HighSolarRad:      toInt(dr[30], dr[31]),
@@ -223,8 +230,10 @@ func parseArchive(pkt []byte) ([]*ArchiveRecord, error) {
 	return ret, nil
 }
 
+// archiveDirectionLookup converts the archive's compass points to degrees
+// like the loop packet has them: north is 360 and 0 is no reading
 var archiveDirectionLookup map[int]int = map[int]int{
-	0:   0,   // N
+	0:   360, // N
 	1:   22,  // NNE
 	2:   45,  // NE
 	3:   67,  // ENE
@@ -243,7 +252,10 @@ var archiveDirectionLookup map[int]int = map[int]int{
 	255: 0,
 }
 
-func parseArchiveTime(dt, tm int) time.Time {
+// parseArchiveTime converts the console's packed date and time. The console
+// has no notion of zone so the time is resolved in the station time zone,
+// using prev to pick the right instant during the repeated DST hour.
+func parseArchiveTime(dt, tm int, clock *Clock, prev time.Time) time.Time {
 	if dt == 0 {
 		return time.Time{}
 	}
@@ -251,7 +263,7 @@ func parseArchiveTime(dt, tm int) time.Time {
 	month := time.Month((dt >> 5) & 0xF) // 4 bits
 	year := (dt >> 9) + 2000             // 7 bits
 	hour := tm / 100
-	min := tm - hour
+	min := tm - hour*100
 
-	return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	return clock.WallTime(year, month, day, hour, min, 0, prev)
 }
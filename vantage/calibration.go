@@ -0,0 +1,82 @@
+package vantage
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Calibration corrects the readings of sensors that are known to be off.
+// The zero value changes nothing.
+type Calibration struct {
+	WindScale             float64 // multiplies wind speeds, 0 is the same as 1
+	WindDirectionOffset   int     // degrees added to the direction
+	OutsideTempOffset     float64 // F
+	OutsideHumidityOffset int     // %
+	BarometerOffset       float64 // in Hg
+}
+
+// ParseCalibration parses a comma separated list like
+// "wind=1.05,direction=-10,temp=-0.5,humidity=3,barometer=0.02"
+func ParseCalibration(calibration string) (*Calibration, error) {
+	c := &Calibration{}
+	for _, part := range strings.Split(calibration, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad calibration %q, expected name=value", part)
+		}
+		value, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad calibration %q: %w", part, err)
+		}
+		switch kv[0] {
+		case "wind":
+			c.WindScale = value
+		case "direction":
+			c.WindDirectionOffset = int(math.Round(value))
+		case "temp":
+			c.OutsideTempOffset = value
+		case "humidity":
+			c.OutsideHumidityOffset = int(math.Round(value))
+		case "barometer":
+			c.BarometerOffset = value
+		default:
+			return nil, fmt.Errorf("unknown calibration %q, use wind, direction, temp, humidity or barometer", kv[0])
+		}
+	}
+	return c, nil
+}
+
+// Apply corrects the loop record in place. A nil calibration does nothing.
+func (c *Calibration) Apply(lr *LoopRecord) {
+	if c == nil {
+		return
+	}
+	if c.WindScale != 0 {
+		lr.Wind = int(math.Round(float64(lr.Wind) * c.WindScale))
+		lr.WindAvg = int(math.Round(float64(lr.WindAvg) * c.WindScale))
+	}
+	// 0 is no reading, north is 360
+	if lr.WindDirection != 0 && c.WindDirectionOffset != 0 {
+		lr.WindDirection = ((lr.WindDirection+c.WindDirectionOffset)%360 + 360) % 360
+		if lr.WindDirection == 0 {
+			lr.WindDirection = 360
+		}
+	}
+	lr.OutsideTempRaw += int(math.Round(c.OutsideTempOffset * 10))
+	if c.OutsideHumidityOffset != 0 {
+		lr.OutsideHumidity += c.OutsideHumidityOffset
+		if lr.OutsideHumidity < 0 {
+			lr.OutsideHumidity = 0
+		}
+		if lr.OutsideHumidity > 100 {
+			lr.OutsideHumidity = 100
+		}
+	}
+	lr.BarometerRaw += int(math.Round(c.BarometerOffset * 1000))
+}
@@ -0,0 +1,18 @@
+package vantage
+
+import "testing"
+
+func TestCalibration(t *testing.T) {
+	c, err := ParseCalibration("wind=1.5, direction=-10,temp=-0.5,humidity=5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lr := &LoopRecord{Wind: 10, WindAvg: 3, WindDirection: 10, OutsideTempRaw: 650, OutsideHumidity: 98}
+	c.Apply(lr)
+	if lr.Wind != 15 || lr.WindAvg != 5 || lr.WindDirection != 360 || lr.OutsideTempRaw != 645 || lr.OutsideHumidity != 100 {
+		t.Fatalf("unexpected calibrated record %+v", lr)
+	}
+	if _, err = ParseCalibration("gust=2"); err == nil {
+		t.Fatal("expected error for unknown calibration")
+	}
+}
@@ -0,0 +1,191 @@
+package vantage
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// offsets that jump by more than this are treated as the console clock being
+// reset (or switching DST) rather than drift so the average starts over
+const clockResetThreshold = 5 * time.Minute
+
+// Clock tracks the offset between the console clock and the host clock.
+// The console keeps wall time for the station's time zone with no zone
+// information, so Location is needed to turn console readings into instants.
+//
+// The policy for the rest of windygo is that the host clock is the canonical
+// timeline: loop packets are stamped with the host receive time and archive
+// records (which only have console time) are moved onto the host timeline
+// using the tracked offset. Everything is stored in UTC and only converted to
+// Location for display. A nil *Clock is valid and assumes the two clocks agree
+// and the station is in time.Local.
+type Clock struct {
+	location *time.Location
+	mutex    sync.Mutex
+	offset   time.Duration // console - host
+	samples  int
+	synced   time.Time // host time of the last observation
+}
+
+func NewClock(location *time.Location) *Clock {
+	if location == nil {
+		location = time.Local
+	}
+	return &Clock{location: location}
+}
+
+// Location is the station time zone
+func (c *Clock) Location() *time.Location {
+	if c == nil {
+		return time.Local
+	}
+	return c.location
+}
+
+// Observe records a reading of the console clock taken at host time.
+// Readings are averaged so the 1s resolution of the console evens out.
+func (c *Clock) Observe(console, host time.Time) {
+	sample := console.Sub(host)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	diff := sample - c.offset
+	if diff < 0 {
+		diff = -diff
+	}
+	if c.samples == 0 || diff > clockResetThreshold {
+		if c.samples > 0 {
+			log.Printf("Console clock jumped from %v to %v, resetting offset", c.offset, sample)
+		}
+		c.offset = sample
+		c.samples = 1
+	} else {
+		// moving average over the last ~8 readings
+		n := c.samples
+		if n > 7 {
+			n = 7
+		}
+		c.offset += (sample - c.offset) / time.Duration(n+1)
+		c.samples++
+	}
+	c.synced = host
+}
+
+// Offset is console time minus host time
+func (c *Clock) Offset() time.Duration {
+	if c == nil {
+		return 0
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.offset
+}
+
+// Synced returns the host time of the last console reading and false if the
+// console clock has never been read
+func (c *Clock) Synced() (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.synced, c.samples > 0
+}
+
+// ConsoleTime converts a host timestamp to what the console clock read at
+// that moment
+func (c *Clock) ConsoleTime(host time.Time) time.Time {
+	return host.Add(c.Offset()).In(c.Location())
+}
+
+// HostTime converts a console timestamp onto the host timeline
+func (c *Clock) HostTime(console time.Time) time.Time {
+	return console.Add(-c.Offset()).UTC()
+}
+
+// ParseLoop parses a loop packet and fills in the console time using the
+// current offset
+func (c *Clock) ParseLoop(pktFull []byte) *LoopRecord {
+	lr := ParseLoop(pktFull)
+	lr.ConsoleTime = c.ConsoleTime(lr.Recorded)
+	return lr
+}
+
+// WallTime converts a console wall clock reading into an instant. During the
+// repeated hour when DST ends the wall time is ambiguous, so the earliest
+// instant at or after hint is chosen (or the latest if they are all before
+// hint). A zero hint picks the earlier instant.
+func (c *Clock) WallTime(year int, month time.Month, day, hour, min, sec int, hint time.Time) time.Time {
+	return resolveWallTime(year, month, day, hour, min, sec, c.Location(), hint)
+}
+
+func resolveWallTime(year int, month time.Month, day, hour, min, sec int, loc *time.Location, hint time.Time) time.Time {
+	t := time.Date(year, month, day, hour, min, sec, 0, loc)
+	// the ambiguous instants are an hour apart; collect them in order
+	candidates := make([]time.Time, 0, 2)
+	if earlier := t.Add(-time.Hour); sameWallTime(earlier, t) {
+		candidates = append(candidates, earlier)
+	}
+	candidates = append(candidates, t)
+	if later := t.Add(time.Hour); sameWallTime(later, t) {
+		candidates = append(candidates, later)
+	}
+	for _, candidate := range candidates {
+		if !candidate.Before(hint) {
+			return candidate
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+func sameWallTime(a, b time.Time) bool {
+	ay, am, ad := a.Date()
+	by, bm, bd := b.Date()
+	return ay == by && am == bm && ad == bd &&
+		a.Hour() == b.Hour() && a.Minute() == b.Minute() && a.Second() == b.Second()
+}
+
+// GetTime reads the console clock. The result is resolved in the station time
+// zone using the host clock as the hint for the ambiguous DST hour.
+func (vc *Conn) GetTime() (time.Time, error) {
+	err := vc.sendAckCommand("GETTIME\n")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("GETTIME command failed: %w", err)
+	}
+	buf := make([]byte, 8)
+	vc.conn.SetReadDeadline(time.Now().Add(time.Second))
+	c, err := io.ReadFull(vc.buf, buf)
+	if err != nil {
+		if c > 0 {
+			log.Printf("Got bytes: %v", buf[:c])
+		}
+		return time.Time{}, fmt.Errorf("error reading GETTIME response: %w", err)
+	}
+	crcCalc := int(crcData(buf[:6]))
+	crcSent := toInt(buf[7], buf[6])
+	if crcCalc != crcSent {
+		return time.Time{}, fmt.Errorf("CRC check failed on GETTIME s:%x c:%x", crcSent, crcCalc)
+	}
+	// allow some slack since the console truncates to the second
+	hint := time.Now().Add(vc.Clock.Offset() - time.Minute)
+	return vc.Clock.WallTime(int(buf[5])+1900, time.Month(buf[4]), int(buf[3]),
+		int(buf[2]), int(buf[1]), int(buf[0]), hint), nil
+}
+
+// SyncClock reads the console clock and records the offset in vc.Clock.
+// The host time used is the midpoint of the request to cancel out latency.
+func (vc *Conn) SyncClock() error {
+	if vc.Clock == nil {
+		return nil
+	}
+	sent := time.Now()
+	console, err := vc.GetTime()
+	if err != nil {
+		return err
+	}
+	received := time.Now()
+	vc.Clock.Observe(console, sent.Add(received.Sub(sent)/2))
+	return nil
+}
@@ -0,0 +1,40 @@
+package vantage
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWallTimeFallBack(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skipf("no tzdata: %v", err)
+	}
+	clock := NewClock(la)
+	// 2021-11-07 01:30 happens twice in LA
+	first := clock.WallTime(2021, time.November, 7, 1, 30, 0, time.Time{})
+	if _, offset := first.Zone(); offset != -7*3600 {
+		t.Fatalf("expected PDT for zero hint, got %v", first)
+	}
+	second := clock.WallTime(2021, time.November, 7, 1, 0, 0, first)
+	if second.Sub(first) != 30*time.Minute {
+		t.Fatalf("expected the repeated hour 30m after %v, got %v", first, second)
+	}
+}
+
+func TestClockObserve(t *testing.T) {
+	clock := NewClock(time.UTC)
+	host := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock.Observe(host.Add(10*time.Second), host)
+	clock.Observe(host.Add(12*time.Second), host)
+	if clock.Offset() != 11*time.Second {
+		t.Fatalf("expected averaged offset of 11s got %v", clock.Offset())
+	}
+	clock.Observe(host.Add(time.Hour), host)
+	if clock.Offset() != time.Hour {
+		t.Fatalf("expected reset offset of 1h got %v", clock.Offset())
+	}
+	if got := clock.HostTime(host.Add(time.Hour)); !got.Equal(host) {
+		t.Fatalf("expected host time %v got %v", host, got)
+	}
+}
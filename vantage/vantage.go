@@ -34,6 +34,8 @@ type Conn struct {
 	conn    net.Conn
 	buf     *bufio.Reader
 	state   ConnState
+	// Clock tracks the console clock offset; it may be nil
+	Clock *Clock
 }
 
 func Dial(address string) (*Conn, error) {
@@ -148,7 +150,8 @@ var BarTrendMap = map[byte]string{
 
 type LoopRecord struct {
 	// TODO everything else
-	Recorded        time.Time `sql:"index"`
+	Recorded        time.Time `sql:"index"` // host receive time
+	ConsoleTime     time.Time // console clock at Recorded
 	Wind            int       // mph
 	WindDirection   int       // degrees
 	WindAvg         int       // mph
@@ -174,6 +177,7 @@ func ParseLoop(pktFull []byte) *LoopRecord {
 	pkt := pktFull[8:]
 	lr := &LoopRecord{
 		Recorded:        recorded,
+		ConsoleTime:     recorded,
 		Wind:            int(pkt[14]),
 		WindDirection:   toInt(pkt[16], pkt[17]),
 		WindAvg:         int(pkt[15]),
@@ -266,7 +270,10 @@ func (v *Conn) Close() error {
 
 type LoopHandler func(loopPkt []byte)
 
-func CollectDataForever(host string, handler LoopHandler) {
+// CollectDataForever reconnects and loops forever, passing each packet
+// to handler. The console clock is read between loop batches to keep
+// the offset in clock up to date; clock may be nil.
+func CollectDataForever(host string, clock *Clock, handler LoopHandler) {
 	var vc *Conn
 	var err error
 	loopChan := make(chan []byte, 100)
@@ -284,7 +291,11 @@ func CollectDataForever(host string, handler LoopHandler) {
 		}
 
 		log.Printf("Connected to %v", host)
+		vc.Clock = clock
 		for err == nil {
+			if syncErr := vc.SyncClock(); syncErr != nil {
+				log.Printf("Error reading console time: %v", syncErr)
+			}
 			//log.Printf("Looping 60 times")
 			err = vc.Loop(60, loopChan, errChan)
 			if err != nil {